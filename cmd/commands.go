@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lucheng0127/narwhal/internal/pkg/config"
+	"github.com/lucheng0127/narwhal/internal/pkg/version"
+)
+
+func addCommands(parser *flags.Parser) {
+	parser.AddCommand("server", "Run server",
+		"Serve clients and visitors, listen port and users are taken from config file or flags.",
+		&serverCommand{})
+	parser.AddCommand("client", "Run client",
+		"Bind remote port of server or register secret service, proxy it to local port.",
+		&clientCommand{})
+	parser.AddCommand("visitor", "Run visitor of secret service",
+		"Proxy local port to secret service registered by another client.",
+		&visitorCommand{})
+	parser.AddCommand("forward", "Run forward client",
+		"Proxy local port to target dialed by server.",
+		&forwardCommand{})
+	parser.AddCommand("check-config", "Check config",
+		"Parse and validate config file, environment variables and flags, then print the effective config with secrets redacted unless --show-secrets.",
+		&checkConfigCommand{})
+	parser.AddCommand("version", "Show version",
+		"Show version and build info.",
+		&versionCommand{})
+	addUserCommands(parser)
+}
+
+type serverCommand struct {
+	Port string `long:"port" description:"listen port, override port"`
+}
+
+func (c *serverCommand) Execute(args []string) error {
+	return launch(config.ModeServer, true, map[string]string{
+		"port": c.Port,
+	})
+}
+
+type clientCommand struct {
+	Host         string `long:"host" description:"server address host:port or transport url, override host"`
+	Proxy        string `long:"proxy" description:"egress proxy url, http://host:port or socks5://host:port, override proxy"`
+	Uid          string `long:"uuid" description:"user id, override uuid"`
+	Token        string `long:"token" description:"token auth with, jwt or invite, override token"`
+	IdentityFile string `short:"i" long:"identity-file" description:"ssh private key auth with, override identityFile"`
+	RemotePort   string `long:"rport" description:"remote port bound on server, override rPort"`
+	LocalPort    string `long:"lport" description:"local port, override lPort"`
+	Service      string `long:"service" description:"secret service name, override service"`
+	Key          string `long:"key" description:"secret service key, override key"`
+}
+
+func (c *clientCommand) Execute(args []string) error {
+	return launch(config.ModeClient, false, map[string]string{
+		"host":         c.Host,
+		"proxy":        c.Proxy,
+		"uuid":         c.Uid,
+		"token":        c.Token,
+		"identityFile": c.IdentityFile,
+		"rPort":        c.RemotePort,
+		"lPort":        c.LocalPort,
+		"service":      c.Service,
+		"key":          c.Key,
+	})
+}
+
+type visitorCommand struct {
+	Host      string `long:"host" description:"server address host:port or transport url, override host"`
+	Proxy     string `long:"proxy" description:"egress proxy url, http://host:port or socks5://host:port, override proxy"`
+	LocalPort string `long:"lport" description:"local port, override lPort"`
+	Service   string `long:"service" description:"secret service name, override service"`
+	Key       string `long:"key" description:"secret service key, override key"`
+}
+
+func (c *visitorCommand) Execute(args []string) error {
+	return launch(config.ModeVisitor, false, map[string]string{
+		"host":    c.Host,
+		"proxy":   c.Proxy,
+		"lPort":   c.LocalPort,
+		"service": c.Service,
+		"key":     c.Key,
+	})
+}
+
+type forwardCommand struct {
+	Host         string `long:"host" description:"server address host:port or transport url, override host"`
+	Proxy        string `long:"proxy" description:"egress proxy url, http://host:port or socks5://host:port, override proxy"`
+	Uid          string `long:"uuid" description:"user id, override uuid"`
+	Token        string `long:"token" description:"jwt auth with, override token"`
+	IdentityFile string `short:"i" long:"identity-file" description:"ssh private key auth with, override identityFile"`
+	LocalPort    string `long:"lport" description:"local port, override lPort"`
+	Target       string `long:"target" description:"target host:port dialed by server, override target"`
+}
+
+func (c *forwardCommand) Execute(args []string) error {
+	return launch(config.ModeForward, false, map[string]string{
+		"host":         c.Host,
+		"proxy":        c.Proxy,
+		"uuid":         c.Uid,
+		"token":        c.Token,
+		"identityFile": c.IdentityFile,
+		"lPort":        c.LocalPort,
+		"target":       c.Target,
+	})
+}
+
+type checkConfigCommand struct {
+	Mode        string `long:"mode" description:"mode(server, client, visitor, forward), override mode"`
+	Output      string `long:"output" description:"format of effective config printed" choice:"yaml" choice:"json" choice:"toml" default:"yaml"`
+	ShowSecrets bool   `long:"show-secrets" description:"print tokens, keys, header values, proxy userinfo and uids as is, they are redacted by default"`
+}
+
+func (c *checkConfigCommand) Execute(args []string) error {
+	conf, err := loadConfig(c.Mode, c.Mode == "" || c.Mode == config.ModeServer, nil)
+	if err != nil {
+		return fmt.Errorf("load config %s", err.Error())
+	}
+
+	marshal := config.MarshalRedacted
+	if c.ShowSecrets {
+		marshal = config.Marshal
+	}
+	data, err := marshal(conf, c.Output)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+	return nil
+}
+
+type versionCommand struct{}
+
+func (c *versionCommand) Execute(args []string) error {
+	fmt.Println(version.BuildInfo())
+	return nil
+}
@@ -7,72 +7,259 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	"github.com/lucheng0127/narwhal/internal/pkg/config"
 	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
 	"github.com/lucheng0127/narwhal/internal/pkg/utils"
 	"github.com/lucheng0127/narwhal/internal/pkg/version"
 	"github.com/lucheng0127/narwhal/pkg/proxy"
-	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
+const defaultConfigFile = "/etc/narwhal/config.yaml"
+
+// globalOptions are options of all commands, flags and NARWHAL_* environment
+// variables override config file, e.g. --set timeout.hello=5s or
+// NARWHAL_TIMEOUT_HELLO=5s
+type globalOptions struct {
+	ConfigFile string   `short:"f" long:"config-file" description:"config file, /etc/narwhal/config.yaml is used by server when exists and not set"`
+	ConfigType string   `short:"t" long:"config-type" description:"config file type(toml, yaml, json), detected from file extension when not set"`
+	Set        []string `short:"o" long:"set" description:"set config key, key=value, e.g. timeout.hello=5s, users.admin=22,80"`
+	LogLevel   string   `short:"l" long:"log-level" description:"log level(debug, info, warn, error), override log.level"`
+	LogFormat  string   `long:"log-format" description:"log format(text, json), override log.format"`
+	Version    bool     `long:"version" description:"show version info"`
+}
+
+var opts globalOptions
+
 func main() {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// Parse command line arguments
-	var opts struct {
-		ConfigFile string `short:"f" long:"config-file" description:"config file" default:"/etc/narwhal/config.yaml"`
-		ConfigType string `short:"t" long:"config-type" description:"config file type(toml, yaml, json)" default:"yaml"`
-		LogLevel   string `short:"l" long:"log-level" description:"log level"`
-		Version    bool   `long:"version" description:"show version info"`
-	}
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	parser.LongDescription = "Narwhal expose local ports behind NAT through server.\n\n" +
+		"Without command, narwhal runs mode of config file."
+	// Run mode of config file when no command, as before commands added
+	parser.SubcommandsOptional = true
+	addCommands(parser)
+
+	_, err := parser.Parse()
 	if err != nil {
+		if fErr, ok := err.(*flags.Error); ok {
+			if fErr.Type == flags.ErrHelp {
+				fmt.Println(fErr.Message)
+				os.Exit(0)
+			}
+			fmt.Fprintln(os.Stderr, fErr.Message)
+			os.Exit(1)
+		}
+		logger.Error(utils.NewTraceContext(), "narwhal", logger.Fields{logger.FieldError: err})
 		os.Exit(1)
 	}
+	if parser.Active != nil {
+		return
+	}
 
 	if opts.Version {
 		fmt.Println("Narwhal version ", version.Version())
 		os.Exit(0)
 	}
+	if err := launch("", true, nil); err != nil {
+		logger.Error(utils.NewTraceContext(), "narwhal", logger.Fields{logger.FieldError: err})
+		os.Exit(1)
+	}
+}
 
-	// Set log
-	switch opts.LogLevel {
-	case "debug":
-		logger.SetLevel(logrus.DebugLevel)
-	case "warn":
-		logger.SetLevel(logrus.WarnLevel)
-	case "info":
-		logger.SetLevel(logrus.InfoLevel)
-	default:
-		logger.SetLevel(logrus.InfoLevel)
+// loadConfig load config of mode, mode of config is used when mode empty,
+// values not empty override keys of config. Default config file is used
+// when useDefault and config file not set
+func loadConfig(mode string, useDefault bool, values map[string]string) (config.ConfigSet, error) {
+	overrides := make(config.Overrides)
+	for _, kv := range opts.Set {
+		if err := overrides.Set(kv); err != nil {
+			return nil, fmt.Errorf("flag --set %s", err.Error())
+		}
+	}
+	if len(mode) != 0 {
+		overrides["mode"] = mode
+	}
+	if len(opts.LogLevel) != 0 {
+		overrides["log.level"] = opts.LogLevel
+	}
+	if len(opts.LogFormat) != 0 {
+		overrides["log.format"] = opts.LogFormat
+	}
+	for key, value := range values {
+		if len(value) != 0 {
+			overrides[key] = value
+		}
 	}
 
+	confFile := opts.ConfigFile
+	if len(confFile) == 0 && useDefault {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			confFile = defaultConfigFile
+		}
+	}
+	return config.Load(confFile, opts.ConfigType, os.Environ(), overrides)
+}
+
+// launch load config of mode and run it until stopped by signal
+func launch(mode string, useDefault bool, values map[string]string) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, notifySignals...)
+
 	ctx := utils.NewTraceContext()
-	// Parse config file
-	conf, err := config.ReadConfigFile(opts.ConfigFile, opts.ConfigType)
+	conf, err := loadConfig(mode, useDefault, values)
 	if err != nil {
-		logger.Error(ctx, err.Error())
-		os.Exit(1)
+		return fmt.Errorf("load config %s", err.Error())
+	}
+
+	// Set log
+	var logConf config.LogConfig
+	var tracingConf config.TracingConfig
+	switch confSet := conf.(type) {
+	case *config.ClientConfigSet:
+		logConf = confSet.Log
+		tracingConf = confSet.Tracing
+	case *config.ServerConfigSet:
+		logConf = confSet.Log
+		tracingConf = confSet.Tracing
+	}
+	if err := setLog(logConf); err != nil {
+		return fmt.Errorf("set log %s", err.Error())
+	}
+
+	// Set tracing
+	shutdownTracing, err := telemetry.Setup(telemetry.Config{
+		Exporter:    tracingConf.Exporter,
+		File:        tracingConf.File,
+		Endpoint:    tracingConf.Endpoint,
+		Insecure:    tracingConf.Insecure,
+		SampleRatio: tracingConf.SampleRatio,
+	})
+	if err != nil {
+		return fmt.Errorf("set tracing %s", err.Error())
 	}
 
 	// Launch server
 	var s proxy.Server
 	switch confSet := conf.(type) {
 	case *config.ClientConfigSet:
+		var signer ssh.Signer
+		if len(confSet.IdentityFile) != 0 {
+			signer, err = proxy.ReadIdentityFile(confSet.IdentityFile)
+			if err != nil {
+				return err
+			}
+		}
+		remote, err := confSet.Endpoint()
+		if err != nil {
+			return err
+		}
 		s = proxy.NewClientServer(
 			proxy.Host(confSet.Host),
-			proxy.RemotePort(conf.(*config.ClientConfigSet).RemotePort),
-			proxy.LocalPort(conf.(*config.ClientConfigSet).LocalPort),
-			proxy.Uid(conf.(*config.ClientConfigSet).Uid),
+			proxy.Remote(remote),
+			proxy.RemotePort(uint16(confSet.RemotePort)),
+			proxy.LocalPort(uint16(confSet.LocalPort)),
+			proxy.Uid(confSet.Uid),
+			proxy.Token(confSet.Token),
+			proxy.Signer(signer),
+			proxy.SecretService(confSet.Service, confSet.Key),
+			proxy.Visitor(confSet.Mode == config.ModeVisitor),
+			proxy.Target(confSet.Target),
 		)
 	case *config.ServerConfigSet:
+		userOpt := proxy.StaticUsers(confSet.StaticUsers())
+		if confSet.UserStore.Type != config.UserStoreStatic {
+			store, err := openUserManager(confSet.UserStore)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			userOpt = proxy.Store(store)
+		}
+		var verifier *proxy.JWTVerifier
+		if len(confSet.JWT.JWKS) != 0 || len(confSet.JWT.PublicKey) != 0 {
+			verifier, err = proxy.NewJWTVerifier(proxy.JWTPolicy{
+				JWKS:      confSet.JWT.JWKS,
+				PublicKey: confSet.JWT.PublicKey,
+				Audience:  confSet.JWT.Audience,
+				Issuer:    confSet.JWT.Issuer,
+				Leeway:    confSet.JWT.Leeway,
+			})
+			if err != nil {
+				return fmt.Errorf("load jwt keys %s", err.Error())
+			}
+		}
+
+		var authKeys *proxy.AuthorizedKeys
+		if len(confSet.AuthorizedKeys) != 0 {
+			authKeys, err = proxy.NewAuthorizedKeys(confSet.AuthorizedKeys)
+			if err != nil {
+				return fmt.Errorf("open authorized keys %s", err.Error())
+			}
+		}
+
+		var invites *proxy.Invites
+		if len(confSet.Invites) != 0 {
+			invites, err = proxy.NewInvites(confSet.Invites)
+			if err != nil {
+				return err
+			}
+		}
+
+		listen, err := confSet.Endpoint()
+		if err != nil {
+			return err
+		}
+
 		s = proxy.NewProxyServer(
-			proxy.ListenPort(conf.(*config.ServerConfigSet).Port),
-			proxy.Users(conf.(*config.ServerConfigSet).Users))
+			proxy.ListenPort(confSet.Port),
+			proxy.Listen(listen),
+			userOpt,
+			proxy.HelloTimeout(confSet.Timeout.Hello),
+			proxy.AuthTimeout(confSet.Timeout.Auth),
+			proxy.BindTimeout(confSet.Timeout.Bind),
+			proxy.IdleTimeout(confSet.Timeout.Idle),
+			proxy.MaxHandshakes(confSet.MaxHandshakes),
+			proxy.Guard(proxy.GuardPolicy{
+				MaxFailures: confSet.Guard.MaxFailures,
+				Window:      confSet.Guard.Window,
+				BanDuration: confSet.Guard.BanDuration,
+				BaseDelay:   confSet.Guard.BaseDelay,
+				MaxDelay:    confSet.Guard.MaxDelay,
+			}),
+			proxy.Forwards(confSet.Forwards),
+			proxy.JWT(verifier),
+			proxy.KeyAuth(authKeys),
+			proxy.InviteAuth(invites),
+			proxy.Sessions(confSet.SessionPolicy()),
+			proxy.Webhook(proxy.WebhookPolicy{
+				URL:      confSet.Webhook.URL,
+				Timeout:  confSet.Webhook.Timeout,
+				CacheTTL: confSet.Webhook.CacheTTL,
+				FailOpen: confSet.Webhook.FailOpen,
+				Visitors: confSet.Webhook.Visitors,
+				Headers:  confSet.Webhook.Headers,
+				Metadata: confSet.Webhook.Metadata,
+			}),
+			proxy.AccessLog(proxy.AccessLogPolicy{
+				File:       confSet.AccessLog.File,
+				MaxSize:    confSet.AccessLog.MaxSize,
+				MaxBackups: confSet.AccessLog.MaxBackups,
+				MaxAge:     confSet.AccessLog.MaxAge,
+				Compress:   confSet.AccessLog.Compress,
+			}))
+	}
+
+	if sConf, ok := conf.(*config.ServerConfigSet); ok && len(sConf.PidFile) != 0 {
+		if err := writePidFile(sConf.PidFile); err != nil {
+			return fmt.Errorf("write pid file %s", err.Error())
+		}
+		defer os.Remove(sConf.PidFile)
 	}
 
 	go func() {
@@ -83,9 +270,116 @@ func main() {
 	}()
 	logger.Info(ctx, "Narwhal started")
 
-	// Exist with signal
-	<-sigCh
+	// Dump bans with SIGUSR1, reload users and jwt keys with SIGHUP, exist
+	// with other signals
+	for sig := range sigCh {
+		if isDumpSignal(sig) {
+			dumpBans(ctx, s)
+			continue
+		}
+		if sig == syscall.SIGHUP {
+			reloadUsers(ctx, s, func() (config.ConfigSet, error) {
+				return loadConfig(mode, useDefault, values)
+			})
+			continue
+		}
+		break
+	}
 	stopServer(ctx, s)
+
+	// Flush spans not exported yet
+	tCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(tCtx); err != nil {
+		logger.Warn(ctx, "shutdown tracing", logger.Fields{logger.FieldError: err})
+	}
+	return nil
+}
+
+func setLog(conf config.LogConfig) error {
+	level := conf.Level
+	if len(level) == 0 {
+		level = "info"
+	}
+	if err := logger.SetLevelString(level); err != nil {
+		return err
+	}
+	if err := logger.SetFormat(conf.Format); err != nil {
+		return err
+	}
+	return logger.SetSinks(logger.Sinks{
+		File:          conf.File,
+		MaxSize:       conf.MaxSize,
+		MaxBackups:    conf.MaxBackups,
+		MaxAge:        conf.MaxAge,
+		Compress:      conf.Compress,
+		Syslog:        conf.Syslog.Enable,
+		SyslogNetwork: conf.Syslog.Network,
+		SyslogAddr:    conf.Syslog.Address,
+		SyslogTag:     conf.Syslog.Tag,
+		Journald:      conf.Journald,
+		Stderr:        conf.Stderr,
+	})
+}
+
+// openUserManager open user store of conf, except static store
+func openUserManager(conf config.UserStoreConfig) (proxy.UserManager, error) {
+	switch conf.Type {
+	case config.UserStoreDir:
+		return proxy.NewDirUserStore(conf.Path)
+	case config.UserStoreSQLite:
+		return proxy.NewSQLiteUserStore(conf.Path)
+	default:
+		return nil, fmt.Errorf("user store [%s] can't be opened", conf.Type)
+	}
+}
+
+// writePidFile write pid of narwhal to path, user commands signal it to
+// reload users
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// reloadUsers reload users, forwards and session policy of server from
+// config, and keys verifying tokens
+func reloadUsers(ctx context.Context, s proxy.Server, load func() (config.ConfigSet, error)) {
+	ps, ok := s.(*proxy.ProxyServer)
+	if !ok {
+		return
+	}
+
+	conf, err := load()
+	if err != nil {
+		logger.Error(ctx, "reload users", logger.Fields{logger.FieldError: err})
+		return
+	}
+	sConf, ok := conf.(*config.ServerConfigSet)
+	if !ok {
+		logger.Error(ctx, "reload users", logger.Fields{logger.FieldError: "mode of config changed to " + conf.GetMode()})
+		return
+	}
+	ps.Reload(sConf.StaticUsers(), sConf.Forwards)
+	ps.SetSessionPolicy(sConf.SessionPolicy())
+	logger.Info(ctx, "users reloaded", logger.Fields{"count": len(sConf.Users)})
+	if err := ps.ReloadKeys(); err != nil {
+		logger.Error(ctx, "reload jwt keys", logger.Fields{logger.FieldError: err})
+	}
+}
+
+func dumpBans(ctx context.Context, s proxy.Server) {
+	ps, ok := s.(*proxy.ProxyServer)
+	if !ok {
+		return
+	}
+
+	bans := ps.Bans()
+	logger.Info(ctx, "dump banned ips", logger.Fields{"count": len(bans)})
+	for _, ban := range bans {
+		logger.Info(ctx, "ip banned", logger.Fields{
+			logger.FieldIP: ban.IP,
+			"until":        ban.Until.Format(time.RFC3339),
+		})
+	}
 }
 
 func stopServer(ctx context.Context, s proxy.Server) {
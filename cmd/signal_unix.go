@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// notifySignals stop narwhal, or dump bans with SIGUSR1 and reload with
+// SIGHUP
+var notifySignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP}
+
+func isDumpSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR1
+}
+
+// signalHUP send SIGHUP to process of pid, nothing done when it's gone
+func signalHUP(pid int) error {
+	err := syscall.Kill(pid, syscall.SIGHUP)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
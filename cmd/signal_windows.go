@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// notifySignals stop narwhal, bans dump and reload by signal are not
+// supported on this platform
+var notifySignals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+
+func isDumpSignal(sig os.Signal) bool {
+	return false
+}
+
+func signalHUP(pid int) error {
+	return errors.New("reload signal not supported on this platform, restart server to apply users")
+}
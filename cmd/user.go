@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/lucheng0127/narwhal/internal/pkg/config"
+	"github.com/lucheng0127/narwhal/pkg/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func addUserCommands(parser *flags.Parser) {
+	cmd, _ := parser.AddCommand("user", "Manage users of server",
+		"Add, remove and list users of user store of server config. Users of static store are kept in "+
+			"config file, the file is backed up before rewritten, and the server of pidFile is signaled to reload users.",
+		&struct{}{})
+	cmd.AddCommand("add", "Add user",
+		"Add user with a generated uid unless --uid given, and print the uid.",
+		&userAddCommand{})
+	cmd.AddCommand("remove", "Remove user",
+		"Remove user and its forward rules.",
+		&userRemoveCommand{})
+	cmd.AddCommand("list", "List users",
+		"List users with their port specs and forward rules.",
+		&userListCommand{})
+	cmd.AddCommand("set-ports", "Set ports of user",
+		"Replace port spec of user.",
+		&userSetPortsCommand{})
+	cmd.AddCommand("invite", "Mint invite token",
+		"Mint a single-use token of invites directory of server config, and print it. The first client "+
+			"authenticating with it consumes it, and is disconnected when it expires.",
+		&userInviteCommand{})
+}
+
+// defaultInviteTTL is how long an invite lasts when neither --ttl nor
+// --expires-at given
+const defaultInviteTTL = 24 * time.Hour
+
+// validityOptions are options of when a credential can be used, times are
+// RFC 3339, ttl counts from not before or now
+type validityOptions struct {
+	NotBefore string        `long:"not-before" description:"time from which credential is valid, e.g. 2024-06-01T13:00:00Z"`
+	ExpiresAt string        `long:"expires-at" description:"time at which credential expires, e.g. 2024-06-01T18:00:00Z"`
+	TTL       time.Duration `long:"ttl" description:"duration credential is valid for, e.g. 4h, instead of --expires-at"`
+}
+
+// validity parse options into validity, zero for unbounded
+func (o *validityOptions) validity(now time.Time) (proxy.Validity, error) {
+	var v proxy.Validity
+	var err error
+	if len(o.NotBefore) != 0 {
+		if v.NotBefore, err = time.Parse(time.RFC3339, o.NotBefore); err != nil {
+			return v, fmt.Errorf("invalidate --not-before %s", err.Error())
+		}
+	}
+	if len(o.ExpiresAt) != 0 {
+		if o.TTL != 0 {
+			return v, errors.New("--expires-at and --ttl are exclusive")
+		}
+		if v.ExpiresAt, err = time.Parse(time.RFC3339, o.ExpiresAt); err != nil {
+			return v, fmt.Errorf("invalidate --expires-at %s", err.Error())
+		}
+	}
+	if o.TTL < 0 {
+		return v, fmt.Errorf("--ttl [%s] is negative", o.TTL)
+	}
+	if o.TTL > 0 {
+		from := now
+		if !v.NotBefore.IsZero() {
+			from = v.NotBefore
+		}
+		v.ExpiresAt = from.Add(o.TTL).Truncate(time.Second)
+	}
+	return v, nil
+}
+
+// formatTime format t for listing, - for zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// userOptions are options of user commands changing users
+type userOptions struct {
+	NoReload bool `long:"no-reload" description:"don't signal running server to reload users"`
+}
+
+// userEditor edit users of user store configured
+type userEditor interface {
+	AddUser(user proxy.User) error
+	RemoveUser(uid string) error
+	SetPorts(uid, ports string) error
+	ListUsers() ([]proxy.User, error)
+	Close() error
+}
+
+// fileUsers edit users of static store in config file
+type fileUsers struct {
+	f *config.UsersFile
+}
+
+func (u *fileUsers) AddUser(user proxy.User) error {
+	if err := u.f.Add(user.Uid, user.Ports); err != nil {
+		return err
+	}
+	return u.f.SetValidity(user.Uid, config.ValidityConfig{NotBefore: user.NotBefore, ExpiresAt: user.ExpiresAt})
+}
+
+func (u *fileUsers) RemoveUser(uid string) error {
+	return u.f.Remove(uid)
+}
+
+func (u *fileUsers) SetPorts(uid, ports string) error {
+	return u.f.SetPorts(uid, ports)
+}
+
+func (u *fileUsers) ListUsers() ([]proxy.User, error) {
+	fUsers, err := u.f.Users()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]proxy.User, 0, len(fUsers))
+	for _, fu := range fUsers {
+		users = append(users, proxy.User{
+			Uid:      fu.Uid,
+			Ports:    fu.Ports,
+			Validity: proxy.Validity{NotBefore: fu.Validity.NotBefore, ExpiresAt: fu.Validity.ExpiresAt},
+		})
+	}
+	return users, nil
+}
+
+func (u *fileUsers) Close() error {
+	return nil
+}
+
+// openUserEditor open users of user store of server config
+func openUserEditor() (userEditor, *config.ServerConfigSet, error) {
+	conf, err := loadConfig(config.ModeServer, true, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load config %s", err.Error())
+	}
+	sConf := conf.(*config.ServerConfigSet)
+
+	if sConf.UserStore.Type != config.UserStoreStatic {
+		m, err := openUserManager(sConf.UserStore)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, sConf, nil
+	}
+
+	path := opts.ConfigFile
+	if len(path) == 0 {
+		path = defaultConfigFile
+	}
+	f, err := config.OpenUsersFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &fileUsers{f: f}, sConf, nil
+}
+
+// saveUsers save users of config file, other stores are changed in place
+// already, then signal server of conf to reload unless noReload, so live
+// sessions of users changed are checked again
+func saveUsers(editor userEditor, conf *config.ServerConfigSet, noReload bool) error {
+	if fu, ok := editor.(*fileUsers); ok {
+		if err := fu.f.Save(); err != nil {
+			return err
+		}
+	}
+	if noReload {
+		return nil
+	}
+
+	if len(conf.PidFile) == 0 {
+		fmt.Fprintln(os.Stderr, "pidFile not set, restart server to apply users")
+		return nil
+	}
+	if err := signalReload(conf.PidFile); err != nil {
+		return fmt.Errorf("signal server to reload %s", err.Error())
+	}
+	return nil
+}
+
+// signalReload send SIGHUP to narwhal of pid file, nothing done when no
+// server running
+func signalReload(pidFile string) error {
+	data, err := os.ReadFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalidate pid file %s", pidFile)
+	}
+
+	return signalHUP(pid)
+}
+
+type userAddCommand struct {
+	userOptions
+	validityOptions
+	Uid   string `long:"uid" description:"uid of user, generated when not set"`
+	Ports string `long:"ports" description:"port spec, 0 for all, e.g. 22,80 or 8000-8100" default:"0"`
+}
+
+func (c *userAddCommand) Execute(args []string) error {
+	validity, err := c.validity(time.Now())
+	if err != nil {
+		return err
+	}
+	editor, conf, err := openUserEditor()
+	if err != nil {
+		return err
+	}
+	defer editor.Close()
+
+	uid := c.Uid
+	if len(uid) == 0 {
+		uid = uuid.NewV4().String()
+	}
+	if err := editor.AddUser(proxy.User{Uid: uid, Ports: c.Ports, Validity: validity}); err != nil {
+		return err
+	}
+	if err := saveUsers(editor, conf, c.NoReload); err != nil {
+		return err
+	}
+	fmt.Println(uid)
+	return nil
+}
+
+type userRemoveCommand struct {
+	userOptions
+	Args struct {
+		Uid string `positional-arg-name:"uid"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *userRemoveCommand) Execute(args []string) error {
+	editor, conf, err := openUserEditor()
+	if err != nil {
+		return err
+	}
+	defer editor.Close()
+	if err := editor.RemoveUser(c.Args.Uid); err != nil {
+		return err
+	}
+	return saveUsers(editor, conf, c.NoReload)
+}
+
+type userSetPortsCommand struct {
+	userOptions
+	Args struct {
+		Uid   string `positional-arg-name:"uid"`
+		Ports string `positional-arg-name:"ports"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (c *userSetPortsCommand) Execute(args []string) error {
+	editor, conf, err := openUserEditor()
+	if err != nil {
+		return err
+	}
+	defer editor.Close()
+	if err := editor.SetPorts(c.Args.Uid, c.Args.Ports); err != nil {
+		return err
+	}
+	return saveUsers(editor, conf, c.NoReload)
+}
+
+type userListCommand struct{}
+
+func (c *userListCommand) Execute(args []string) error {
+	editor, conf, err := openUserEditor()
+	if err != nil {
+		return err
+	}
+	defer editor.Close()
+	users, err := editor.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "UID\tPORTS\tNOT BEFORE\tEXPIRES AT\tFORWARDS")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Uid, u.Ports, formatTime(u.NotBefore), formatTime(u.ExpiresAt),
+			strings.Join(conf.Forwards[u.Uid], " "))
+	}
+	return w.Flush()
+}
+
+type userInviteCommand struct {
+	validityOptions
+	Uid   string `long:"uid" description:"uid of the session, generated when not set"`
+	Ports string `long:"ports" description:"port spec, 0 for all, e.g. 22,80 or 8000-8100" default:"0"`
+}
+
+func (c *userInviteCommand) Execute(args []string) error {
+	if len(c.ExpiresAt) == 0 && c.TTL == 0 {
+		c.TTL = defaultInviteTTL
+	}
+	validity, err := c.validity(time.Now())
+	if err != nil {
+		return err
+	}
+	conf, err := loadConfig(config.ModeServer, true, nil)
+	if err != nil {
+		return fmt.Errorf("load config %s", err.Error())
+	}
+	sConf := conf.(*config.ServerConfigSet)
+	if len(sConf.Invites) == 0 {
+		return errors.New("invites not set in server config")
+	}
+	invites, err := proxy.NewInvites(sConf.Invites)
+	if err != nil {
+		return err
+	}
+
+	uid := c.Uid
+	if len(uid) == 0 {
+		uid = uuid.NewV4().String()
+	}
+	token, err := invites.Mint(proxy.Invite{
+		Uid:       uid,
+		Ports:     c.Ports,
+		NotBefore: validity.NotBefore,
+		ExpiresAt: validity.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -1,42 +1,407 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
 
+	"github.com/lucheng0127/narwhal/pkg/proxy"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Modes of narwhal
+const (
+	ModeServer  = "server"  // Serve clients and visitors
+	ModeClient  = "client"  // Bind remote port or register secret service, proxy it to local port
+	ModeVisitor = "visitor" // Proxy local port to secret service
+	ModeForward = "forward" // Proxy local port to target dialed by server
+)
+
+// TimeoutConfig is deadlines of connection phases, idle 0 means never
+type TimeoutConfig struct {
+	Hello time.Duration `mapstructure:"hello"`
+	Auth  time.Duration `mapstructure:"auth"`
+	Bind  time.Duration `mapstructure:"bind"`
+	Idle  time.Duration `mapstructure:"idle"`
+}
+
+// GuardConfig is the punishment of auth failures, baseDelay -1 means
+// reply failures without delay
+type GuardConfig struct {
+	MaxFailures int           `mapstructure:"maxFailures"`
+	Window      time.Duration `mapstructure:"window"`
+	BanDuration time.Duration `mapstructure:"banDuration"`
+	BaseDelay   time.Duration `mapstructure:"baseDelay"`
+	MaxDelay    time.Duration `mapstructure:"maxDelay"`
+}
+
+// AccessLogConfig is the access log of visitor connections, disabled when
+// file not set, MaxSize in megabytes, MaxAge in days
+type AccessLogConfig struct {
+	File       string `mapstructure:"file"`
+	MaxSize    int    `mapstructure:"maxSize"`
+	MaxBackups int    `mapstructure:"maxBackups"`
+	MaxAge     int    `mapstructure:"maxAge"`
+	Compress   bool   `mapstructure:"compress"`
+}
+
+// SyslogConfig send logs to syslog, network and address empty means local
+// /dev/log socket
+type SyslogConfig struct {
+	Enable  bool   `mapstructure:"enable"`
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	Tag     string `mapstructure:"tag"`
+}
+
+// LogConfig is level, format and sinks of logs, logs are written to
+// stderr when no sink configured, MaxSize of file in megabytes, MaxAge in
+// days, MaxBackups and MaxAge 0 means retain all rotated files
+type LogConfig struct {
+	Level      string       `mapstructure:"level"`
+	Format     string       `mapstructure:"format"`
+	File       string       `mapstructure:"file"`
+	MaxSize    int          `mapstructure:"maxSize"`
+	MaxBackups int          `mapstructure:"maxBackups"`
+	MaxAge     int          `mapstructure:"maxAge"`
+	Compress   bool         `mapstructure:"compress"`
+	Syslog     SyslogConfig `mapstructure:"syslog"`
+	Journald   bool         `mapstructure:"journald"`
+	Stderr     bool         `mapstructure:"stderr"`
+}
+
+// TracingConfig export opentelemetry spans, exporter is none or empty,
+// stdout, file or otlp, file is used by file exporter, endpoint and
+// insecure by otlp exporter, sampleRatio 0 means trace all sessions
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter"`
+	File        string  `mapstructure:"file"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	SampleRatio float64 `mapstructure:"sampleRatio"`
+}
+
+// User store types
+const (
+	UserStoreStatic = "static" // Users of config file
+	UserStoreDir    = "dir"    // A yaml or json file for each user in directory
+	UserStoreSQLite = "sqlite" // Table users of sqlite database
+)
+
+// UserStoreConfig is where server looks up users, users of config file are
+// used by static store, path is the directory of dir store or database
+// file of sqlite store
+type UserStoreConfig struct {
+	Type string `mapstructure:"type"`
+	Path string `mapstructure:"path"`
+}
+
+// WebhookConfig is the http webhook deciding auth and bind instead of
+// users, and each visitor when visitors is true, disabled when url not set.
+// Decisions are cached for cacheTTL, failOpen allows when webhook fails
+type WebhookConfig struct {
+	URL      string            `mapstructure:"url" redact:"userinfo"`
+	Timeout  time.Duration     `mapstructure:"timeout"`
+	CacheTTL time.Duration     `mapstructure:"cacheTTL"`
+	FailOpen bool              `mapstructure:"failOpen"`
+	Visitors bool              `mapstructure:"visitors"`
+	Headers  map[string]string `mapstructure:"headers" redact:"value"`
+	Metadata map[string]string `mapstructure:"metadata"`
+}
+
+// JWTConfig verify tokens clients auth with, uid and ports are taken from
+// sub and ports claims. Disabled when jwks and publicKey not set, keys are
+// read again on reload
+type JWTConfig struct {
+	JWKS      string        `mapstructure:"jwks"`      // JWKS file
+	PublicKey string        `mapstructure:"publicKey"` // PEM public key or certificate file
+	Audience  string        `mapstructure:"audience"`
+	Issuer    string        `mapstructure:"issuer"` // Any issuer when empty
+	Leeway    time.Duration `mapstructure:"leeway"` // Clock skew allowed
+}
+
+// ValidityConfig is when a user can authenticate, RFC 3339 times like
+// 2024-06-01T18:00:00Z, zero means unbounded. Sessions of the user are
+// closed when it expires
+type ValidityConfig struct {
+	NotBefore time.Time `mapstructure:"notBefore"`
+	ExpiresAt time.Time `mapstructure:"expiresAt"`
+}
+
+// ServerTLSConfig is certificate and key files of tls listen
+type ServerTLSConfig struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+}
+
+// ClientTLSConfig verify server of tls host, ca is the CA file verifying
+// server certificate, system roots when empty, serverName defaults to host
+// of host url, insecure skips the verification
+type ClientTLSConfig struct {
+	CA         string `mapstructure:"ca"`
+	ServerName string `mapstructure:"serverName"`
+	Insecure   bool   `mapstructure:"insecure"`
+}
+
+// SessionConfig is what happens when a uid binds or registers while its
+// previous session is alive, policy is allow, reject or replace, users
+// override it for uids
+type SessionConfig struct {
+	Policy string            `mapstructure:"policy"`
+	Users  map[string]string `mapstructure:"users" redact:"uid"` // uid: policy
+}
+
+// ServerConfigSet is config of server mode, see DefaultServerConfigSet for
+// defaults
 type ServerConfigSet struct {
-	Port  int               `mapstructure:"port"`
-	Users map[string]string `mapstructure:"users"`
+	Mode           string                    `mapstructure:"mode"`
+	Port           int                       `mapstructure:"port"`
+	Listen         string                    `mapstructure:"listen"` // Transport url listened instead of tcp port, e.g. tls://:8888
+	TLS            ServerTLSConfig           `mapstructure:"tls"`
+	Users          map[string]string         `mapstructure:"users" redact:"uid"`    // uid: port spec
+	Validity       map[string]ValidityConfig `mapstructure:"validity" redact:"uid"` // uid: validity of users
+	UserStore      UserStoreConfig           `mapstructure:"userStore"`
+	Webhook        WebhookConfig             `mapstructure:"webhook"`
+	JWT            JWTConfig                 `mapstructure:"jwt"`
+	AuthorizedKeys string                    `mapstructure:"authorizedKeys"` // Directory of authorized_keys files named uid
+	Invites        string                    `mapstructure:"invites"`        // Directory of pending invites minted by user invite
+	Sessions       SessionConfig             `mapstructure:"sessions"`
+	Timeout        TimeoutConfig             `mapstructure:"timeout"`
+	MaxHandshakes  int                       `mapstructure:"maxHandshakes"` // Unauthenticated connections limit
+	Guard          GuardConfig               `mapstructure:"guard"`
+	Forwards       map[string][]string       `mapstructure:"forwards" redact:"uid"` // uid: host:port spec
+	AccessLog      AccessLogConfig           `mapstructure:"accessLog"`
+	Log            LogConfig                 `mapstructure:"log"`
+	Tracing        TracingConfig             `mapstructure:"tracing"`
+	PidFile        string                    `mapstructure:"pidFile"` // Pid written to, used to signal reload
+}
+
+// StaticUsers return users of static store with their validity
+func (c *ServerConfigSet) StaticUsers() []proxy.User {
+	users := make([]proxy.User, 0, len(c.Users))
+	for uid, ports := range c.Users {
+		v := c.Validity[uid]
+		users = append(users, proxy.User{
+			Uid:      uid,
+			Ports:    ports,
+			Validity: proxy.Validity{NotBefore: v.NotBefore, ExpiresAt: v.ExpiresAt},
+		})
+	}
+	return users
+}
+
+// SessionPolicy return session policy of server
+func (c *ServerConfigSet) SessionPolicy() proxy.SessionPolicy {
+	return proxy.SessionPolicy{Default: c.Sessions.Policy, Users: c.Sessions.Users}
+}
+
+// Endpoint return transport endpoint listened, nil for tcp port
+func (c *ServerConfigSet) Endpoint() (*transport.Endpoint, error) {
+	if len(c.Listen) == 0 {
+		return nil, nil
+	}
+	ep, err := transport.Parse(c.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.TLS.Cert) != 0 {
+		if ep.TLS, err = transport.ServerTLSConfig(c.TLS.Cert, c.TLS.Key); err != nil {
+			return nil, err
+		}
+	}
+	return ep, nil
 }
 
+// ClientConfigSet is config of client, visitor and forward mode, see
+// DefaultClientConfigSet for defaults
 type ClientConfigSet struct {
-	Uid        string
-	RemotePort uint16
-	LocalPort  uint16
-	Host       string
+	Mode         string          `mapstructure:"mode"`
+	Uid          string          `mapstructure:"uuid" redact:"uid"`
+	Token        string          `mapstructure:"token" redact:"value"` // Sent with uuid on auth, uuid may be empty with it
+	IdentityFile string          `mapstructure:"identityFile"`         // Ssh private key signing challenge of server on auth
+	RemotePort   int             `mapstructure:"rPort"`
+	LocalPort    int             `mapstructure:"lPort"`
+	Host         string          `mapstructure:"host"` // Server address, host:port or transport url like tls://host:port
+	TLS          ClientTLSConfig `mapstructure:"tls"`
+	Proxy        string          `mapstructure:"proxy" redact:"userinfo"` // Egress proxy url of http, https or socks5, HTTPS_PROXY or ALL_PROXY when empty
+	Service      string          `mapstructure:"service"`                 // Secret service name, no remote port bound when set
+	Key          string          `mapstructure:"key" redact:"value"`      // Secret service key
+	Target       string          `mapstructure:"target"`                  // Forward local port to target dialed by server
+	Log          LogConfig       `mapstructure:"log"`
+	Tracing      TracingConfig   `mapstructure:"tracing"`
+}
+
+// Endpoint return transport endpoint of host, dialed through proxy or
+// the one of environment
+func (c *ClientConfigSet) Endpoint() (*transport.Endpoint, error) {
+	ep, err := transport.Parse(c.Host)
+	if err != nil {
+		return nil, err
+	}
+	if ep.TLS, err = transport.ClientTLSConfig(c.TLS.CA, c.TLS.ServerName, c.TLS.Insecure); err != nil {
+		return nil, err
+	}
+	if !transport.ProxySupported(ep.URL.Scheme) {
+		return ep, nil
+	}
+	if len(c.Proxy) != 0 {
+		ep.Proxy, err = transport.ParseProxy(c.Proxy)
+	} else {
+		ep.Proxy, err = transport.ProxyFromEnvironment(ep.URL.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+// ConfigSet is config of a mode
+//
+// GetMode: mode of config
+// Validate: check values of config, called by ReadConfigFile
+type ConfigSet interface {
+	GetMode() string
+	Validate() error
+}
+
+func (c *ServerConfigSet) GetMode() string {
+	return c.Mode
 }
 
-type ConfigSet interface{}
+func (c *ClientConfigSet) GetMode() string {
+	return c.Mode
+}
+
+// Defaults of config, defaults of server are the same as proxy package
+const (
+	DefaultLogLevel  = "info"
+	DefaultLogFormat = "text"
+	DefaultSyslogTag = "narwhal"
+)
+
+// DefaultServerConfigSet return server config with defaults, values in
+// config file override them
+func DefaultServerConfigSet() *ServerConfigSet {
+	return &ServerConfigSet{
+		Mode:      ModeServer,
+		Port:      proxy.DefaultPort,
+		UserStore: UserStoreConfig{Type: UserStoreStatic},
+		Timeout: TimeoutConfig{
+			Hello: proxy.DefaultHelloTimeout,
+			Auth:  proxy.DefaultAuthTimeout,
+			Bind:  proxy.DefaultBindTimeout,
+		},
+		MaxHandshakes: proxy.DefaultMaxHandshakes,
+		Guard: GuardConfig{
+			MaxFailures: proxy.DefaultGuardPolicy.MaxFailures,
+			Window:      proxy.DefaultGuardPolicy.Window,
+			BanDuration: proxy.DefaultGuardPolicy.BanDuration,
+			BaseDelay:   proxy.DefaultGuardPolicy.BaseDelay,
+			MaxDelay:    proxy.DefaultGuardPolicy.MaxDelay,
+		},
+		Webhook:   WebhookConfig{Timeout: proxy.DefaultWebhookTimeout},
+		Sessions:  SessionConfig{Policy: proxy.SessionAllow},
+		AccessLog: AccessLogConfig{MaxSize: proxy.DefaultAccessLogMaxSize},
+		Log:       defaultLogConfig(),
+	}
+}
 
+// DefaultClientConfigSet return client config of mode with defaults,
+// values in config file override them
+func DefaultClientConfigSet(mode string) *ClientConfigSet {
+	return &ClientConfigSet{
+		Mode: mode,
+		Log:  defaultLogConfig(),
+	}
+}
+
+func defaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:   DefaultLogLevel,
+		Format:  DefaultLogFormat,
+		MaxSize: proxy.DefaultAccessLogMaxSize,
+		Syslog:  SyslogConfig{Tag: DefaultSyslogTag},
+	}
+}
+
+// ReadConfigFile read config file of format yaml, json or toml, format
+// is detected from file extension when empty. Mode is required, unknown
+// keys are refused, keys are case sensitive
 func ReadConfigFile(path, format string) (ConfigSet, error) {
-	v := viper.New()
-	v.SetConfigFile(path)
-	v.SetConfigType(format)
+	return Load(path, format, nil, nil)
+}
 
-	if err := v.ReadInConfig(); err != nil {
-		return nil, err
+// parse config data into map, duplicate keys are refused
+func parse(data []byte, format string) (map[string]interface{}, error) {
+	raw := make(map[string]interface{})
+	switch format {
+	case "yaml", "yml", "json":
+		// Json is yaml, parse it with yaml to refuse duplicate keys
+		err := yaml.Unmarshal(data, &raw)
+		if err != nil {
+			return nil, err
+		}
+	case "toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config type [%s]", format)
 	}
+	return raw, nil
+}
 
-	switch v.GetString("mode") {
-	case "client":
-		return &ClientConfigSet{
-			Uid:        v.GetString("uuid"),
-			RemotePort: v.GetUint16("rPort"),
-			LocalPort:  v.GetUint16("lPort"),
-			Host:       v.GetString("host"),
-		}, nil
+// decode raw config into config set of its mode
+func decode(raw map[string]interface{}) (ConfigSet, error) {
+	mode, _ := raw["mode"].(string)
+	var conf ConfigSet
+	switch mode {
+	case ModeServer:
+		conf = DefaultServerConfigSet()
+	case ModeClient, ModeVisitor, ModeForward:
+		conf = DefaultClientConfigSet(mode)
+	case "":
+		return nil, fmt.Errorf("mode not set, one of %s, %s, %s, %s expected", ModeServer, ModeClient, ModeVisitor, ModeForward)
 	default:
-		return &ServerConfigSet{
-			Port:  v.GetInt("port"),
-			Users: v.GetStringMapString("users"),
-		}, nil
+		return nil, fmt.Errorf("unknown mode [%s]", mode)
+	}
+
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+			numberToStringHookFunc,
+		),
+		ErrorUnused: true,
+		MatchName: func(mapKey, fieldName string) bool {
+			return mapKey == fieldName
+		},
+		Result: conf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(raw); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// numberToStringHookFunc convert numbers into string, port spec like 22
+// is parsed as number
+func numberToStringHookFunc(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+	if t.Kind() != reflect.String {
+		return data, nil
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("%d", data), nil
 	}
+	return data, nil
 }
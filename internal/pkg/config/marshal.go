@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Marshal marshal config set into yaml, json or toml with keys of config
+// file, durations are written as strings like 10s, so the output can be
+// read by ReadConfigFile
+func Marshal(conf ConfigSet, format string) ([]byte, error) {
+	return marshal(toRaw(reflect.ValueOf(conf).Elem(), nil), format)
+}
+
+// MarshalRedacted is Marshal with secrets replaced, tokens, keys and
+// headers are written as ****, userinfo of urls too, and uids are written
+// as ****1, ****2 and so on, the same uid gets the same alias
+func MarshalRedacted(conf ConfigSet, format string) ([]byte, error) {
+	r := &redactor{uids: make(map[string]string)}
+	return marshal(toRaw(reflect.ValueOf(conf).Elem(), r), format)
+}
+
+func marshal(raw map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case "yaml", "yml", "":
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(raw); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "json":
+		data, err := json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case "toml":
+		return toml.Marshal(raw)
+	default:
+		return nil, fmt.Errorf("unsupported config type [%s]", format)
+	}
+}
+
+// toRaw convert struct into map of its mapstructure keys, zero times are
+// omitted. Fields tagged redact are redacted by r when it's not nil
+func toRaw(v reflect.Value, r *redactor) map[string]interface{} {
+	raw := make(map[string]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("mapstructure")
+		redact := v.Type().Field(i).Tag.Get("redact")
+		f := v.Field(i)
+		switch {
+		case (f.Kind() == reflect.Map || f.Kind() == reflect.Slice) && f.IsNil():
+			// Omitted so read back as nil
+		case r != nil && len(redact) != 0:
+			raw[key] = r.redact(redact, f)
+		case f.Type() == reflect.TypeOf(time.Time{}):
+			if t := f.Interface().(time.Time); !t.IsZero() {
+				raw[key] = t.Format(time.RFC3339)
+			}
+		case f.Kind() == reflect.Struct:
+			raw[key] = toRaw(f, r)
+		case f.Kind() == reflect.Map && f.Type().Elem().Kind() == reflect.Struct:
+			m := make(map[string]interface{}, f.Len())
+			iter := f.MapRange()
+			for iter.Next() {
+				m[iter.Key().String()] = toRaw(iter.Value(), r)
+			}
+			raw[key] = m
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			raw[key] = time.Duration(f.Int()).String()
+		default:
+			raw[key] = f.Interface()
+		}
+	}
+	return raw
+}
+
+// Masks of redacted values
+const (
+	redactMask     = "****"
+	redactValue    = "value"    // String, or values of string map
+	redactUserinfo = "userinfo" // Userinfo of url string
+	redactUID      = "uid"      // Uid string, or keys of map by uid
+)
+
+// redactor redact config fields tagged redact, uids are replaced by
+// aliases numbered in order of appearance
+type redactor struct {
+	uids map[string]string
+}
+
+func (r *redactor) uid(uid string) string {
+	if len(uid) == 0 {
+		return uid
+	}
+	alias, ok := r.uids[uid]
+	if !ok {
+		alias = fmt.Sprintf("%s%d", redactMask, len(r.uids)+1)
+		r.uids[uid] = alias
+	}
+	return alias
+}
+
+func mask(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	return redactMask
+}
+
+func maskUserinfo(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return mask(value)
+	}
+	if u.User == nil {
+		return value
+	}
+	// Mask is set after encoding, url escapes * of userinfo
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redactMask+"@", 1)
+}
+
+func (r *redactor) redact(kind string, f reflect.Value) interface{} {
+	if f.Kind() == reflect.String {
+		switch kind {
+		case redactUserinfo:
+			return maskUserinfo(f.String())
+		case redactUID:
+			return r.uid(f.String())
+		default:
+			return mask(f.String())
+		}
+	}
+
+	// Keys are sorted so aliases don't depend on map order
+	keys := make([]string, 0, f.Len())
+	for _, k := range f.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	m := make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		v := f.MapIndex(reflect.ValueOf(k))
+		switch {
+		case kind == redactValue:
+			m[k] = mask(v.String())
+		case v.Kind() == reflect.Struct:
+			m[r.uid(k)] = toRaw(v, r)
+		default:
+			m[r.uid(k)] = v.Interface()
+		}
+	}
+	return m
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables of config keys, key
+// path is upper cased and dots replaced with underscores, e.g. rPort is
+// NARWHAL_RPORT and timeout.hello is NARWHAL_TIMEOUT_HELLO
+const EnvPrefix = "NARWHAL_"
+
+// Overrides is config values of key path, e.g. timeout.hello: 5s. Values
+// are parsed as yaml, so maps and lists can be given in flow style, e.g.
+// users: "{admin: 0, guest: 8080}". Keys of map fields can be set one by
+// one, e.g. users.admin: 0
+type Overrides map[string]string
+
+// Set implement flag value, value is key=value
+func (o Overrides) Set(value string) error {
+	key, v, ok := strings.Cut(value, "=")
+	if !ok || len(key) == 0 {
+		return fmt.Errorf("[%s] not key=value", value)
+	}
+	o[key] = v
+	return nil
+}
+
+// EnvName return environment variable name of key path
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Load load config from config file, environment variables and flags, flags
+// take precedence over environment and environment over config file. Path
+// empty means no config file, env is environment of key=value like
+// os.Environ
+func Load(path, format string, env []string, flags Overrides) (ConfigSet, error) {
+	raw := make(map[string]interface{})
+	if len(path) != 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(format) == 0 {
+			format = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+
+		raw, err = parse(data, format)
+		if err != nil {
+			return nil, fmt.Errorf("parse config file %s %s", path, err.Error())
+		}
+	}
+
+	if err := overlay(raw, env, flags); err != nil {
+		return nil, err
+	}
+
+	conf, err := decode(raw)
+	if err != nil {
+		return nil, configErr(path, err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, configErr(path, err)
+	}
+	return conf, nil
+}
+
+func configErr(path string, err error) error {
+	if len(path) == 0 {
+		return fmt.Errorf("config %s", err.Error())
+	}
+	return fmt.Errorf("config file %s %s", path, err.Error())
+}
+
+// overlay set values of env and flags into raw config, keys depend on mode
+// so mode is resolved first
+func overlay(raw map[string]interface{}, env []string, flags Overrides) error {
+	envs := make(map[string]string)
+	for _, kv := range env {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(k, EnvPrefix) {
+			envs[k] = v
+		}
+	}
+
+	if mode, ok := envs[EnvName("mode")]; ok {
+		raw["mode"] = mode
+	}
+	if mode, ok := flags["mode"]; ok {
+		raw["mode"] = mode
+	}
+	mode, _ := raw["mode"].(string)
+	fields, err := configFields(mode)
+	if err != nil {
+		// Unknown mode is reported by decode
+		return nil
+	}
+
+	for key, t := range fields {
+		if v, ok := envs[EnvName(key)]; ok {
+			setRaw(raw, key, "", parseValue(v, t))
+		}
+	}
+
+	// Sort keys so users: {...} set before users.admin
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, mapKey, t, ok := lookupField(fields, key)
+		if !ok {
+			return fmt.Errorf("unknown config key [%s]", key)
+		}
+		setRaw(raw, field, mapKey, parseValue(flags[key], t))
+	}
+	return nil
+}
+
+// configFields return key paths of config of mode and their types, maps
+// and lists are leaves
+func configFields(mode string) (map[string]reflect.Type, error) {
+	var t reflect.Type
+	switch mode {
+	case ModeServer:
+		t = reflect.TypeOf(ServerConfigSet{})
+	case ModeClient, ModeVisitor, ModeForward:
+		t = reflect.TypeOf(ClientConfigSet{})
+	default:
+		return nil, fmt.Errorf("unknown mode [%s]", mode)
+	}
+
+	fields := make(map[string]reflect.Type)
+	walkFields(t, "", fields)
+	return fields, nil
+}
+
+func walkFields(t reflect.Type, prefix string, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("mapstructure")
+		if f.Type.Kind() == reflect.Struct {
+			walkFields(f.Type, key+".", fields)
+			continue
+		}
+		fields[key] = f.Type
+	}
+}
+
+// lookupField return field of key and its type, key may be an entry of
+// map field like users.admin, then the field is users and map key admin
+func lookupField(fields map[string]reflect.Type, key string) (string, string, reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return key, "", t, true
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] != '.' {
+			continue
+		}
+		if t, ok := fields[key[:i]]; ok && t.Kind() == reflect.Map && i+1 < len(key) {
+			return key[:i], key[i+1:], t.Elem(), true
+		}
+	}
+	return "", "", nil, false
+}
+
+// parseValue parse value as yaml for keys not of string type, so numbers,
+// bools, maps and lists get the same types as in config file
+func parseValue(value string, t reflect.Type) interface{} {
+	if t.Kind() == reflect.String {
+		return value
+	}
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil || v == nil {
+		// Let decode report the mismatch
+		return value
+	}
+	if _, ok := v.([]interface{}); !ok && t.Kind() == reflect.Slice {
+		// Single entry of list
+		return []interface{}{v}
+	}
+	return v
+}
+
+// setRaw set value of field path into raw, value is set as entry of the
+// map field when mapKey not empty
+func setRaw(raw map[string]interface{}, field, mapKey string, value interface{}) {
+	parts := strings.Split(field, ".")
+	if len(mapKey) != 0 {
+		parts = append(parts, mapKey)
+	}
+
+	m := raw
+	for _, p := range parts[:len(parts)-1] {
+		sub, ok := m[p].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[p] = sub
+		}
+		m = sub
+	}
+	m[parts[len(parts)-1]] = value
+}
@@ -0,0 +1,297 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+// BackupSuffix is appended to config file path for the backup written
+// before config file rewritten
+const BackupSuffix = ".bak"
+
+// UsersFile edit users of a yaml server config file, comments and order of
+// keys are kept
+type UsersFile struct {
+	path string
+	mode os.FileMode
+	data []byte
+	doc  yaml.Node
+}
+
+// User is a user of server config
+type User struct {
+	Uid      string
+	Ports    string   // Port spec, see proxy.ValidatePortSpec
+	Forwards []string // Forward rules, see proxy.ValidateForwardRule
+	Validity ValidityConfig
+}
+
+// OpenUsersFile parse server config file at path, yaml only as other
+// formats can't be rewritten with comments kept
+func OpenUsersFile(path string) (*UsersFile, error) {
+	switch ext := strings.TrimPrefix(filepath.Ext(path), "."); ext {
+	case "yaml", "yml":
+	default:
+		return nil, fmt.Errorf("config file %s of type [%s] can't be edited, yaml only", path, ext)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &UsersFile{path: path, mode: info.Mode().Perm(), data: data}
+	if err := yaml.Unmarshal(data, &f.doc); err != nil {
+		return nil, fmt.Errorf("parse config file %s %s", path, err.Error())
+	}
+	if f.root() == nil {
+		return nil, fmt.Errorf("config file %s is not a map", path)
+	}
+	conf, err := f.decode()
+	if err != nil {
+		return nil, err
+	}
+	if conf.GetMode() != ModeServer {
+		return nil, fmt.Errorf("config file %s is of mode [%s], not %s", path, conf.GetMode(), ModeServer)
+	}
+	return f, nil
+}
+
+// root return the top level mapping node, nil if document is not a map
+func (f *UsersFile) root() *yaml.Node {
+	if f.doc.Kind != yaml.DocumentNode || len(f.doc.Content) == 0 {
+		return nil
+	}
+	root := f.doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	return root
+}
+
+// decode current document into server config without validating it
+func (f *UsersFile) decode() (ConfigSet, error) {
+	raw := make(map[string]interface{})
+	if err := f.doc.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("config file %s %s", f.path, err.Error())
+	}
+	conf, err := decode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s %s", f.path, err.Error())
+	}
+	return conf, nil
+}
+
+// Config return server config of current document
+func (f *UsersFile) Config() (*ServerConfigSet, error) {
+	conf, err := f.decode()
+	if err != nil {
+		return nil, err
+	}
+	return conf.(*ServerConfigSet), nil
+}
+
+// Users return users sorted by uid
+func (f *UsersFile) Users() ([]User, error) {
+	conf, err := f.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(conf.Users))
+	for uid, ports := range conf.Users {
+		users = append(users, User{Uid: uid, Ports: ports, Forwards: conf.Forwards[uid], Validity: conf.Validity[uid]})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Uid < users[j].Uid
+	})
+	return users, nil
+}
+
+// mapping return value node of key in node, it is created when create and
+// not exist
+func mapping(node *yaml.Node, key string, create bool) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			if value.Kind != yaml.MappingNode && create {
+				// users: or users: {} with nothing
+				*value = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			return value
+		}
+	}
+	if !create {
+		return nil
+	}
+
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	return value
+}
+
+// removeKey remove key from mapping node, return whether it existed
+func removeKey(node *yaml.Node, key string) bool {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Add add user uid with port spec ports
+func (f *UsersFile) Add(uid, ports string) error {
+	if len(strings.TrimSpace(uid)) == 0 {
+		return errors.New("uid is empty")
+	}
+	if err := proxy.ValidatePortSpec(ports); err != nil {
+		return err
+	}
+
+	users := mapping(f.root(), "users", true)
+	if mapping(users, uid, false) != nil {
+		return fmt.Errorf("user [%s] exists", uid)
+	}
+	users.Content = append(users.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: uid},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: ports},
+	)
+	return nil
+}
+
+// Remove remove user uid, its validity and forward rules
+func (f *UsersFile) Remove(uid string) error {
+	if !removeKey(mapping(f.root(), "users", false), uid) {
+		return fmt.Errorf("no such user [%s]", uid)
+	}
+	removeKey(mapping(f.root(), "validity", false), uid)
+	removeKey(mapping(f.root(), "forwards", false), uid)
+	return nil
+}
+
+// SetValidity replace validity of user uid with v, removed when v is zero
+func (f *UsersFile) SetValidity(uid string, v ValidityConfig) error {
+	users := mapping(f.root(), "users", false)
+	if users == nil || mapping(users, uid, false) == nil {
+		return fmt.Errorf("no such user [%s]", uid)
+	}
+	if v.NotBefore.IsZero() && v.ExpiresAt.IsZero() {
+		removeKey(mapping(f.root(), "validity", false), uid)
+		return nil
+	}
+	validity := mapping(f.root(), "validity", true)
+	removeKey(validity, uid)
+
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, kv := range []struct {
+		key string
+		t   time.Time
+	}{{"notBefore", v.NotBefore}, {"expiresAt", v.ExpiresAt}} {
+		if kv.t.IsZero() {
+			continue
+		}
+		value.Content = append(value.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: kv.key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: kv.t.Format(time.RFC3339)},
+		)
+	}
+	validity.Content = append(validity.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: uid}, value)
+	return nil
+}
+
+// SetPorts replace port spec of user uid with ports
+func (f *UsersFile) SetPorts(uid, ports string) error {
+	if err := proxy.ValidatePortSpec(ports); err != nil {
+		return err
+	}
+
+	users := mapping(f.root(), "users", false)
+	if users == nil {
+		return fmt.Errorf("no such user [%s]", uid)
+	}
+	value := mapping(users, uid, false)
+	if value == nil {
+		return fmt.Errorf("no such user [%s]", uid)
+	}
+	// Keep comments of the entry
+	value.Kind = yaml.ScalarNode
+	value.Tag = ""
+	value.Style = 0
+	value.Value = ports
+	value.Content = nil
+	return nil
+}
+
+// Save validate config and write it back, the original file is copied to
+// path with BackupSuffix, and the new one replace it atomically
+func (f *UsersFile) Save() error {
+	conf, err := f.decode()
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("config file %s %s", f.path, err.Error())
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&f.doc); err != nil {
+		return err
+	}
+	enc.Close()
+
+	if err := writeFileAtomic(f.path+BackupSuffix, f.data, f.mode); err != nil {
+		return fmt.Errorf("backup config file %s", err.Error())
+	}
+	if err := writeFileAtomic(f.path, buf.Bytes(), f.mode); err != nil {
+		return fmt.Errorf("write config file %s", err.Error())
+	}
+	f.data = buf.Bytes()
+	return nil
+}
+
+// writeFileAtomic write data to a temporary file in the same directory and
+// rename it to path, so readers see the old or the new content only
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
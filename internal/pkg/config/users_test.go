@@ -0,0 +1,188 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const usersConfig = `mode: server
+# Users of team
+users:
+  alice: 0 # admin
+  bob: 22,80
+forwards:
+  bob:
+    - 10.0.0.5:5432
+`
+
+func TestUsersFile(t *testing.T) {
+	path := writeConfig(t, "server.yaml", usersConfig)
+	f, err := OpenUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Add("carol", "8000-8100"); err != nil {
+		t.Errorf("Add() error = %v", err)
+	}
+	if err := f.Add("alice", "0"); err == nil {
+		t.Error("Add() exist user should fail")
+	}
+	if err := f.Add("dave", "99999"); err == nil {
+		t.Error("Add() invalidate ports should fail")
+	}
+	if err := f.SetPorts("alice", "443"); err != nil {
+		t.Errorf("SetPorts() error = %v", err)
+	}
+	if err := f.SetPorts("dave", "443"); err == nil {
+		t.Error("SetPorts() no such user should fail")
+	}
+	if err := f.Remove("bob"); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+	if err := f.Remove("bob"); err == nil {
+		t.Error("Remove() no such user should fail")
+	}
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	backup, err := os.ReadFile(path + BackupSuffix)
+	if err != nil || string(backup) != usersConfig {
+		t.Errorf("backup %s not match origin, error %v", backup, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "# Users of team") || !strings.Contains(string(data), "# admin") {
+		t.Errorf("comments not kept\n%s", data)
+	}
+
+	conf, err := ReadConfigFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := conf.(*ServerConfigSet)
+	if len(s.Users) != 2 || s.Users["alice"] != "443" || s.Users["carol"] != "8000-8100" {
+		t.Errorf("users %v not match", s.Users)
+	}
+	if len(s.Forwards) != 0 {
+		t.Errorf("forwards of removed user %v not removed", s.Forwards)
+	}
+
+	f, err = OpenUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := f.Users()
+	if err != nil || len(users) != 2 || users[0].Uid != "alice" || users[1].Uid != "carol" {
+		t.Errorf("Users() = %v, error %v", users, err)
+	}
+}
+
+func TestUsersFile_SetValidity(t *testing.T) {
+	path := writeConfig(t, "server.yaml", usersConfig)
+	f, err := OpenUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire := time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)
+	if err := f.SetValidity("alice", ValidityConfig{ExpiresAt: expire}); err != nil {
+		t.Errorf("SetValidity() error = %v", err)
+	}
+	if err := f.SetValidity("bob", ValidityConfig{NotBefore: expire.Add(-time.Hour), ExpiresAt: expire}); err != nil {
+		t.Errorf("SetValidity() error = %v", err)
+	}
+	if err := f.SetValidity("dave", ValidityConfig{ExpiresAt: expire}); err == nil {
+		t.Error("SetValidity() no such user should fail")
+	}
+	// Replace then clear
+	if err := f.SetValidity("bob", ValidityConfig{ExpiresAt: expire.Add(time.Hour)}); err != nil {
+		t.Errorf("SetValidity() error = %v", err)
+	}
+	if err := f.SetValidity("alice", ValidityConfig{}); err != nil {
+		t.Errorf("SetValidity() error = %v", err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	conf, err := ReadConfigFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := conf.(*ServerConfigSet)
+	if len(s.Validity) != 1 || !s.Validity["bob"].NotBefore.IsZero() || !s.Validity["bob"].ExpiresAt.Equal(expire.Add(time.Hour)) {
+		t.Errorf("validity %+v not match", s.Validity)
+	}
+
+	// Validity is removed with user
+	if err := f.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	users, err := f.Users()
+	if err != nil || len(users) != 1 || users[0].Validity != (ValidityConfig{}) {
+		t.Errorf("Users() = %+v, error %v", users, err)
+	}
+}
+
+func TestUsersFile_saveInvalidate(t *testing.T) {
+	path := writeConfig(t, "server.yaml", usersConfig)
+	f, err := OpenUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Differ in case only
+	if err := f.Add("Alice", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Save(); err == nil || !strings.Contains(err.Error(), "duplicate users") {
+		t.Errorf("Save() error = %v, want duplicate users", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != usersConfig {
+		t.Errorf("config file changed by failed save\n%s", data)
+	}
+}
+
+func TestOpenUsersFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "toml",
+			file:    "server.toml",
+			content: "mode = \"server\"\n",
+			wantErr: "yaml only",
+		},
+		{
+			name:    "client",
+			file:    "client.yaml",
+			content: "mode: client\n",
+			wantErr: "not server",
+		},
+		{
+			name:    "not map",
+			file:    "server.yaml",
+			content: "- server\n",
+			wantErr: "not a map",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := OpenUsersFile(writeConfig(t, tt.file, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("OpenUsersFile() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
+	"github.com/lucheng0127/narwhal/pkg/proxy"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+	"github.com/sirupsen/logrus"
+)
+
+func validatePort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s [%d] out of range 1-65535", name, port)
+	}
+	return nil
+}
+
+func validateHostPort(name, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s [%s] %s", name, addr, err.Error())
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("%s [%s] host not set", name, addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%s [%s] invalidate port", name, addr)
+	}
+	return validatePort(name+" port", p)
+}
+
+// validateEndpoint check addr is host:port or url of a transport, host of
+// listened address may be empty
+func validateEndpoint(name, addr string, listen bool) (*transport.Endpoint, error) {
+	ep, err := transport.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s [%s] %s", name, addr, err.Error())
+	}
+	if ep.URL.Scheme == transport.SchemeUnix {
+		if len(ep.URL.Path) == 0 {
+			return nil, fmt.Errorf("%s [%s] socket path not set", name, addr)
+		}
+		return ep, nil
+	}
+	if listen {
+		if _, err := strconv.Atoi(ep.URL.Port()); err != nil {
+			return nil, fmt.Errorf("%s [%s] invalidate port", name, addr)
+		}
+		return ep, nil
+	}
+	// Websocket urls default to port of http or https
+	isWS := ep.URL.Scheme == transport.SchemeWS || ep.URL.Scheme == transport.SchemeWSS
+	if isWS && len(ep.URL.Port()) == 0 {
+		if len(ep.URL.Hostname()) == 0 {
+			return nil, fmt.Errorf("%s [%s] host not set", name, addr)
+		}
+		return ep, nil
+	}
+	return ep, validateHostPort(name, ep.URL.Host)
+}
+
+func validateNonNegative(name string, value int64) error {
+	if value < 0 {
+		return fmt.Errorf("%s [%d] is negative", name, value)
+	}
+	return nil
+}
+
+func (c *LogConfig) Validate() error {
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("log.level %s", err.Error())
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("log.format [%s] not text or json", c.Format)
+	}
+	for name, v := range map[string]int{
+		"log.maxSize":    c.MaxSize,
+		"log.maxBackups": c.MaxBackups,
+		"log.maxAge":     c.MaxAge,
+	} {
+		if err := validateNonNegative(name, int64(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *TracingConfig) Validate() error {
+	switch c.Exporter {
+	case telemetry.ExporterNone, telemetry.ExporterOff, telemetry.ExporterStdout, telemetry.ExporterOTLP:
+	case telemetry.ExporterFile:
+		if len(c.File) == 0 {
+			return errors.New("tracing.file not set for file exporter")
+		}
+	default:
+		return fmt.Errorf("tracing.exporter [%s] not stdout, file or otlp", c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sampleRatio [%v] out of range 0-1", c.SampleRatio)
+	}
+	return nil
+}
+
+func (c *WebhookConfig) Validate() error {
+	if len(c.URL) == 0 {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("webhook.url %s", err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("webhook.url [%s] not a http or https url", c.URL)
+	}
+	return nil
+}
+
+func (c *JWTConfig) Validate() error {
+	if len(c.JWKS) == 0 && len(c.PublicKey) == 0 {
+		return nil
+	}
+	if len(c.JWKS) != 0 && len(c.PublicKey) != 0 {
+		return errors.New("jwt.jwks and jwt.publicKey are exclusive")
+	}
+	if len(c.Audience) == 0 {
+		return errors.New("jwt.audience not set")
+	}
+	return nil
+}
+
+// Validate check ports, users and their port specs, forward rules and
+// limits of server config
+func (c *ServerConfigSet) Validate() error {
+	if err := validatePort("port", c.Port); err != nil {
+		return err
+	}
+	if len(c.Listen) != 0 {
+		ep, err := validateEndpoint("listen", c.Listen, true)
+		if err != nil {
+			return err
+		}
+		secure := ep.URL.Scheme == transport.SchemeTLS || ep.URL.Scheme == transport.SchemeWSS ||
+			ep.URL.Scheme == transport.SchemeQUIC
+		if secure && (len(c.TLS.Cert) == 0 || len(c.TLS.Key) == 0) {
+			return fmt.Errorf("tls.cert and tls.key not set for listen [%s]", c.Listen)
+		}
+	}
+
+	if err := c.Webhook.Validate(); err != nil {
+		return err
+	}
+	if err := c.JWT.Validate(); err != nil {
+		return err
+	}
+	// Users are not required when webhook decides auth or credentials carry
+	// permissions
+	usersOptional := len(c.Webhook.URL) != 0 || len(c.JWT.JWKS) != 0 || len(c.JWT.PublicKey) != 0 ||
+		len(c.AuthorizedKeys) != 0 || len(c.Invites) != 0
+
+	switch c.UserStore.Type {
+	case UserStoreStatic:
+		if len(c.Users) == 0 && !usersOptional {
+			return errors.New("users not set")
+		}
+	case UserStoreDir, UserStoreSQLite:
+		if len(c.UserStore.Path) == 0 {
+			return fmt.Errorf("userStore.path not set for %s store", c.UserStore.Type)
+		}
+		if len(c.Users) != 0 {
+			return fmt.Errorf("users is used by %s store only, add them to %s store", UserStoreStatic, c.UserStore.Type)
+		}
+		if len(c.Validity) != 0 {
+			return fmt.Errorf("validity is used by %s store only, add it to users of %s store", UserStoreStatic, c.UserStore.Type)
+		}
+	default:
+		return fmt.Errorf("userStore.type [%s] not static, dir or sqlite", c.UserStore.Type)
+	}
+	seen := make(map[string]string, len(c.Users))
+	for uid, ports := range c.Users {
+		if len(strings.TrimSpace(uid)) == 0 {
+			return errors.New("users has empty uid")
+		}
+		// Uid is compared exactly, but case or spaces only difference is
+		// likely a copy paste mistake
+		key := strings.ToLower(strings.TrimSpace(uid))
+		if dup, ok := seen[key]; ok {
+			return fmt.Errorf("duplicate users [%s] and [%s]", dup, uid)
+		}
+		seen[key] = uid
+
+		if err := proxy.ValidatePortSpec(ports); err != nil {
+			return fmt.Errorf("users [%s] %s", uid, err.Error())
+		}
+	}
+
+	for uid, v := range c.Validity {
+		if _, ok := c.Users[uid]; !ok {
+			return fmt.Errorf("validity of unknown user [%s]", uid)
+		}
+		if !v.NotBefore.IsZero() && !v.ExpiresAt.IsZero() && !v.NotBefore.Before(v.ExpiresAt) {
+			return fmt.Errorf("validity of [%s] expiresAt not later than notBefore", uid)
+		}
+	}
+
+	if err := proxy.ValidateSessionPolicy(c.Sessions.Policy); err != nil {
+		return fmt.Errorf("sessions.policy %s", err.Error())
+	}
+	for uid, policy := range c.Sessions.Users {
+		if err := proxy.ValidateSessionPolicy(policy); err != nil {
+			return fmt.Errorf("sessions.users [%s] %s", uid, err.Error())
+		}
+	}
+
+	for uid, rules := range c.Forwards {
+		// Users of other stores are unknown until looked up
+		if _, ok := c.Users[uid]; !ok && c.UserStore.Type == UserStoreStatic && !usersOptional {
+			return fmt.Errorf("forwards of unknown user [%s]", uid)
+		}
+		for _, rule := range rules {
+			if err := proxy.ValidateForwardRule(rule); err != nil {
+				return fmt.Errorf("forwards of [%s] %s", uid, err.Error())
+			}
+		}
+	}
+
+	for name, v := range map[string]int64{
+		"timeout.hello":     int64(c.Timeout.Hello),
+		"timeout.auth":      int64(c.Timeout.Auth),
+		"timeout.bind":      int64(c.Timeout.Bind),
+		"timeout.idle":      int64(c.Timeout.Idle),
+		"maxHandshakes":     int64(c.MaxHandshakes),
+		"guard.maxFailures": int64(c.Guard.MaxFailures),
+		"guard.window":      int64(c.Guard.Window),
+		"guard.banDuration": int64(c.Guard.BanDuration),
+		"guard.maxDelay":    int64(c.Guard.MaxDelay),
+		"accessLog.maxSize": int64(c.AccessLog.MaxSize),
+		"webhook.timeout":   int64(c.Webhook.Timeout),
+		"webhook.cacheTTL":  int64(c.Webhook.CacheTTL),
+		"jwt.leeway":        int64(c.JWT.Leeway),
+		"accessLog.maxAge":  int64(c.AccessLog.MaxAge),
+	} {
+		if err := validateNonNegative(name, v); err != nil {
+			return err
+		}
+	}
+	if c.Guard.BaseDelay < -1 {
+		return fmt.Errorf("guard.baseDelay [%s] is negative", c.Guard.BaseDelay)
+	}
+
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	return c.Tracing.Validate()
+}
+
+// validateIdentity check identity file is used with uid, server looks up
+// public keys by uid
+func (c *ClientConfigSet) validateIdentity() error {
+	if len(c.IdentityFile) == 0 {
+		return nil
+	}
+	if len(c.Uid) == 0 {
+		return errors.New("uuid not set for identityFile")
+	}
+	if len(c.Token) != 0 {
+		return errors.New("identityFile and token are exclusive")
+	}
+	return nil
+}
+
+// Validate check the keys required by mode are set and their values
+func (c *ClientConfigSet) Validate() error {
+	ep, err := validateEndpoint("host", c.Host, false)
+	if err != nil {
+		return err
+	}
+	if len(c.Proxy) != 0 {
+		if _, err := transport.ParseProxy(c.Proxy); err != nil {
+			return fmt.Errorf("proxy %s", err.Error())
+		}
+		if !transport.ProxySupported(ep.URL.Scheme) {
+			return fmt.Errorf("proxy not supported by transport [%s] of host", ep.URL.Scheme)
+		}
+	}
+	if err := validatePort("lPort", c.LocalPort); err != nil {
+		return err
+	}
+	if len(c.Service) != 0 && len(c.Key) == 0 {
+		return fmt.Errorf("key of service [%s] not set", c.Service)
+	}
+
+	switch c.Mode {
+	case ModeClient:
+		if len(c.Uid) == 0 && len(c.Token) == 0 {
+			return errors.New("uuid not set")
+		}
+		if err := c.validateIdentity(); err != nil {
+			return err
+		}
+		if len(c.Service) == 0 {
+			if err := validatePort("rPort", c.RemotePort); err != nil {
+				return err
+			}
+		}
+		if len(c.Target) != 0 {
+			return fmt.Errorf("target is used by %s mode only", ModeForward)
+		}
+	case ModeVisitor:
+		if len(c.Service) == 0 {
+			return errors.New("service not set")
+		}
+	case ModeForward:
+		if len(c.Uid) == 0 && len(c.Token) == 0 {
+			return errors.New("uuid not set")
+		}
+		// Each local connection is authenticated, an invite is redeemed once
+		if strings.HasPrefix(c.Token, proxy.InvitePrefix) {
+			return fmt.Errorf("invite token not supported by %s mode, use jwt or identityFile", ModeForward)
+		}
+		if err := c.validateIdentity(); err != nil {
+			return err
+		}
+		if err := validateHostPort("target", c.Target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown client mode [%s]", c.Mode)
+	}
+
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	return c.Tracing.Validate()
+}
@@ -2,6 +2,7 @@ package log
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/sirupsen/logrus"
 )
@@ -10,12 +11,43 @@ type TraceIDType string
 
 const MSG_ID TraceIDType = "MsgID"
 
+// Fields is key/value pairs attached to a log entry
+type Fields map[string]interface{}
+
+// Field keys shared by call sites, so the log pipeline can filter on them
+const (
+	FieldTraceID    = "trace_id"
+	FieldUID        = "uid"
+	FieldAuthCtx    = "auth_ctx"
+	FieldBindPort   = "bind_port"
+	FieldLocalPort  = "local_port"
+	FieldRemoteAddr = "remote_addr"
+	FieldLocalAddr  = "local_addr"
+	FieldStreamID   = "stream_id"
+	FieldBytes      = "bytes"
+	FieldBytesIn    = "bytes_in"
+	FieldBytesOut   = "bytes_out"
+	FieldService    = "service"
+	FieldTarget     = "target"
+	FieldPhase      = "phase"
+	FieldIP         = "ip"
+	FieldError      = "error"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const timestampFormat = "2006-01-02 15:04:05"
+
 var logger = logrus.New()
 
 func init() {
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp:   true,
-		TimestampFormat: "2006-01-02 15:04:05",
+		TimestampFormat: timestampFormat,
 	})
 }
 
@@ -32,27 +64,83 @@ func SetLevel(level logrus.Level) {
 	logger.SetLevel(level)
 }
 
-func Painc(ctx context.Context, msg string) {
-	traceID := getTraceID(ctx)
-	logger.Panicf("%s [%s]", msg, traceID)
+// SetFormat set output format, text or json
+func SetFormat(format string) error {
+	switch format {
+	case FormatText, "":
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: timestampFormat,
+		})
+	case FormatJSON:
+		logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: timestampFormat,
+		})
+	default:
+		return fmt.Errorf("unsupported log format [%s]", format)
+	}
+	return nil
+}
+
+// entry build log entry with trace id of ctx and fields
+func entry(ctx context.Context, fields []Fields) *logrus.Entry {
+	data := make(logrus.Fields, 1)
+	for _, f := range fields {
+		for k, v := range f {
+			if err, ok := v.(error); ok {
+				// Errors are marshaled as {} by json formatter
+				v = err.Error()
+			}
+			data[k] = v
+		}
+	}
+	data[FieldTraceID] = getTraceID(ctx)
+	return logger.WithFields(data)
 }
 
-func Error(ctx context.Context, msg string) {
-	traceID := getTraceID(ctx)
-	logger.Errorf("%s [%s]", msg, traceID)
+func Painc(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Panic(msg)
 }
 
-func Warn(ctx context.Context, msg string) {
-	traceID := getTraceID(ctx)
-	logger.Warnf("%s [%s]", msg, traceID)
+func Error(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Error(msg)
 }
 
-func Info(ctx context.Context, msg string) {
-	traceID := getTraceID(ctx)
-	logger.Infof("%s [%s]", msg, traceID)
+func Warn(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Warn(msg)
+}
+
+func Info(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Info(msg)
+}
+
+func Debug(ctx context.Context, msg string, fields ...Fields) {
+	entry(ctx, fields).Debug(msg)
+}
+
+// Logger is implemented by loggers narwhal instances log through
+type Logger interface {
+	Error(ctx context.Context, msg string, fields ...Fields)
+	Warn(ctx context.Context, msg string, fields ...Fields)
+	Info(ctx context.Context, msg string, fields ...Fields)
+	Debug(ctx context.Context, msg string, fields ...Fields)
+}
+
+// stdLogger log through the package logger, so its level and format are
+// controlled by SetLevel and SetFormat
+type stdLogger struct{}
+
+func (stdLogger) Error(ctx context.Context, msg string, fields ...Fields) { Error(ctx, msg, fields...) }
+func (stdLogger) Warn(ctx context.Context, msg string, fields ...Fields)  { Warn(ctx, msg, fields...) }
+func (stdLogger) Info(ctx context.Context, msg string, fields ...Fields)  { Info(ctx, msg, fields...) }
+func (stdLogger) Debug(ctx context.Context, msg string, fields ...Fields) { Debug(ctx, msg, fields...) }
+
+// Default return the Logger of package logger
+func Default() Logger {
+	return stdLogger{}
 }
 
-func Debug(ctx context.Context, msg string) {
-	traceID := getTraceID(ctx)
-	logger.Debugf("%s [%s]", msg, traceID)
+// GetTraceID return trace id of ctx, DEFAULT-0000 if not set
+func GetTraceID(ctx context.Context) string {
+	return getTraceID(ctx)
 }
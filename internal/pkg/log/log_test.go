@@ -0,0 +1,64 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestJSONFields(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger.SetOutput(buf)
+	defer logger.SetOutput(os.Stderr)
+	if err := SetFormat(FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer SetFormat(FormatText)
+
+	ctx := context.WithValue(context.Background(), MSG_ID, "trace-1")
+	Warn(ctx, "proxy failed", Fields{
+		FieldUID:      "user",
+		FieldBindPort: 8080,
+	}, Fields{FieldError: errors.New("broken pipe")})
+
+	got := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal log entry %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":         "proxy failed",
+		"level":       "warning",
+		FieldTraceID:  "trace-1",
+		FieldUID:      "user",
+		FieldBindPort: float64(8080),
+		FieldError:    "broken pipe",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("field %s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{format: ""},
+		{format: FormatText},
+		{format: FormatJSON},
+		{format: "xml", wantErr: true},
+	}
+	defer SetFormat(FormatText)
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if err := SetFormat(tt.format); (err != nil) != tt.wantErr {
+				t.Errorf("SetFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
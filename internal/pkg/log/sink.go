@@ -0,0 +1,94 @@
+package log
+
+import (
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Sinks decide where logs written
+//
+// File: path of log file, MaxSize in megabytes, MaxAge in days, rotated
+// files are gzipped when Compress
+// Syslog: send to syslog, SyslogNetwork and SyslogAddr empty means local
+// /dev/log socket, SyslogTag default is narwhal
+// Journald: send to journald with fields as journal fields
+// Stderr: keep writing stderr when any other sink configured, stderr is
+// always written when no sink configured
+type Sinks struct {
+	File          string
+	MaxSize       int
+	MaxBackups    int
+	MaxAge        int
+	Compress      bool
+	Syslog        bool
+	SyslogNetwork string
+	SyslogAddr    string
+	SyslogTag     string
+	Journald      bool
+	Stderr        bool
+}
+
+// logFile is the log file written currently
+var logFile *lumberjack.Logger
+
+// SetSinks replace log outputs with sinks
+func SetSinks(sinks Sinks) error {
+	hooks := make(logrus.LevelHooks)
+	if sinks.Syslog {
+		hook, err := newSyslogHook(sinks)
+		if err != nil {
+			return err
+		}
+		hooks.Add(hook)
+	}
+	if sinks.Journald {
+		hook, err := newJournalHook()
+		if err != nil {
+			return err
+		}
+		hooks.Add(hook)
+	}
+
+	writers := make([]io.Writer, 0)
+	var file *lumberjack.Logger
+	if len(sinks.File) != 0 {
+		file = &lumberjack.Logger{
+			Filename:   sinks.File,
+			MaxSize:    sinks.MaxSize,
+			MaxBackups: sinks.MaxBackups,
+			MaxAge:     sinks.MaxAge,
+			Compress:   sinks.Compress,
+		}
+		writers = append(writers, file)
+	}
+	if sinks.Stderr || (len(writers) == 0 && len(hooks) == 0) {
+		writers = append(writers, os.Stderr)
+	}
+
+	var out io.Writer = io.Discard
+	if len(writers) != 0 {
+		out = io.MultiWriter(writers...)
+	}
+
+	logger.SetOutput(out)
+	logger.ReplaceHooks(hooks)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	return nil
+}
+
+// SetLevelString set level by name, panic, fatal, error, warn, info, debug
+// or trace
+func SetLevelString(level string) error {
+	lv, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lv)
+	return nil
+}
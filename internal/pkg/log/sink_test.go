@@ -0,0 +1,55 @@
+package log
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetSinks_file(t *testing.T) {
+	defer SetSinks(Sinks{})
+
+	file := filepath.Join(t.TempDir(), "narwhal.log")
+	if err := SetSinks(Sinks{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	Info(context.Background(), "to file", Fields{FieldUID: "user"})
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "to file") || !strings.Contains(string(data), "uid=user") {
+		t.Errorf("log file got %q", string(data))
+	}
+}
+
+func TestSetLevelString(t *testing.T) {
+	defer logger.SetLevel(logrus.InfoLevel)
+
+	tests := []struct {
+		level   string
+		want    logrus.Level
+		wantErr bool
+	}{
+		{level: "error", want: logrus.ErrorLevel},
+		{level: "warn", want: logrus.WarnLevel},
+		{level: "debug", want: logrus.DebugLevel},
+		{level: "verbose", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			err := SetLevelString(tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetLevelString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && logger.GetLevel() != tt.want {
+				t.Errorf("SetLevelString() level = %v, want %v", logger.GetLevel(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+//go:build !windows
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// newSyslogHook connect to syslog of sinks, tag default is narwhal
+func newSyslogHook(sinks Sinks) (logrus.Hook, error) {
+	tag := sinks.SyslogTag
+	if len(tag) == 0 {
+		tag = "narwhal"
+	}
+	hook, err := lSyslog.NewSyslogHook(sinks.SyslogNetwork, sinks.SyslogAddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog %s", err.Error())
+	}
+	return hook, nil
+}
+
+func newJournalHook() (logrus.Hook, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("journald not available")
+	}
+	return journalHook{}, nil
+}
+
+// journalHook send entries to journald, fields are sent as upper case
+// journal fields, e.g. bind_port as BIND_PORT
+type journalHook struct{}
+
+func (journalHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (journalHook) Fire(entry *logrus.Entry) error {
+	vars := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		vars[journalField(k)] = fmt.Sprint(v)
+	}
+	return journal.Send(entry.Message, journalPriority(entry.Level), vars)
+}
+
+// journalField convert key into journal field name, which is made of upper
+// case letters, digits and underscores, not starting with underscore
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return "NARWHAL_" + strings.TrimLeft(name, "_")
+}
+
+func journalPriority(level logrus.Level) journal.Priority {
+	switch level {
+	case logrus.PanicLevel:
+		return journal.PriEmerg
+	case logrus.FatalLevel:
+		return journal.PriCrit
+	case logrus.ErrorLevel:
+		return journal.PriErr
+	case logrus.WarnLevel:
+		return journal.PriWarning
+	case logrus.InfoLevel:
+		return journal.PriInfo
+	default:
+		return journal.PriDebug
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package log
+
+import "testing"
+
+func TestJournalField(t *testing.T) {
+	tests := map[string]string{
+		FieldBindPort:   "NARWHAL_BIND_PORT",
+		"_private":      "NARWHAL_PRIVATE",
+		"remote-addr.v": "NARWHAL_REMOTE_ADDR_V",
+	}
+	for key, want := range tests {
+		if got := journalField(key); got != want {
+			t.Errorf("journalField(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
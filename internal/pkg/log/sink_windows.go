@@ -0,0 +1,15 @@
+package log
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newSyslogHook(sinks Sinks) (logrus.Hook, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
+
+func newJournalHook() (logrus.Hook, error) {
+	return nil, errors.New("journald not supported on this platform")
+}
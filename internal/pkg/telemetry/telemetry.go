@@ -0,0 +1,194 @@
+// Package telemetry trace sessions and visitor streams with opentelemetry
+// spans, trace id of spans is the trace id of ctx set by utils, so logs
+// and spans of a session share the same id
+package telemetry
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"github.com/lucheng0127/narwhal/internal/pkg/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/lucheng0127/narwhal"
+
+// Exporters of spans
+const (
+	ExporterNone   = ""       // Tracing disabled
+	ExporterOff    = "none"   // Alias of ExporterNone
+	ExporterStdout = "stdout" // Pretty json to stdout
+	ExporterFile   = "file"   // Json lines to Config.File
+	ExporterOTLP   = "otlp"   // OTLP over http to Config.Endpoint
+)
+
+// Attribute keys of spans
+const (
+	AttrUID        = attribute.Key("narwhal.uid")
+	AttrBindPort   = attribute.Key("narwhal.bind_port")
+	AttrLocalPort  = attribute.Key("narwhal.local_port")
+	AttrStreamID   = attribute.Key("narwhal.stream_id")
+	AttrService    = attribute.Key("narwhal.service")
+	AttrTarget     = attribute.Key("narwhal.target")
+	AttrRemoteAddr = attribute.Key("narwhal.remote_addr")
+	AttrBytesIn    = attribute.Key("narwhal.bytes_in")
+	AttrBytesOut   = attribute.Key("narwhal.bytes_out")
+)
+
+// Config of tracing
+//
+// Exporter: none or empty, stdout, file or otlp
+// File: path spans written to with file exporter
+// Endpoint: host:port of OTLP http receiver, default localhost:4318
+// Insecure: use http instead of https for OTLP
+// SampleRatio: ratio of sessions traced, 0 means trace all
+// ServiceName: default narwhal
+type Config struct {
+	Exporter    string
+	File        string
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+	ServiceName string
+}
+
+// Setup install the global tracer provider, the returned func flush and
+// stop exporting, it must be called before exit
+func Setup(conf Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+
+	switch conf.Exporter {
+	case ExporterNone, ExporterOff:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open span file %s", err.Error())
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		opts := make([]otlptracehttp.Option, 0)
+		if len(conf.Endpoint) != 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unsupported span exporter [%s]", conf.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create span exporter %s", err.Error())
+	}
+
+	name := conf.ServiceName
+	if len(name) == 0 {
+		name = "narwhal"
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithIDGenerator(newIDGenerator()),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(name),
+			semconv.ServiceVersion(version.Version()),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// Start start a span named name as child of span in ctx, the span is a no
+// op when tracing not set up
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End end span, span status is error when err not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID return opentelemetry trace id of trace id set by utils, for child
+// trace id the parent part is used
+func TraceID(ctx context.Context) (trace.TraceID, bool) {
+	id := utils.GetTraceID(ctx)
+	id, _, _ = strings.Cut(id, "-")
+	tid, err := trace.TraceIDFromHex(id)
+	if err != nil {
+		return trace.TraceID{}, false
+	}
+	return tid, true
+}
+
+// idGenerator use trace id of ctx for root spans, so spans of a session
+// share the trace id in logs
+type idGenerator struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newIDGenerator() *idGenerator {
+	var seed int64
+	binary.Read(crand.Reader, binary.LittleEndian, &seed)
+	return &idGenerator{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (g *idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	tid, ok := TraceID(ctx)
+	if !ok {
+		g.mu.Lock()
+		g.rand.Read(tid[:])
+		g.mu.Unlock()
+	}
+	return tid, g.NewSpanID(ctx, tid)
+}
+
+func (g *idGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	var sid trace.SpanID
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !sid.IsValid() {
+		g.rand.Read(sid[:])
+	}
+	return sid
+}
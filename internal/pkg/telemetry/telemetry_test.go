@@ -0,0 +1,94 @@
+package telemetry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStart_traceID(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithIDGenerator(newIDGenerator()),
+	)
+	otel.SetTracerProvider(tp)
+	defer tp.Shutdown(context.Background())
+
+	ctx := utils.NewTraceContext()
+	traceID := utils.GetTraceID(ctx)
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{
+			name: "session",
+			ctx:  ctx,
+			want: traceID,
+		},
+		{
+			name: "visitor stream",
+			ctx:  utils.NewChildTraceContext(ctx, "3"),
+			want: traceID,
+		},
+		{
+			name: "trace id from old peer",
+			ctx:  utils.WithTraceID(context.Background(), "1a2b3c4d"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, span := Start(tt.ctx, tt.name)
+			span.End()
+
+			got := span.SpanContext().TraceID()
+			if !got.IsValid() {
+				t.Fatalf("Start() trace id %s invalidate", got)
+			}
+			if len(tt.want) != 0 && got.String() != tt.want {
+				t.Errorf("Start() trace id = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetup_exporter(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Config
+		wantErr bool
+	}{
+		{
+			name: "disabled",
+		},
+		{
+			name: "none",
+			conf: Config{Exporter: ExporterOff},
+		},
+		{
+			name: "file",
+			conf: Config{Exporter: ExporterFile, File: t.TempDir() + "/spans.json"},
+		},
+		{
+			name:    "unknown exporter",
+			conf:    Config{Exporter: "zipkin"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := Setup(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				shutdown(context.Background())
+			}
+		})
+	}
+}
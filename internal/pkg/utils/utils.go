@@ -8,9 +8,11 @@ import (
 	"github.com/lucheng0127/narwhal/internal/pkg/log"
 )
 
+// genUUID return 32 hex characters, the same size as opentelemetry trace
+// id, so spans of a trace can be found by trace id in logs
 func genUUID() string {
-	uuid := "00000000"
-	u := make([]byte, 4)
+	uuid := "00000000000000000000000000000000"
+	u := make([]byte, 16)
 	_, err := rand.Read(u)
 	if err == nil {
 		uuid = hex.EncodeToString(u)
@@ -27,3 +29,21 @@ func NewTraceContext() context.Context {
 	ctx := context.Background()
 	return AddContextTraceID(ctx)
 }
+
+// WithTraceID return ctx carrying traceID, used to continue a trace
+// received from peer
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, log.MSG_ID, traceID)
+}
+
+// GetTraceID return trace id of ctx, empty if not set
+func GetTraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(log.MSG_ID).(string)
+	return traceID
+}
+
+// NewChildTraceContext return ctx with trace id of parent suffixed by id,
+// so child trace can be correlated with its parent
+func NewChildTraceContext(ctx context.Context, id string) context.Context {
+	return WithTraceID(ctx, GetTraceID(ctx)+"-"+id)
+}
@@ -1,6 +1,10 @@
 package version
 
-import "fmt"
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
 
 const (
 	MAJOR  uint   = 0
@@ -12,3 +16,51 @@ const (
 func Version() string {
 	return fmt.Sprintf("%d.%d.%d%s", MAJOR, MINOR, PATCH, SUFFIX)
 }
+
+// Info is build info of binary, Commit, BuildTime and Modified come from
+// vcs info stamped by go build, they are empty when built out of git
+type Info struct {
+	Version   string
+	Commit    string
+	BuildTime string
+	Modified  bool
+	GoVersion string
+	Platform  string
+}
+
+// BuildInfo return build info of running binary
+func BuildInfo() Info {
+	info := Info{
+		Version:   Version(),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.BuildTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+func (i Info) String() string {
+	commit := i.Commit
+	if len(commit) == 0 {
+		commit = "unknown"
+	}
+	if i.Modified {
+		commit += "-dirty"
+	}
+	return fmt.Sprintf("Narwhal version %s\ncommit: %s\nbuild time: %s\ngo version: %s\nplatform: %s",
+		i.Version, commit, i.BuildTime, i.GoVersion, i.Platform)
+}
@@ -5,13 +5,134 @@
 package mock_connection
 
 import (
+	context "context"
 	net "net"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	connection "github.com/lucheng0127/narwhal/pkg/connection"
 )
 
+// MockClient is a mock of Client interface.
+type MockClient struct {
+	ctrl     *gomock.Controller
+	recorder *MockClientMockRecorder
+}
+
+// MockClientMockRecorder is the mock recorder for MockClient.
+type MockClientMockRecorder struct {
+	mock *MockClient
+}
+
+// NewMockClient creates a new mock instance.
+func NewMockClient(ctrl *gomock.Controller) *MockClient {
+	mock := &MockClient{ctrl: ctrl}
+	mock.recorder = &MockClientMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockClient) EXPECT() *MockClientMockRecorder {
+	return m.recorder
+}
+
+// Auth mocks base method.
+func (m *MockClient) Auth(uid string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Auth", uid)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Auth indicates an expected call of Auth.
+func (mr *MockClientMockRecorder) Auth(uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Auth", reflect.TypeOf((*MockClient)(nil).Auth), uid)
+}
+
+// Bind mocks base method.
+func (m *MockClient) Bind(rPort uint16) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Bind", rPort)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Bind indicates an expected call of Bind.
+func (mr *MockClientMockRecorder) Bind(rPort interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bind", reflect.TypeOf((*MockClient)(nil).Bind), rPort)
+}
+
+// Close mocks base method.
+func (m *MockClient) Close() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Close")
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockClientMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockClient)(nil).Close))
+}
+
+// Forward mocks base method.
+func (m *MockClient) Forward(target string, lConn net.Conn) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Forward", target, lConn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Forward indicates an expected call of Forward.
+func (mr *MockClientMockRecorder) Forward(target, lConn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Forward", reflect.TypeOf((*MockClient)(nil).Forward), target, lConn)
+}
+
+// MonitorAndProxy mocks base method.
+func (m *MockClient) MonitorAndProxy(lPort uint16) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MonitorAndProxy", lPort)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MonitorAndProxy indicates an expected call of MonitorAndProxy.
+func (mr *MockClientMockRecorder) MonitorAndProxy(lPort interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MonitorAndProxy", reflect.TypeOf((*MockClient)(nil).MonitorAndProxy), lPort)
+}
+
+// Register mocks base method.
+func (m *MockClient) Register(name, key string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Register", name, key)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Register indicates an expected call of Register.
+func (mr *MockClientMockRecorder) Register(name, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Register", reflect.TypeOf((*MockClient)(nil).Register), name, key)
+}
+
+// Visit mocks base method.
+func (m *MockClient) Visit(name, key string, vConn net.Conn) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Visit", name, key, vConn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Visit indicates an expected call of Visit.
+func (mr *MockClientMockRecorder) Visit(name, key, vConn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Visit", reflect.TypeOf((*MockClient)(nil).Visit), name, key, vConn)
+}
+
 // MockConnection is a mock of Connection interface.
 type MockConnection struct {
 	ctrl     *gomock.Controller
@@ -36,17 +157,17 @@ func (m *MockConnection) EXPECT() *MockConnectionMockRecorder {
 }
 
 // BindAndProxy mocks base method.
-func (m *MockConnection) BindAndProxy(bPort int) error {
+func (m *MockConnection) BindAndProxy(ctx context.Context, bPort int) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "BindAndProxy", bPort)
+	ret := m.ctrl.Call(m, "BindAndProxy", ctx, bPort)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // BindAndProxy indicates an expected call of BindAndProxy.
-func (mr *MockConnectionMockRecorder) BindAndProxy(bPort interface{}) *gomock.Call {
+func (mr *MockConnectionMockRecorder) BindAndProxy(ctx, bPort interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BindAndProxy", reflect.TypeOf((*MockConnection)(nil).BindAndProxy), bPort)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BindAndProxy", reflect.TypeOf((*MockConnection)(nil).BindAndProxy), ctx, bPort)
 }
 
 // Close mocks base method.
@@ -61,6 +182,18 @@ func (mr *MockConnectionMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockConnection)(nil).Close))
 }
 
+// Forward mocks base method.
+func (m *MockConnection) Forward(ctx context.Context, tConn net.Conn) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Forward", ctx, tConn)
+}
+
+// Forward indicates an expected call of Forward.
+func (mr *MockConnectionMockRecorder) Forward(ctx, tConn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Forward", reflect.TypeOf((*MockConnection)(nil).Forward), ctx, tConn)
+}
+
 // GetArrs mocks base method.
 func (m *MockConnection) GetArrs() connection.Arrs {
 	m.ctrl.T.Helper()
@@ -75,6 +208,20 @@ func (mr *MockConnectionMockRecorder) GetArrs() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetArrs", reflect.TypeOf((*MockConnection)(nil).GetArrs))
 }
 
+// Monitor mocks base method.
+func (m *MockConnection) Monitor() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Monitor")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Monitor indicates an expected call of Monitor.
+func (mr *MockConnectionMockRecorder) Monitor() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Monitor", reflect.TypeOf((*MockConnection)(nil).Monitor))
+}
+
 // NewPConn mocks base method.
 func (m *MockConnection) NewPConn(pConn net.Conn) {
 	m.ctrl.T.Helper()
@@ -87,6 +234,18 @@ func (mr *MockConnectionMockRecorder) NewPConn(pConn interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewPConn", reflect.TypeOf((*MockConnection)(nil).NewPConn), pConn)
 }
 
+// NewVisitor mocks base method.
+func (m *MockConnection) NewVisitor(ctx context.Context, vConn net.Conn) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "NewVisitor", ctx, vConn)
+}
+
+// NewVisitor indicates an expected call of NewVisitor.
+func (mr *MockConnectionMockRecorder) NewVisitor(ctx, vConn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewVisitor", reflect.TypeOf((*MockConnection)(nil).NewVisitor), ctx, vConn)
+}
+
 // SetAuthCtx mocks base method.
 func (m *MockConnection) SetAuthCtx(authCtx string) {
 	m.ctrl.T.Helper()
@@ -99,6 +258,54 @@ func (mr *MockConnectionMockRecorder) SetAuthCtx(authCtx interface{}) *gomock.Ca
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAuthCtx", reflect.TypeOf((*MockConnection)(nil).SetAuthCtx), authCtx)
 }
 
+// SetExpire mocks base method.
+func (m *MockConnection) SetExpire(t time.Time) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetExpire", t)
+}
+
+// SetExpire indicates an expected call of SetExpire.
+func (mr *MockConnectionMockRecorder) SetExpire(t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetExpire", reflect.TypeOf((*MockConnection)(nil).SetExpire), t)
+}
+
+// SetGrant mocks base method.
+func (m *MockConnection) SetGrant(g *connection.Grant) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetGrant", g)
+}
+
+// SetGrant indicates an expected call of SetGrant.
+func (mr *MockConnectionMockRecorder) SetGrant(g interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetGrant", reflect.TypeOf((*MockConnection)(nil).SetGrant), g)
+}
+
+// SetKeyExpire mocks base method.
+func (m *MockConnection) SetKeyExpire(t time.Time) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetKeyExpire", t)
+}
+
+// SetKeyExpire indicates an expected call of SetKeyExpire.
+func (mr *MockConnectionMockRecorder) SetKeyExpire(t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetKeyExpire", reflect.TypeOf((*MockConnection)(nil).SetKeyExpire), t)
+}
+
+// SetLimits mocks base method.
+func (m *MockConnection) SetLimits(l connection.Limits) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetLimits", l)
+}
+
+// SetLimits indicates an expected call of SetLimits.
+func (mr *MockConnectionMockRecorder) SetLimits(l interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLimits", reflect.TypeOf((*MockConnection)(nil).SetLimits), l)
+}
+
 // SetToProxyConn mocks base method.
 func (m *MockConnection) SetToProxyConn() {
 	m.ctrl.T.Helper()
@@ -111,6 +318,18 @@ func (mr *MockConnectionMockRecorder) SetToProxyConn() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetToProxyConn", reflect.TypeOf((*MockConnection)(nil).SetToProxyConn))
 }
 
+// SetToVisitorConn mocks base method.
+func (m *MockConnection) SetToVisitorConn() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetToVisitorConn")
+}
+
+// SetToVisitorConn indicates an expected call of SetToVisitorConn.
+func (mr *MockConnectionMockRecorder) SetToVisitorConn() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetToVisitorConn", reflect.TypeOf((*MockConnection)(nil).SetToVisitorConn))
+}
+
 // SetUID mocks base method.
 func (m *MockConnection) SetUID(uid string) {
 	m.ctrl.T.Helper()
@@ -122,3 +341,89 @@ func (mr *MockConnectionMockRecorder) SetUID(uid interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUID", reflect.TypeOf((*MockConnection)(nil).SetUID), uid)
 }
+
+// Terminate mocks base method.
+func (m *MockConnection) Terminate() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Terminate")
+}
+
+// Terminate indicates an expected call of Terminate.
+func (mr *MockConnectionMockRecorder) Terminate() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Terminate", reflect.TypeOf((*MockConnection)(nil).Terminate))
+}
+
+// MockcloseWriter is a mock of closeWriter interface.
+type MockcloseWriter struct {
+	ctrl     *gomock.Controller
+	recorder *MockcloseWriterMockRecorder
+}
+
+// MockcloseWriterMockRecorder is the mock recorder for MockcloseWriter.
+type MockcloseWriterMockRecorder struct {
+	mock *MockcloseWriter
+}
+
+// NewMockcloseWriter creates a new mock instance.
+func NewMockcloseWriter(ctrl *gomock.Controller) *MockcloseWriter {
+	mock := &MockcloseWriter{ctrl: ctrl}
+	mock.recorder = &MockcloseWriterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockcloseWriter) EXPECT() *MockcloseWriterMockRecorder {
+	return m.recorder
+}
+
+// CloseWrite mocks base method.
+func (m *MockcloseWriter) CloseWrite() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseWrite")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CloseWrite indicates an expected call of CloseWrite.
+func (mr *MockcloseWriterMockRecorder) CloseWrite() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseWrite", reflect.TypeOf((*MockcloseWriter)(nil).CloseWrite))
+}
+
+// MockcloseReader is a mock of closeReader interface.
+type MockcloseReader struct {
+	ctrl     *gomock.Controller
+	recorder *MockcloseReaderMockRecorder
+}
+
+// MockcloseReaderMockRecorder is the mock recorder for MockcloseReader.
+type MockcloseReaderMockRecorder struct {
+	mock *MockcloseReader
+}
+
+// NewMockcloseReader creates a new mock instance.
+func NewMockcloseReader(ctrl *gomock.Controller) *MockcloseReader {
+	mock := &MockcloseReader{ctrl: ctrl}
+	mock.recorder = &MockcloseReaderMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockcloseReader) EXPECT() *MockcloseReaderMockRecorder {
+	return m.recorder
+}
+
+// CloseRead mocks base method.
+func (m *MockcloseReader) CloseRead() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseRead")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CloseRead indicates an expected call of CloseRead.
+func (mr *MockcloseReaderMockRecorder) CloseRead() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseRead", reflect.TypeOf((*MockcloseReader)(nil).CloseRead))
+}
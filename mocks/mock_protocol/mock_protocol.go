@@ -115,6 +115,34 @@ func (m *MockPL) EXPECT() *MockPLMockRecorder {
 	return m.recorder
 }
 
+// Byte mocks base method.
+func (m *MockPL) Byte() byte {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Byte")
+	ret0, _ := ret[0].(byte)
+	return ret0
+}
+
+// Byte indicates an expected call of Byte.
+func (mr *MockPLMockRecorder) Byte() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Byte", reflect.TypeOf((*MockPL)(nil).Byte))
+}
+
+// Fields mocks base method.
+func (m *MockPL) Fields() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Fields")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// Fields indicates an expected call of Fields.
+func (mr *MockPLMockRecorder) Fields() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fields", reflect.TypeOf((*MockPL)(nil).Fields))
+}
+
 // Int mocks base method.
 func (m *MockPL) Int() int {
 	m.ctrl.T.Helper()
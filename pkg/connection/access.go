@@ -0,0 +1,86 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Close reasons of visitor connections
+const (
+	ReasonEOF          = "eof"           // Both sides finished
+	ReasonIdleTimeout  = "idle_timeout"  // No traffic longer than idle timeout
+	ReasonError        = "error"         // Any side failed
+	ReasonNotifyFailed = "notify_failed" // Failed to notify client
+	ReasonNoProxyConn  = "no_proxy_conn" // Client established no proxy connection in time
+	ReasonClientGone   = "client_gone"   // Control connection closed before proxying
+	ReasonRejected     = "rejected"      // Refused by admit func
+	ReasonLimited      = "limited"       // Refused by limits of tunnel
+)
+
+// AccessRecord is the accounting of a visitor connection
+//
+// Visitor: remote address of visitor
+// BindPort: port visitor connected to, 0 for secret service visitors
+// UID: user serving the tunnel
+// SessionID: trace id of control connection session
+// StreamID: sequence of visitor in session
+// BytesIn: bytes from visitor to client
+// BytesOut: bytes from client to visitor
+// Reason: why connection closed, Err is set when reason is error
+type AccessRecord struct {
+	Visitor   string
+	BindPort  int
+	UID       string
+	SessionID string
+	StreamID  uint64
+	Start     time.Time
+	Duration  time.Duration
+	BytesIn   int64
+	BytesOut  int64
+	Reason    string
+	Err       error
+}
+
+// AccessRecorder record each visitor connection when it closes
+type AccessRecorder interface {
+	Record(rec AccessRecord)
+}
+
+// AccessLog record visitor connections with r
+func AccessLog(r AccessRecorder) SOption {
+	return func(c *SConn) {
+		c.access = r
+	}
+}
+
+// closeReason return the close reason of a finished io switch
+func closeReason(stat SpliceStat) string {
+	switch {
+	case stat.Err == nil:
+		return ReasonEOF
+	case errors.Is(stat.Err, ErrIdleTimeout):
+		return ReasonIdleTimeout
+	default:
+		return ReasonError
+	}
+}
+
+// record report access of vConn if recorder configured
+func (c *SConn) record(rec AccessRecord, vConn net.Conn, stat SpliceStat) {
+	if c.access == nil {
+		return
+	}
+
+	rec.Visitor = vConn.RemoteAddr().String()
+	rec.BindPort = c.arrs.BindPort
+	rec.UID = c.arrs.UID
+	rec.Duration = time.Since(rec.Start)
+	rec.BytesIn = stat.InBytes
+	rec.BytesOut = stat.OutBytes
+	if len(rec.Reason) == 0 {
+		rec.Reason = closeReason(stat)
+		rec.Err = stat.Err
+	}
+	c.access.Record(rec)
+}
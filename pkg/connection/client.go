@@ -1,30 +1,337 @@
 package connection
 
-import "net"
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
+	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"github.com/lucheng0127/narwhal/pkg/protocol"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrSessionExists is returned when binding or registering refused
+	// because session of the uid is alive on server
+	ErrSessionExists = errors.New("session of uid exists")
+	// ErrSessionReplaced is returned by MonitorAndProxy when session closed
+	// by server for a new session of the same uid
+	ErrSessionReplaced = errors.New("session replaced by a new one of uid")
+)
 
 type CConn struct {
-	arrs Arrs
+	arrs   Arrs
+	remote *transport.Endpoint // Server address, used to establish proxy connection
+	token  string              // Sent with uid on auth, e.g. a JWT
+	signer ssh.Signer          // Sign challenge of server on auth instead of sending token
+	log    logger.Logger
+}
+
+type COption func(c *CConn)
+
+// ClientLogger log through l instead of the default logger
+func ClientLogger(l logger.Logger) COption {
+	return func(c *CConn) {
+		c.log = l
+	}
+}
+
+// AuthToken send token with uid on auth, uid may be empty when server
+// takes it from token
+func AuthToken(token string) COption {
+	return func(c *CConn) {
+		c.token = token
+	}
+}
+
+// AuthKey auth by signing challenge of server with signer, server checks
+// it against public keys authorized for uid
+func AuthKey(signer ssh.Signer) COption {
+	return func(c *CConn) {
+		c.signer = signer
+	}
 }
 
-func NewClient(conn net.Conn) Client {
+// Remote establish proxy connections to ep, tcp remote address of the
+// connection by default
+func Remote(ep *transport.Endpoint) COption {
+	return func(c *CConn) {
+		c.remote = ep
+	}
+}
+
+func NewClient(conn net.Conn, opts ...COption) Client {
 	c := new(CConn)
 	c.arrs.Conn = conn
+	c.log = logger.Default()
+	for _, o := range opts {
+		o(c)
+	}
+	if c.remote == nil {
+		c.remote = transport.TCP(conn.RemoteAddr().String())
+	}
 	return c
 }
 
+// request send request with payload and check reply code and result
+func request(conn net.Conn, code, rCode byte, payload []byte) error {
+	_, err := requestData(conn, code, rCode, payload)
+	return err
+}
+
+// requestData is request returning data following result code of reply
+func requestData(conn net.Conn, code, rCode byte, payload []byte) ([]byte, error) {
+	ret, data, err := exchange(conn, code, rCode, payload)
+	if err != nil {
+		return nil, err
+	}
+	if ret != protocol.RetSucceed {
+		return nil, fmt.Errorf("request refused by server")
+	}
+	return data, nil
+}
+
+// exchange send request with payload, check reply code and return result
+// code and data following it
+func exchange(conn net.Conn, code, rCode byte, payload []byte) (byte, []byte, error) {
+	pkt := protocol.NewPkt(code, payload)
+	err := pkt.SendToConn(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rPkt, err := protocol.ReadFromConn(conn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("parse reply %s", err.Error())
+	}
+
+	if rPkt.GetPCode() != rCode {
+		return 0, nil, fmt.Errorf("unexpected reply code [%#x]", rPkt.GetPCode())
+	}
+	data := []byte(rPkt.GetPayload().String())
+	if len(data) != 0 {
+		data = data[1:]
+	}
+	return rPkt.GetPayload().Byte(), data, nil
+}
+
+// requestSession is request of binding or registering, which is subject to
+// session policy of server
+func (c *CConn) requestSession(code, rCode byte, payload []byte) error {
+	ret, _, err := exchange(c.arrs.Conn, code, rCode, payload)
+	if err != nil {
+		return err
+	}
+	switch ret {
+	case protocol.RetSucceed:
+		return nil
+	case protocol.RetReplaced:
+		c.log.Info(utils.NewTraceContext(), "previous session of uid replaced", logger.Fields{logger.FieldUID: c.arrs.UID})
+		return nil
+	case protocol.RetSessionExists:
+		return ErrSessionExists
+	}
+	return fmt.Errorf("request refused by server")
+}
+
 // Auth connection with uid, get authCtx from reply
 func (c *CConn) Auth(uid string) error {
 	c.arrs.UID = uid
+	if c.signer != nil {
+		return c.keyAuth(uid)
+	}
+	payload := []byte(uid)
+	if len(c.token) != 0 {
+		payload = protocol.EncodeFields(uid, c.token)
+	}
+	err := request(c.arrs.Conn, protocol.ReqAuth, protocol.RepAuth, payload)
+	if err != nil {
+		return fmt.Errorf("auth with uid [%s] %s", uid, err.Error())
+	}
+	return nil
+}
+
+// keyAuth send public key of signer with uid, then sign the challenge of
+// server. Rsa keys sign with rsa-sha2-256, server refuses ssh-rsa
+func (c *CConn) keyAuth(uid string) error {
+	pub := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(c.signer.PublicKey())))
+	challenge, err := requestData(c.arrs.Conn, protocol.ReqKeyAuth, protocol.RepKeyAuth, protocol.EncodeFields(uid, pub))
+	if err != nil {
+		return fmt.Errorf("key auth with uid [%s] %s", uid, err.Error())
+	}
+
+	data := protocol.KeyAuthData(uid, challenge)
+	var sig *ssh.Signature
+	if as, ok := c.signer.(ssh.AlgorithmSigner); ok && c.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	} else {
+		sig, err = c.signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return fmt.Errorf("sign challenge %s", err.Error())
+	}
+
+	err = request(c.arrs.Conn, protocol.ReqKeySign, protocol.RepKeySign, ssh.Marshal(sig))
+	if err != nil {
+		return fmt.Errorf("key auth with uid [%s] %s", uid, err.Error())
+	}
 	return nil
 }
 
 // Send ReqBind with payload rPort
 func (c *CConn) Bind(rPort uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, rPort)
+	err := c.requestSession(protocol.ReqBind, protocol.RepBind, payload)
+	if err != nil {
+		return fmt.Errorf("bind port [%d] %w", rPort, err)
+	}
+	c.arrs.BindPort = int(rPort)
+	return nil
+}
+
+// Send ReqSecret with service name and key
+func (c *CConn) Register(name, key string) error {
+	err := c.requestSession(protocol.ReqSecret, protocol.RepSecret, protocol.EncodeFields(name, key))
+	if err != nil {
+		return fmt.Errorf("register secret service [%s] %w", name, err)
+	}
 	return nil
 }
 
-// Monitor notify and start proxy
+// Monitor notify and start proxy, until server closes the session
 func (c *CConn) MonitorAndProxy(lPort uint16) error {
+	for {
+		pkt, err := protocol.ReadFromConn(c.arrs.Conn)
+		if err != nil {
+			return fmt.Errorf("read notify %s", err.Error())
+		}
+
+		if pkt.GetPCode() == protocol.RepEvict {
+			if pkt.GetPayload().Byte() == protocol.RetReplaced {
+				return ErrSessionReplaced
+			}
+			return fmt.Errorf("session closed by server [%#x]", pkt.GetPayload().Byte())
+		}
+
+		if pkt.GetPCode() != protocol.RepNotify {
+			ctx := utils.NewTraceContext()
+			c.log.Warn(ctx, "ignore unexpected packet from server", logger.Fields{
+				"pcode": fmt.Sprintf("%#x", pkt.GetPCode()),
+			})
+			continue
+		}
+
+		// Payload is authCtx and trace id of the visitor stream, trace id
+		// is absent in notify from old server
+		fields := pkt.GetPayload().Fields()
+		if len(fields) == 0 {
+			continue
+		}
+		ctx := context.Background()
+		if len(fields) > 1 && len(fields[1]) != 0 {
+			ctx = utils.WithTraceID(ctx, fields[1])
+		} else {
+			ctx = utils.AddContextTraceID(ctx)
+		}
+		go c.proxy(ctx, fields[0], lPort)
+	}
+}
+
+// proxy establish a proxy connection with authCtx, and proxy it to lPort
+func (c *CConn) proxy(ctx context.Context, authCtx string, lPort uint16) {
+	ctx, span := telemetry.Start(ctx, "proxy", telemetry.AttrLocalPort.Int(int(lPort)))
+	defer span.End()
+
+	pConn, err := c.remote.Dial(ctx)
+	if err != nil {
+		c.log.Error(ctx, "connect to server", logger.Fields{
+			logger.FieldRemoteAddr: c.remote.String(),
+			logger.FieldError:      err,
+		})
+		return
+	}
+
+	err = request(pConn, protocol.ReqPConn, protocol.RepPConn, []byte(authCtx))
+	if err != nil {
+		c.log.Error(ctx, "establish proxy connection", logger.Fields{
+			logger.FieldAuthCtx: authCtx,
+			logger.FieldError:   err,
+		})
+		pConn.Close()
+		return
+	}
+
+	_, dSpan := telemetry.Start(ctx, "dial local", telemetry.AttrLocalPort.Int(int(lPort)))
+	tConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", lPort))
+	telemetry.End(dSpan, err)
+	if err != nil {
+		c.log.Error(ctx, "connect to local port", logger.Fields{
+			logger.FieldLocalPort: lPort,
+			logger.FieldError:     err,
+		})
+		pConn.Close()
+		return
+	}
+
+	stat := ioSwitch(ctx, c.log, pConn, tConn, 0)
+	c.log.Debug(ctx, "proxy to local port finished", logger.Fields{
+		logger.FieldLocalPort: lPort,
+		logger.FieldBytesIn:   stat.InBytes,
+		logger.FieldBytesOut:  stat.OutBytes,
+	})
+}
+
+// Visit secret service with name and key, then proxy vConn through
+// the connection until any side closed
+func (c *CConn) Visit(name, key string, vConn net.Conn) error {
+	err := request(c.arrs.Conn, protocol.ReqVisit, protocol.RepVisit, protocol.EncodeFields(name, key))
+	if err != nil {
+		vConn.Close()
+		c.arrs.Conn.Close()
+		return fmt.Errorf("visit secret service [%s] %s", name, err.Error())
+	}
+
+	ctx := utils.NewTraceContext()
+	stat := ioSwitch(ctx, c.log, vConn, c.arrs.Conn, 0)
+	if stat.Err != nil {
+		return stat.Err
+	}
+	c.log.Debug(ctx, "visit secret service finished", logger.Fields{
+		logger.FieldService:  name,
+		logger.FieldBytesIn:  stat.InBytes,
+		logger.FieldBytesOut: stat.OutBytes,
+	})
+	return nil
+}
+
+// Forward ask server to dial target, then proxy lConn through the
+// connection until any side closed
+func (c *CConn) Forward(target string, lConn net.Conn) error {
+	err := request(c.arrs.Conn, protocol.ReqForward, protocol.RepForward, []byte(target))
+	if err != nil {
+		lConn.Close()
+		c.arrs.Conn.Close()
+		return fmt.Errorf("forward to [%s] %s", target, err.Error())
+	}
+
+	ctx := utils.NewTraceContext()
+	stat := ioSwitch(ctx, c.log, lConn, c.arrs.Conn, 0)
+	if stat.Err != nil {
+		return stat.Err
+	}
+	c.log.Debug(ctx, "forward finished", logger.Fields{
+		logger.FieldTarget:   target,
+		logger.FieldBytesIn:  stat.InBytes,
+		logger.FieldBytesOut: stat.OutBytes,
+	})
 	return nil
 }
 
@@ -1,13 +1,17 @@
 package connection
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"runtime/debug"
+	"sync/atomic"
+	"time"
 
 	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
-	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
 )
 
 type Arrs struct {
@@ -18,12 +22,36 @@ type Arrs struct {
 	Conn        net.Conn
 	ProxyConnCh chan net.Conn // Connection used to port forwarding
 	ProxyConn   bool
+	VisitorConn bool      // Connection of a visitor to secret service
+	Limits      Limits    // Limits of visitor connections of tunnel
+	Grant       *Grant    // Permissions of credential authenticated with, nil for users of user store
+	Expire      time.Time // When credential authenticated with expires, zero for never
+	KeyExpire   time.Time // When ssh key authenticated with expires, reloaded user validity can't extend it
 }
 
+// Grant is what a credential like JWT permits, instead of user store
+//
+// Ports: port spec can be bound
+type Grant struct {
+	Ports string
+}
+
+// Client is used to implement connection from narwhal client to server
+//
+// Auth: auth connection with uid, with token or key set by AuthToken or AuthKey
+// Bind: ask server to listen rPort and proxy it to client
+// Register: register a secret service with name and key, no port listened
+// MonitorAndProxy: wait notify from server and proxy traffic to lPort
+// Visit: connect to secret service with name and key then proxy vConn
+// Forward: ask server to dial target then proxy lConn to it
+// Close: close connection
 type Client interface {
 	Auth(uid string) error
 	Bind(rPort uint16) error
+	Register(name, key string) error
 	MonitorAndProxy(lPort uint16) error
+	Visit(name, key string, vConn net.Conn) error
+	Forward(target string, lConn net.Conn) error
 	Close()
 }
 
@@ -37,34 +65,212 @@ type Client interface {
 // SetAuthCtx: add authCtx to connection
 // GetBindPort: get bind port of connection
 // Reply: reply connection with reply code and payload
+// NewVisitor: proxy a visitor connection through client
+// Monitor: wait until control connection closed
+// Forward: proxy the connection itself to tConn dialed by server
+// SetLimits: limit visitor connections of tunnel
+// SetGrant: set permissions of credential authenticated with
+// SetExpire: set when credential authenticated with expires
+// SetKeyExpire: set when ssh key authenticated with expires
+// Terminate: close connection and streams proxied through it
 type Connection interface {
 	Close()
-	BindAndProxy(bPort int) error
+	BindAndProxy(ctx context.Context, bPort int) error
 	NewPConn(pConn net.Conn)
+	NewVisitor(ctx context.Context, vConn net.Conn)
+	Monitor() error
+	Forward(ctx context.Context, tConn net.Conn)
 	SetAuthCtx(authCtx string)
 	SetUID(uid string)
 	SetToProxyConn()
+	SetToVisitorConn()
+	SetLimits(l Limits)
+	SetGrant(g *Grant)
+	SetExpire(t time.Time)
+	SetKeyExpire(t time.Time)
+	Terminate()
 	GetArrs() Arrs
 }
 
-func copyIO(srcConn, dstConn net.Conn) {
-	defer srcConn.Close()
-	defer dstConn.Close()
-	io.Copy(dstConn, srcConn)
+// ErrIdleTimeout is reported by io switch when no traffic in both directions
+// for longer than the idle timeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// SpliceStat is the accounting of a finished io switch
+//
+// InBytes: bytes copied from pConn to tConn
+// OutBytes: bytes copied from tConn to pConn
+// Err: the first error reported by either direction, nil when both
+// directions finished with EOF
+type SpliceStat struct {
+	InBytes  int64
+	OutBytes int64
+	Err      error
+}
+
+// closeWriter is implemented by *net.TCPConn, *net.UnixConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeReader is implemented by *net.TCPConn and *net.UnixConn
+type closeReader interface {
+	CloseRead() error
+}
+
+// closeWrite send EOF to the peer of conn, if conn can't be half closed
+// close it entirely
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// closeRead stop receiving from conn, it's fine to do nothing when conn
+// can't be half closed, the reader already got EOF
+func closeRead(conn net.Conn) {
+	if cr, ok := conn.(closeReader); ok {
+		cr.CloseRead()
+	}
+}
+
+// activity track the last time traffic went through a switch in any
+// direction, a direction waiting for data is not idle while the other
+// direction is busy
+type activity struct {
+	timeout time.Duration
+	last    int64 // UnixNano
+}
+
+func newActivity(timeout time.Duration) *activity {
+	if timeout <= 0 {
+		return nil
+	}
+	return &activity{timeout: timeout, last: time.Now().UnixNano()}
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last))) >= a.timeout
 }
 
-func ioSwitch(pConn, tConn net.Conn) {
+// copy is io.Copy with read deadline refreshed by traffic
+func (a *activity) copy(dstConn, srcConn net.Conn) (int64, error) {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		srcConn.SetReadDeadline(time.Now().Add(a.timeout))
+		nr, rErr := srcConn.Read(buf)
+		if nr > 0 {
+			a.touch()
+			nw, wErr := dstConn.Write(buf[:nr])
+			written += int64(nw)
+			if wErr != nil {
+				return written, wErr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+			a.touch()
+		}
+
+		if rErr != nil {
+			if rErr == io.EOF {
+				return written, nil
+			}
+
+			var nErr net.Error
+			if errors.As(rErr, &nErr) && nErr.Timeout() {
+				if !a.idle() {
+					continue
+				}
+				return written, ErrIdleTimeout
+			}
+			return written, rErr
+		}
+	}
+}
+
+// copyIO copy srcConn to dstConn until EOF or error, then propagate the
+// half close to both sides
+func copyIO(srcConn, dstConn net.Conn, act *activity) (int64, error) {
+	var n int64
+	var err error
+	if act != nil {
+		n, err = act.copy(dstConn, srcConn)
+	} else {
+		n, err = io.Copy(dstConn, srcConn)
+	}
+	closeWrite(dstConn)
+	closeRead(srcConn)
+	return n, err
+}
+
+// ioSwitch proxy traffic between pConn and tConn, it returns when both
+// directions finished, any direction failed or no traffic for idle, both
+// connections are closed before return, idle <= 0 means never timeout
+func ioSwitch(ctx context.Context, log logger.Logger, pConn, tConn net.Conn, idle time.Duration) (stat SpliceStat) {
+	ctx, span := telemetry.Start(ctx, "splice")
+	defer func() {
+		span.SetAttributes(
+			telemetry.AttrBytesIn.Int64(stat.InBytes),
+			telemetry.AttrBytesOut.Int64(stat.OutBytes),
+		)
+		telemetry.End(span, stat.Err)
+	}()
+	defer pConn.Close()
+	defer tConn.Close()
 	defer func() {
 		if r := recover(); r != nil {
-			pConn.Close()
-			tConn.Close()
-			ctx := utils.NewTraceContext()
-			logger.Warn(ctx, fmt.Sprintf("stop proxy %s %s\n%s", pConn.RemoteAddr().String(), tConn.RemoteAddr().String(), debug.Stack()))
+			log.Warn(ctx, "stop proxy", logger.Fields{
+				logger.FieldRemoteAddr: pConn.RemoteAddr().String(),
+				logger.FieldTarget:     tConn.RemoteAddr().String(),
+				logger.FieldError:      fmt.Sprintf("%v\n%s", r, debug.Stack()),
+			})
+			stat.Err = fmt.Errorf("proxy panic %v", r)
 		}
 	}()
 
-	ctx := utils.NewTraceContext()
-	logger.Debug(ctx, fmt.Sprintf("proxy %s %s\n", pConn.RemoteAddr().String(), tConn.RemoteAddr().String()))
-	go copyIO(pConn, tConn)
-	go copyIO(tConn, pConn)
+	log.Debug(ctx, "proxy", logger.Fields{
+		logger.FieldRemoteAddr: pConn.RemoteAddr().String(),
+		logger.FieldTarget:     tConn.RemoteAddr().String(),
+	})
+
+	type result struct {
+		in  bool
+		n   int64
+		err error
+	}
+	act := newActivity(idle)
+	resCh := make(chan result, 2)
+	go func() {
+		n, err := copyIO(pConn, tConn, act)
+		resCh <- result{in: true, n: n, err: err}
+	}()
+	go func() {
+		n, err := copyIO(tConn, pConn, act)
+		resCh <- result{in: false, n: n, err: err}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res := <-resCh
+		if res.in {
+			stat.InBytes = res.n
+		} else {
+			stat.OutBytes = res.n
+		}
+
+		if res.err != nil && stat.Err == nil {
+			// Abort the other direction, it may wait for data forever
+			stat.Err = res.err
+			pConn.Close()
+			tConn.Close()
+		}
+	}
+	return
 }
@@ -0,0 +1,211 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+)
+
+// tcpPair return both ends of a loopback tcp connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	acceptCh := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptCh <- conn
+	}()
+
+	cConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sConn := <-acceptCh
+	if sConn == nil {
+		t.Fatal("accept connection failed")
+	}
+	return cConn.(*net.TCPConn), sConn.(*net.TCPConn)
+}
+
+func TestIoSwitchHalfClose(t *testing.T) {
+	// visitor <-> pConn | ioSwitch | tConn <-> target
+	visitor, pConn := tcpPair(t)
+	tConn, target := tcpPair(t)
+	defer visitor.Close()
+	defer target.Close()
+
+	statCh := make(chan SpliceStat)
+	go func() {
+		statCh <- ioSwitch(context.Background(), logger.Default(), pConn, tConn, 0)
+	}()
+
+	// Visitor send request then shutdown write side, wait for response
+	if _, err := visitor.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	visitor.CloseWrite()
+
+	req, err := io.ReadAll(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req) != "ping" {
+		t.Errorf("target got %q, want %q", req, "ping")
+	}
+
+	// Response must reach visitor after visitor half closed
+	if _, err := target.Write([]byte("pong!")); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	rep, err := io.ReadAll(visitor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep) != "pong!" {
+		t.Errorf("visitor got %q, want %q", rep, "pong!")
+	}
+
+	stat := <-statCh
+	if stat.Err != nil {
+		t.Errorf("ioSwitch() error = %v", stat.Err)
+	}
+	if stat.InBytes != 4 || stat.OutBytes != 5 {
+		t.Errorf("ioSwitch() in [%d] out [%d], want in [4] out [5]", stat.InBytes, stat.OutBytes)
+	}
+}
+
+func TestIoSwitchNoHalfClose(t *testing.T) {
+	// net.Pipe doesn't support half close, fall back to full close
+	visitor, pConn := net.Pipe()
+	tConn, target := net.Pipe()
+	defer visitor.Close()
+
+	statCh := make(chan SpliceStat)
+	go func() {
+		statCh <- ioSwitch(context.Background(), logger.Default(), pConn, tConn, 0)
+	}()
+
+	go visitor.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(target, buf); err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+
+	stat := <-statCh
+	if stat.InBytes != 4 {
+		t.Errorf("ioSwitch() in [%d], want [4]", stat.InBytes)
+	}
+}
+
+// wsPair return both ends of a loopback websocket connection
+func wsPair(t *testing.T) (net.Conn, net.Conn) {
+	ep, _ := transport.Parse("ws://127.0.0.1:0/narwhal")
+	ln, err := ep.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	acceptCh := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptCh <- conn
+	}()
+
+	ep.URL.Host = ln.Addr().String()
+	cConn, err := ep.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sConn := <-acceptCh
+	if sConn == nil {
+		t.Fatal("accept connection failed")
+	}
+	return cConn, sConn
+}
+
+func TestIoSwitchIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		pair func(t *testing.T) (net.Conn, net.Conn)
+	}{
+		{name: "tcp", pair: func(t *testing.T) (net.Conn, net.Conn) { return tcpPair(t) }},
+		{name: "websocket", pair: wsPair},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visitor, pConn := tt.pair(t)
+			tConn, target := tt.pair(t)
+			defer visitor.Close()
+			defer target.Close()
+
+			statCh := make(chan SpliceStat)
+			go func() {
+				statCh <- ioSwitch(context.Background(), logger.Default(), pConn, tConn, 200*time.Millisecond)
+			}()
+
+			// Traffic in one direction keep the whole switch alive, reads of
+			// the other direction time out meanwhile
+			for i := 0; i < 3; i++ {
+				time.Sleep(100 * time.Millisecond)
+				if _, err := visitor.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case stat := <-statCh:
+				if !errors.Is(stat.Err, ErrIdleTimeout) {
+					t.Errorf("ioSwitch() error = %v, want %v", stat.Err, ErrIdleTimeout)
+				}
+				if stat.InBytes != 3 {
+					t.Errorf("ioSwitch() in [%d], want [3]", stat.InBytes)
+				}
+			case <-time.After(2 * time.Second):
+				t.Error("ioSwitch() not timeout")
+			}
+		})
+	}
+}
+
+func TestSConn_Terminate(t *testing.T) {
+	control, peer := tcpPair(t)
+	visitor, pConn := tcpPair(t)
+	tConn, target := tcpPair(t)
+	defer peer.Close()
+	defer visitor.Close()
+	defer target.Close()
+
+	c := NewServerConnection(control).(*SConn)
+	done := make(chan struct{})
+	go func() {
+		c.proxy(context.Background(), pConn, tConn, logger.Fields{})
+		close(done)
+	}()
+
+	c.Terminate()
+	// Terminate twice is fine
+	c.Terminate()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream not cut by Terminate")
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Error("control connection not closed by Terminate")
+	}
+}
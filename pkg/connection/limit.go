@@ -0,0 +1,96 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits of visitor connections of a tunnel, 0 means no limit
+//
+// MaxStreams: concurrent visitor connections
+// Rate: new visitor connections per second, bursts up to rate
+type Limits struct {
+	MaxStreams int
+	Rate       float64
+}
+
+// AdmitFunc decide whether visitor vConn of tunnel arrs is allowed, the
+// visitor is refused when error returned
+type AdmitFunc func(ctx context.Context, arrs Arrs, vConn net.Conn) error
+
+// Errors of visitors refused
+var (
+	ErrTooManyStreams = errors.New("too many streams")
+	ErrRateLimited    = errors.New("rate limited")
+)
+
+// limiter enforce limits of visitor connections
+type limiter struct {
+	mu         sync.Mutex
+	maxStreams int64
+	rate       *rate.Limiter // Nil means no limit
+	active     int64         // Visitor connections proxying
+}
+
+// Admit check visitor connections with f before notifying client
+func Admit(f AdmitFunc) SOption {
+	return func(c *SConn) {
+		c.admit = f
+	}
+}
+
+// SetLimits limit visitor connections of tunnel, it applies to visitors
+// arrive later
+func (c *SConn) SetLimits(l Limits) {
+	c.limiter.mu.Lock()
+	defer c.limiter.mu.Unlock()
+
+	c.arrs.Limits = l
+	c.limiter.maxStreams = int64(l.MaxStreams)
+	c.limiter.rate = nil
+	if l.Rate > 0 {
+		burst := int(l.Rate)
+		if burst < 1 {
+			burst = 1
+		}
+		c.limiter.rate = rate.NewLimiter(rate.Limit(l.Rate), burst)
+	}
+}
+
+// acquire take a stream slot, release must be called when stream finished
+func (l *limiter) acquire() error {
+	l.mu.Lock()
+	maxStreams, r := l.maxStreams, l.rate
+	l.mu.Unlock()
+
+	if r != nil && !r.Allow() {
+		return ErrRateLimited
+	}
+	if n := atomic.AddInt64(&l.active, 1); maxStreams > 0 && n > maxStreams {
+		atomic.AddInt64(&l.active, -1)
+		return ErrTooManyStreams
+	}
+	return nil
+}
+
+func (l *limiter) release() {
+	atomic.AddInt64(&l.active, -1)
+}
+
+// admitVisitor check vConn with admit func and limits
+func (c *SConn) admitVisitor(ctx context.Context, vConn net.Conn) (string, error) {
+	if c.admit != nil {
+		if err := c.admit(ctx, c.arrs, vConn); err != nil {
+			return ReasonRejected, err
+		}
+	}
+	if err := c.limiter.acquire(); err != nil {
+		return ReasonLimited, err
+	}
+	return "", nil
+}
@@ -0,0 +1,88 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	c := NewServerConnection(nil).(*SConn)
+	c.SetLimits(Limits{MaxStreams: 2})
+	if err := c.limiter.acquire(); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := c.limiter.acquire(); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := c.limiter.acquire(); !errors.Is(err, ErrTooManyStreams) {
+		t.Errorf("acquire() over max streams error = %v, want %v", err, ErrTooManyStreams)
+	}
+	c.limiter.release()
+	if err := c.limiter.acquire(); err != nil {
+		t.Errorf("acquire() after release error = %v", err)
+	}
+
+	c.SetLimits(Limits{Rate: 1})
+	if err := c.limiter.acquire(); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := c.limiter.acquire(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("acquire() over rate error = %v, want %v", err, ErrRateLimited)
+	}
+}
+
+type recorder struct {
+	recs []AccessRecord
+}
+
+func (r *recorder) Record(rec AccessRecord) {
+	r.recs = append(r.recs, rec)
+}
+
+func TestSConn_NewVisitorRefused(t *testing.T) {
+	refused := errors.New("refused")
+	tests := []struct {
+		name       string
+		admit      AdmitFunc
+		limits     Limits
+		wantReason string
+	}{
+		{
+			name: "rejected by admit",
+			admit: func(ctx context.Context, arrs Arrs, vConn net.Conn) error {
+				return refused
+			},
+			wantReason: ReasonRejected,
+		},
+		{
+			name:       "limited",
+			limits:     Limits{Rate: 0.001},
+			wantReason: ReasonLimited,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cConn, sConn := net.Pipe()
+			defer cConn.Close()
+			rec := new(recorder)
+			c := NewServerConnection(sConn, Admit(tt.admit), AccessLog(rec))
+			c.SetLimits(tt.limits)
+			// Take the only token
+			c.(*SConn).limiter.acquire()
+			c.(*SConn).limiter.release()
+
+			vConn, peer := net.Pipe()
+			defer peer.Close()
+			c.NewVisitor(context.Background(), vConn)
+
+			if len(rec.recs) != 1 || rec.recs[0].Reason != tt.wantReason {
+				t.Errorf("records %+v, want reason %s", rec.recs, tt.wantReason)
+			}
+			if _, err := peer.Read(make([]byte, 1)); err == nil {
+				t.Error("refused visitor not closed")
+			}
+		})
+	}
+}
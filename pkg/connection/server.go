@@ -1,21 +1,65 @@
 package connection
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
 	"github.com/lucheng0127/narwhal/internal/pkg/utils"
 	"github.com/lucheng0127/narwhal/pkg/protocol"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// DefaultPConnTimeout is how long a visitor wait for client proxy connection
+const DefaultPConnTimeout = 10 * time.Second
+
 type SConn struct {
-	arrs Arrs
+	arrs        Arrs
+	idleTimeout time.Duration
+	done        chan struct{} // Closed when control connection closed
+	terminated  chan struct{} // Closed by Terminate, streams are cut
+	termOnce    sync.Once
+	streams     uint64 // Counter of visitor streams, used as stream id
+	log         logger.Logger
+	access      AccessRecorder // Record visitor connections, nil to disable
+	admit       AdmitFunc      // Check visitors, nil to allow all
+	limiter     limiter
+}
+
+type SOption func(c *SConn)
+
+// IdleTimeout close proxy streams without traffic for d, 0 means never
+func IdleTimeout(d time.Duration) SOption {
+	return func(c *SConn) {
+		c.idleTimeout = d
+	}
+}
+
+// ServerLogger log through l instead of the default logger
+func ServerLogger(l logger.Logger) SOption {
+	return func(c *SConn) {
+		c.log = l
+	}
 }
 
-func NewServerConnection(conn net.Conn) Connection {
+func NewServerConnection(conn net.Conn, opts ...SOption) Connection {
 	c := new(SConn)
 	c.arrs.Conn = conn
+	c.arrs.ProxyConnCh = make(chan net.Conn)
+	c.done = make(chan struct{})
+	c.terminated = make(chan struct{})
+	c.log = logger.Default()
+	for _, o := range opts {
+		o(c)
+	}
 	return c
 }
 
@@ -31,21 +75,141 @@ func (c *SConn) SetUID(uid string) {
 	c.arrs.UID = uid
 }
 
+func (c *SConn) SetGrant(g *Grant) {
+	c.arrs.Grant = g
+}
+
+func (c *SConn) SetExpire(t time.Time) {
+	c.arrs.Expire = t
+}
+
+func (c *SConn) SetKeyExpire(t time.Time) {
+	c.arrs.KeyExpire = t
+}
+
+func (c *SConn) SetToVisitorConn() {
+	c.arrs.VisitorConn = true
+}
+
 func (c *SConn) NewPConn(conn net.Conn) {
-	c.arrs.ProxyConnCh <- conn
+	select {
+	case c.arrs.ProxyConnCh <- conn:
+	case <-time.After(DefaultPConnTimeout):
+		// No visitor waiting for it, maybe timeout already
+		conn.Close()
+	case <-c.done:
+		conn.Close()
+	}
+}
+
+// NewVisitor notify client and proxy vConn with the proxy connection
+// established by client, the stream is traced by a child of ctx, whose
+// trace id is sent to client with notify, it blocks until vConn closed
+func (c *SConn) NewVisitor(ctx context.Context, vConn net.Conn) {
+	streamID := atomic.AddUint64(&c.streams, 1)
+	rec := AccessRecord{
+		SessionID: utils.GetTraceID(ctx),
+		StreamID:  streamID,
+		Start:     time.Now(),
+	}
+	ctx = utils.NewChildTraceContext(ctx, strconv.FormatUint(streamID, 10))
+	ctx, span := telemetry.Start(ctx, "visitor",
+		telemetry.AttrUID.String(c.arrs.UID),
+		telemetry.AttrBindPort.Int(c.arrs.BindPort),
+		telemetry.AttrStreamID.Int64(int64(streamID)),
+		telemetry.AttrRemoteAddr.String(vConn.RemoteAddr().String()),
+	)
+	defer span.End()
+	fields := logger.Fields{
+		logger.FieldUID:        c.arrs.UID,
+		logger.FieldBindPort:   c.arrs.BindPort,
+		logger.FieldStreamID:   streamID,
+		logger.FieldRemoteAddr: vConn.RemoteAddr().String(),
+	}
+	if reason, err := c.admitVisitor(ctx, vConn); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		c.log.Warn(ctx, "visitor refused", fields, logger.Fields{logger.FieldError: err})
+		vConn.Close()
+		rec.Reason, rec.Err = reason, err
+		c.record(rec, vConn, SpliceStat{})
+		return
+	}
+	defer c.limiter.release()
+
+	// Notify span lasts until proxy connection established by client
+	_, nSpan := telemetry.Start(ctx, "notify")
+	err := c.notify(ctx)
+	if err != nil {
+		telemetry.End(nSpan, err)
+		c.log.Error(ctx, "send notify", fields, logger.Fields{logger.FieldError: err})
+		vConn.Close()
+		rec.Reason, rec.Err = ReasonNotifyFailed, err
+		c.record(rec, vConn, SpliceStat{})
+		return
+	}
+
+	select {
+	case tConn := <-c.arrs.ProxyConnCh:
+		nSpan.End()
+		stat := c.proxy(ctx, vConn, tConn, fields)
+		c.record(rec, vConn, stat)
+	case <-time.After(DefaultPConnTimeout):
+		telemetry.End(nSpan, errors.New(ReasonNoProxyConn))
+		c.log.Warn(ctx, "wait proxy connection timeout, drop visitor", fields)
+		vConn.Close()
+		rec.Reason = ReasonNoProxyConn
+		c.record(rec, vConn, SpliceStat{})
+	case <-c.done:
+		telemetry.End(nSpan, errors.New(ReasonClientGone))
+		vConn.Close()
+		rec.Reason = ReasonClientGone
+		c.record(rec, vConn, SpliceStat{})
+	}
+}
+
+// Monitor block until control connection closed, client sends nothing
+// after negotiation finished
+func (c *SConn) Monitor() error {
+	defer close(c.done)
+	_, err := io.Copy(io.Discard, c.arrs.Conn)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Forward proxy traffic between client and tConn until any side closed
+func (c *SConn) Forward(ctx context.Context, tConn net.Conn) {
+	c.proxy(ctx, c.arrs.Conn, tConn, logger.Fields{
+		logger.FieldUID:        c.arrs.UID,
+		logger.FieldRemoteAddr: c.arrs.Conn.RemoteAddr().String(),
+		logger.FieldTarget:     tConn.RemoteAddr().String(),
+	})
 }
 
 func (c *SConn) Close() {
 	c.arrs.Conn.Close()
 }
 
+// Terminate close control connection and cut streams in progress, unlike
+// Close streams don't outlive it
+func (c *SConn) Terminate() {
+	c.termOnce.Do(func() {
+		close(c.terminated)
+	})
+	c.arrs.Conn.Close()
+}
+
 func (c *SConn) GetArrs() Arrs {
 	return c.arrs
 }
 
-func (c *SConn) notify() error {
-	// Notify client new connection establish with authCtx through c.Conn
-	pkt := protocol.NewPkt(protocol.RepNotify, []byte(c.arrs.AuthCtx))
+// notify send authCtx and trace id of ctx to client, client establish a
+// new proxy connection with authCtx and logs with the same trace id
+func (c *SConn) notify(ctx context.Context) error {
+	payload := protocol.EncodeFields(c.arrs.AuthCtx, utils.GetTraceID(ctx))
+	pkt := protocol.NewPkt(protocol.RepNotify, payload)
 	pktData, err := pkt.Encode()
 	if err != nil {
 		return err
@@ -55,33 +219,77 @@ func (c *SConn) notify() error {
 	if err != nil {
 		return err
 	}
-	ctx := utils.NewTraceContext()
-	logger.Debug(ctx, fmt.Sprintf("send [%d] bytes notify data to connection [%s]", n, c.arrs.Conn.RemoteAddr().String()))
+	c.log.Debug(ctx, "sent notify", logger.Fields{
+		logger.FieldBytes:      n,
+		logger.FieldUID:        c.arrs.UID,
+		logger.FieldRemoteAddr: c.arrs.Conn.RemoteAddr().String(),
+	})
 	return nil
 }
 
-func (c *SConn) BindAndProxy(bPort int) error {
-	ctx := utils.NewTraceContext()
+func (c *SConn) BindAndProxy(ctx context.Context, bPort int) error {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", bPort))
 	if err != nil {
 		return err
 	}
 	c.arrs.ln = ln
+	c.arrs.BindPort = bPort
 
-	for {
-		conn, err := ln.Accept()
+	// Stop listening when client gone
+	go func() {
+		err := c.Monitor()
 		if err != nil {
-			logger.Error(ctx, fmt.Sprintf("connection establish with port [%d] %s", bPort, err.Error()))
+			c.log.Debug(ctx, "connection closed", logger.Fields{
+				logger.FieldUID:        c.arrs.UID,
+				logger.FieldRemoteAddr: c.arrs.Conn.RemoteAddr().String(),
+				logger.FieldError:      err,
+			})
 		}
+		ln.Close()
+	}()
 
-		err = c.notify()
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			logger.Error(ctx, fmt.Sprintf("send notify to connection [%s] %s", c.arrs.Conn.RemoteAddr().String(), err.Error()))
-			conn.Close()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			c.log.Error(ctx, "accept visitor", logger.Fields{
+				logger.FieldBindPort: bPort,
+				logger.FieldError:    err,
+			})
 			continue
 		}
 
-		tConn := <-c.arrs.ProxyConnCh
-		go ioSwitch(conn, tConn)
+		go c.NewVisitor(ctx, conn)
+	}
+}
+
+// proxy splice pConn and tConn, log and return stats of the stream
+func (c *SConn) proxy(ctx context.Context, pConn, tConn net.Conn, fields logger.Fields) SpliceStat {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-c.terminated:
+			pConn.Close()
+			tConn.Close()
+		case <-finished:
+		}
+	}()
+	stat := ioSwitch(ctx, c.log, pConn, tConn, c.idleTimeout)
+	close(finished)
+	statFields := logger.Fields{
+		logger.FieldBytesIn:  stat.InBytes,
+		logger.FieldBytesOut: stat.OutBytes,
+	}
+	if errors.Is(stat.Err, ErrIdleTimeout) {
+		c.log.Warn(ctx, "proxy idle timeout", fields, statFields)
+		return stat
+	}
+	if stat.Err != nil {
+		c.log.Warn(ctx, "proxy failed", fields, statFields, logger.Fields{logger.FieldError: stat.Err})
+		return stat
 	}
+	c.log.Debug(ctx, "proxy finished", fields, statFields)
+	return stat
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -38,6 +39,7 @@ func TestNewServerConnection(t *testing.T) {
 					AuthCtx:   mockAuthCtx,
 					ProxyConn: true,
 				},
+				log: logger.Default(),
 			},
 		},
 	}
@@ -48,6 +50,9 @@ func TestNewServerConnection(t *testing.T) {
 			got.SetAuthCtx(mockAuthCtx)
 			got.SetUID(mockUid)
 			got.SetToProxyConn()
+			tt.want.(*SConn).arrs.ProxyConnCh = got.GetArrs().ProxyConnCh
+			tt.want.(*SConn).done = got.(*SConn).done
+			tt.want.(*SConn).terminated = got.(*SConn).terminated
 		}
 
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,102 @@
+// Package logging let applications embedding narwhal route its logs into
+// their own logger
+//
+//	s := proxy.NewProxyServer(
+//		proxy.ListenPort(8888),
+//		proxy.ServerLogger(logging.NewSlog(slog.Default())),
+//	)
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+)
+
+// Fields is key/value pairs attached to a log entry
+type Fields = logger.Fields
+
+// Logger is implemented by loggers narwhal instances log through, every
+// entry comes with ctx of the session, whose trace id can be get with
+// TraceID
+type Logger = logger.Logger
+
+// Default return the logger narwhal used when no logger specified, it's
+// shared by all instances
+func Default() Logger {
+	return logger.Default()
+}
+
+// TraceID return trace id of ctx passed to Logger
+func TraceID(ctx context.Context) string {
+	return logger.GetTraceID(ctx)
+}
+
+type discard struct{}
+
+func (discard) Error(ctx context.Context, msg string, fields ...Fields) {}
+func (discard) Warn(ctx context.Context, msg string, fields ...Fields)  {}
+func (discard) Info(ctx context.Context, msg string, fields ...Fields)  {}
+func (discard) Debug(ctx context.Context, msg string, fields ...Fields) {}
+
+// Discard return a Logger drop all entries
+func Discard() Logger {
+	return discard{}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog return a Logger log through l, fields are converted into attrs
+// with trace id as trace_id
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) log(ctx context.Context, level slog.Level, msg string, fields []Fields) {
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+
+	keys := make([]string, 0)
+	values := make(map[string]interface{})
+	for _, f := range fields {
+		for k, v := range f {
+			if _, ok := values[k]; !ok {
+				keys = append(keys, k)
+			}
+			values[k] = v
+		}
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys)+1)
+	attrs = append(attrs, slog.String(logger.FieldTraceID, logger.GetTraceID(ctx)))
+	for _, k := range keys {
+		v := values[k]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		attrs = append(attrs, slog.Any(k, v))
+	}
+	s.l.LogAttrs(ctx, level, msg, attrs...)
+}
+
+func (s *slogLogger) Error(ctx context.Context, msg string, fields ...Fields) {
+	s.log(ctx, slog.LevelError, msg, fields)
+}
+
+func (s *slogLogger) Warn(ctx context.Context, msg string, fields ...Fields) {
+	s.log(ctx, slog.LevelWarn, msg, fields)
+}
+
+func (s *slogLogger) Info(ctx context.Context, msg string, fields ...Fields) {
+	s.log(ctx, slog.LevelInfo, msg, fields)
+}
+
+func (s *slogLogger) Debug(ctx context.Context, msg string, fields ...Fields) {
+	s.log(ctx, slog.LevelDebug, msg, fields)
+}
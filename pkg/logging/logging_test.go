@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewSlog(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	ctx := context.WithValue(context.Background(), logger.MSG_ID, "trace-1")
+
+	l.Debug(ctx, "dropped by level")
+	if buf.Len() != 0 {
+		t.Fatalf("debug entry logged with info level: %s", buf.String())
+	}
+
+	l.Warn(ctx, "proxy failed", Fields{
+		logger.FieldUID:      "user",
+		logger.FieldBindPort: 8080,
+		logger.FieldError:    errors.New("broken pipe"),
+	})
+	got := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshal log entry %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":                "proxy failed",
+		"level":              "WARN",
+		logger.FieldTraceID:  "trace-1",
+		logger.FieldUID:      "user",
+		logger.FieldBindPort: float64(8080),
+		logger.FieldError:    "broken pipe",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("field %s = %v, want %v", k, got[k], v)
+		}
+	}
+}
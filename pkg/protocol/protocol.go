@@ -6,39 +6,55 @@ import (
 	"fmt"
 	"io"
 	"net"
-
-	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
-	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"strings"
 )
 
 const (
 	// Request code
-	ReqNone   byte = byte(0x00)
-	ReqAuth   byte = byte(0x01)
-	ReqBind   byte = byte(0x01 << 1)
-	ReqPConn  byte = byte(0x01 << 2) // Client establish a new connection with server send RepPConn to server with connection.AuthCtx
-	ReqNotify byte = byte(0x01 << 3) // A new connection establish to server binding port, server send RepNotify to client with connection.AuthCtx
+	ReqNone    byte = byte(0x00)
+	ReqAuth    byte = byte(0x01)
+	ReqBind    byte = byte(0x01 << 1)
+	ReqPConn   byte = byte(0x01 << 2) // Client establish a new connection with server send RepPConn to server with connection.AuthCtx
+	ReqNotify  byte = byte(0x01 << 3) // A new connection establish to server binding port, server send RepNotify to client with connection.AuthCtx
+	ReqSecret  byte = byte(0x01 << 4) // Authenticated client register a secret service with name and key instead of binding port
+	ReqVisit   byte = byte(0x01 << 5) // Visitor connect to a secret service with name and key
+	ReqForward byte = byte(0x01 << 6) // Authenticated client ask server to dial target host:port and proxy to it
 
 	// Reply code
-	RepNone   byte = byte(0x80)
-	RepAuth   byte = byte(0x01)
-	RepBind   byte = byte((0x01 << 1) | 0x80)
-	RepPConn  byte = byte((0x01 << 2) | 0x80)
-	RepNotify byte = byte((0x01 << 3) | 0x80)
+	RepNone    byte = byte(0x80)
+	RepAuth    byte = byte(0x01)
+	RepBind    byte = byte((0x01 << 1) | 0x80)
+	RepPConn   byte = byte((0x01 << 2) | 0x80)
+	RepNotify  byte = byte((0x01 << 3) | 0x80)
+	RepSecret  byte = byte((0x01 << 4) | 0x80)
+	RepVisit   byte = byte((0x01 << 5) | 0x80)
+	RepForward byte = byte((0x01 << 6) | 0x80)
+
+	// Public key auth, all single bits are taken by codes above
+	ReqKeyAuth byte = byte(0x01 | 0x01<<1)        // Client send uid and ssh public key, server reply a challenge
+	ReqKeySign byte = byte(0x01 | 0x01<<2)        // Client send signature of KeyAuthData, server reply result
+	RepKeyAuth byte = byte(0x01 | 0x01<<1 | 0x80) // Payload is result code followed by challenge
+	RepKeySign byte = byte(0x01 | 0x01<<2 | 0x80)
+
+	// Server closing a session, payload is result code of the reason
+	RepEvict byte = byte(0x01<<1 | 0x01<<2 | 0x80)
 
 	// Result code
-	RetSucceed byte = byte(0xf0)
-	RetFailed  byte = byte(0xf1)
+	RetSucceed       byte = byte(0xf0)
+	RetFailed        byte = byte(0xf1)
+	RetSessionExists byte = byte(0xf2) // Refused, uid has a session alive
+	RetReplaced      byte = byte(0xf3) // Succeed, previous session of uid is closed
 )
 
 // PKG is used to implement package for negotiation
 //
-// +-----+----+-------+
-// |PCode|PLen|Payload|
-// +-----+----+-------+
+// +-----+----+--------+-------+
+// |PCode|PLen|ExtPLen |Payload|
+// +-----+----+--------+-------+
 //
 // PCode: request/reply method code
-// PLen: length of payload
+// PLen: length of payload, PLenExt means payload is longer than 254 bytes
+// ExtPLen: uint16 length of payload, only present when PLen is PLenExt
 // Payload: payload of data
 type PKG interface {
 	Encode() ([]byte, error)
@@ -50,8 +66,34 @@ type PKG interface {
 type PL interface {
 	String() string
 	Int() int
+	Byte() byte
+	Fields() []string
+}
+
+// KeyAuthData return data signed by client with its private key, challenge
+// is bound to uid and narwhal so signature can't be replayed elsewhere
+func KeyAuthData(uid string, challenge []byte) []byte {
+	data := EncodeFields("narwhal-key-auth", uid)
+	data = append(data, FieldSep)
+	return append(data, challenge...)
 }
 
+// FieldSep separate fields of payload, e.g. name and key of secret service
+const FieldSep byte = byte(0x00)
+
+// EncodeFields join fields into payload
+func EncodeFields(fields ...string) []byte {
+	return []byte(strings.Join(fields, string(FieldSep)))
+}
+
+// PLenExt in PLen means the length of payload follows as uint16, payloads
+// of 255 bytes or longer, e.g. auth tokens, are not understood by peers
+// before it
+const PLenExt uint8 = 0xff
+
+// MaxPayloadLen is the max length of payload
+const MaxPayloadLen = 0xffff
+
 type PHeader struct {
 	PCode byte
 	Plen  uint8
@@ -75,6 +117,21 @@ func (pp *PPayload) Int() int {
 	return int(binary.BigEndian.Uint16(pp.Data))
 }
 
+// Byte return the first byte of payload, used by result code
+func (pp *PPayload) Byte() byte {
+	if len(pp.Data) == 0 {
+		return RetFailed
+	}
+	return pp.Data[0]
+}
+
+func (pp *PPayload) Fields() []string {
+	if len(pp.Data) == 0 {
+		return make([]string, 0)
+	}
+	return strings.Split(string(pp.Data), string(FieldSep))
+}
+
 type Package struct {
 	Header  *PHeader
 	Payload *PPayload
@@ -85,7 +142,11 @@ func NewPkt(code byte, payload []byte) PKG {
 	pkt.Header = new(PHeader)
 	pkt.Payload = new(PPayload)
 	pkt.Header.PCode = code
-	pkt.Header.Plen = uint8(len(payload))
+	if len(payload) < int(PLenExt) {
+		pkt.Header.Plen = uint8(len(payload))
+	} else {
+		pkt.Header.Plen = PLenExt
+	}
 	pkt.Payload.Data = payload
 	return pkt
 }
@@ -108,7 +169,16 @@ func ReadFromConn(conn net.Conn) (PKG, error) {
 		return nil, err
 	}
 
-	buf := make([]byte, int(pkt.Header.Plen))
+	pLen := int(pkt.Header.Plen)
+	if pkt.Header.Plen == PLenExt {
+		var extLen uint16
+		if err := binary.Read(conn, binary.BigEndian, &extLen); err != nil {
+			return nil, err
+		}
+		pLen = int(extLen)
+	}
+
+	buf := make([]byte, pLen)
 	_, err = io.ReadFull(conn, buf)
 	if err != nil {
 		return nil, err
@@ -123,23 +193,23 @@ func (p *Package) SendToConn(conn net.Conn) error {
 		return err
 	}
 
-	n, err := conn.Write(pktBytes)
-	if err != nil {
-		return err
-	}
-
-	ctx := utils.NewTraceContext()
-	logger.Debug(ctx, fmt.Sprintf("sent [%d] bytes to connection %s", n, conn.RemoteAddr().String()))
-	return nil
+	_, err = conn.Write(pktBytes)
+	return err
 }
 
 func (p *Package) Encode() ([]byte, error) {
 	var headBuf bytes.Buffer
 
+	if len(p.Payload.Data) > MaxPayloadLen {
+		return nil, fmt.Errorf("payload length %d exceeds %d", len(p.Payload.Data), MaxPayloadLen)
+	}
 	err := binary.Write(&headBuf, binary.BigEndian, p.Header)
 	if err != nil {
 		return make([]byte, 0), nil
 	}
+	if p.Header.Plen == PLenExt {
+		binary.Write(&headBuf, binary.BigEndian, uint16(len(p.Payload.Data)))
+	}
 
 	return append(headBuf.Bytes(), p.Payload.Data...), nil
 }
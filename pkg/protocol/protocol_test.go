@@ -27,35 +27,54 @@ func TestSendAndReadPkt(t *testing.T) {
 				payload: []byte(uid),
 			},
 		},
+		{
+			name: "empty payload",
+			args: args{code: ReqNone, payload: []byte{}},
+		},
+		{
+			name: "longest short payload",
+			args: args{code: ReqAuth, payload: bytes.Repeat([]byte("a"), 254)},
+		},
+		{
+			name: "extended length",
+			args: args{code: ReqAuth, payload: bytes.Repeat([]byte("a"), 255)},
+		},
+		{
+			name: "max payload",
+			args: args{code: ReqAuth, payload: bytes.Repeat([]byte("a"), MaxPayloadLen)},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			pkt := NewPkt(tt.args.code, tt.args.payload)
 
-			go func(pkt PKG) {
-				ln, _ := net.Listen("tcp", "127.0.0.1:8881")
-				for {
-					conn, _ := ln.Accept()
-					pkt.SendToConn(conn)
-				}
-			}(pkt)
-			time.Sleep(100 * time.Microsecond)
-			conn, _ := net.Dial("tcp", "127.0.0.1:8881")
+			sConn, cConn := net.Pipe()
+			defer sConn.Close()
+			defer cConn.Close()
+			go pkt.SendToConn(sConn)
+			cConn.SetDeadline(time.Now().Add(time.Second))
 
-			rPkt, err := ReadFromConn(conn)
+			rPkt, err := ReadFromConn(cConn)
 			if err != nil {
-				t.Error("read from connection error")
+				t.Fatalf("read from connection error %v", err)
 			}
-			if rPkt.GetPCode() != RepAuth {
+			if rPkt.GetPCode() != tt.args.code {
 				t.Error("pcode not match")
 			}
-			if rPkt.GetPayload().String() != uid {
+			if rPkt.GetPayload().String() != string(tt.args.payload) {
 				t.Error("payload not match")
 			}
 		})
 	}
 }
 
+func TestPackage_EncodeTooLong(t *testing.T) {
+	pkt := NewPkt(ReqAuth, make([]byte, MaxPayloadLen+1))
+	if _, err := pkt.Encode(); err == nil {
+		t.Error("Encode() payload longer than MaxPayloadLen succeed")
+	}
+}
+
 func TestPPayload_Int(t *testing.T) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, uint16(22))
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// DefaultAccessLogMaxSize is the size in megabytes access log rotated at
+const DefaultAccessLogMaxSize = 100
+
+// AccessLogPolicy decide where access log written and how it rotated
+//
+// File: path of access log, access log disabled when empty
+// MaxSize: megabytes of file before it get rotated
+// MaxBackups: rotated files retained, 0 means retain all
+// MaxAge: days to retain rotated files, 0 means never remove for age
+// Compress: gzip rotated files
+type AccessLogPolicy struct {
+	File       string
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+	Compress   bool
+}
+
+// accessEntry is one line of access log
+type accessEntry struct {
+	Visitor   string    `json:"visitor"`
+	BindPort  int       `json:"bind_port"`
+	UID       string    `json:"uid"`
+	SessionID string    `json:"session_id"`
+	StreamID  uint64    `json:"stream_id"`
+	Start     time.Time `json:"start"`
+	Duration  float64   `json:"duration"` // Seconds
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Reason    string    `json:"reason"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// accessLog write visitor connections as json lines
+type accessLog struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	log logger.Logger
+}
+
+func newAccessLog(policy AccessLogPolicy) *accessLog {
+	if policy.MaxSize == 0 {
+		policy.MaxSize = DefaultAccessLogMaxSize
+	}
+
+	return &accessLog{
+		w: &lumberjack.Logger{
+			Filename:   policy.File,
+			MaxSize:    policy.MaxSize,
+			MaxBackups: policy.MaxBackups,
+			MaxAge:     policy.MaxAge,
+			Compress:   policy.Compress,
+		},
+		log: logger.Default(),
+	}
+}
+
+// Record implement connection.AccessRecorder
+func (a *accessLog) Record(rec connection.AccessRecord) {
+	entry := accessEntry{
+		Visitor:   rec.Visitor,
+		BindPort:  rec.BindPort,
+		UID:       rec.UID,
+		SessionID: rec.SessionID,
+		StreamID:  rec.StreamID,
+		Start:     rec.Start,
+		Duration:  rec.Duration.Seconds(),
+		BytesIn:   rec.BytesIn,
+		BytesOut:  rec.BytesOut,
+		Reason:    rec.Reason,
+	}
+	if rec.Err != nil {
+		entry.Error = rec.Err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(line); err != nil {
+		ctx := utils.NewTraceContext()
+		a.log.Error(ctx, "write access log", logger.Fields{logger.FieldError: err})
+	}
+}
+
+func (a *accessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeyPortsOption is the option of authorized key line setting ports can be
+// bound with the key, e.g. ports="22,8000-8100" ssh-ed25519 AAAA...
+const KeyPortsOption = "ports"
+
+// KeyExpiryOption is the option of OpenSSH setting when the key expires,
+// YYYYMMDD[HHMM[SS]] of local time, or UTC with suffix Z
+const KeyExpiryOption = "expiry-time"
+
+// AuthorizedKey is a public key of user can authenticate with
+//
+// Ports: port spec of ports option, user store decides when not HasPorts
+// ExpiresAt: time of expiry-time option, zero for never
+type AuthorizedKey struct {
+	Key       ssh.PublicKey
+	Ports     string
+	HasPorts  bool
+	ExpiresAt time.Time
+}
+
+// parseKeyExpiry parse value of expiry-time option
+func parseKeyExpiry(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalidate %s [%s], YYYYMMDD[HHMM[SS]] expected", KeyExpiryOption, value)
+}
+
+// AuthorizedKeys look up ssh public keys of users, keys of a user are in
+// the authorized_keys style file named uid in dir, files are read on each
+// lookup so changes take effect without reload. Options other than ports
+// and expiry-time are ignored
+type AuthorizedKeys struct {
+	dir string
+}
+
+// NewAuthorizedKeys return authorized keys of dir
+func NewAuthorizedKeys(dir string) (*AuthorizedKeys, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("authorized keys %s not a directory", dir)
+	}
+	return &AuthorizedKeys{dir: dir}, nil
+}
+
+// Lookup return authorized key of uid matching key, nil when not found
+func (a *AuthorizedKeys) Lookup(uid string, key ssh.PublicKey) (*AuthorizedKey, error) {
+	if !validUidFile(uid) {
+		return nil, nil
+	}
+	path := filepath.Join(a.dir, uid)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	want := key.Marshal()
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		aKey, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d of %s %s", i+1, path, err.Error())
+		}
+		if !bytes.Equal(aKey.Marshal(), want) {
+			continue
+		}
+
+		ak := &AuthorizedKey{Key: aKey}
+		for _, opt := range options {
+			name, value, ok := strings.Cut(opt, "=")
+			if !ok {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			switch name {
+			case KeyPortsOption:
+				ak.Ports, ak.HasPorts = value, true
+				err = ValidatePortSpec(ak.Ports)
+			case KeyExpiryOption:
+				ak.ExpiresAt, err = parseKeyExpiry(value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d of %s %s", i+1, path, err.Error())
+			}
+		}
+		return ak, nil
+	}
+	return nil, nil
+}
+
+// ReadIdentityFile return signer of ssh private key file, key protected by
+// passphrase is used through ssh-agent of SSH_AUTH_SOCK, which must hold it
+func ReadIdentityFile(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+	var pErr *ssh.PassphraseMissingError
+	if !errors.As(err, &pErr) || pErr.PublicKey == nil {
+		return nil, fmt.Errorf("parse identity file %s %s", path, err.Error())
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil, fmt.Errorf("identity file %s protected by passphrase, and SSH_AUTH_SOCK not set", path)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connect to ssh-agent %s", err.Error())
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("list keys of ssh-agent %s", err.Error())
+	}
+	want := pErr.PublicKey.Marshal()
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), want) {
+			return s, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("key of identity file %s not added to ssh-agent", path)
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/connection"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newSigner(t *testing.T, rsaKey bool) ssh.Signer {
+	var key interface{}
+	if rsaKey {
+		key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, key, _ = ed25519.GenerateKey(rand.Reader)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedLine(options string, signer ssh.Signer) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if len(options) != 0 {
+		line = options + " " + line
+	}
+	return line + " alice@laptop\n"
+}
+
+func TestAuthorizedKeys_Lookup(t *testing.T) {
+	edSigner := newSigner(t, false)
+	rsaSigner := newSigner(t, true)
+	otherSigner := newSigner(t, false)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "alice"), []byte("# keys of alice\n\n"+
+		authorizedLine(`no-pty,ports="22,8000-8100"`, edSigner)+
+		authorizedLine("", rsaSigner)), 0600)
+	os.WriteFile(filepath.Join(dir, "bob"), []byte(authorizedLine(`ports="22-"`, edSigner)), 0600)
+	os.WriteFile(filepath.Join(dir, "dave"), []byte(authorizedLine(`expiry-time="20240601180000Z"`, edSigner)+
+		authorizedLine(`expiry-time="tomorrow"`, rsaSigner)), 0600)
+	keys, err := NewAuthorizedKeys(dir)
+	if err != nil {
+		t.Fatalf("NewAuthorizedKeys() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		uid        string
+		key        ssh.PublicKey
+		wantFound  bool
+		wantPorts  string
+		wantExpire time.Time
+		wantErr    bool
+	}{
+		{name: "key with ports", uid: "alice", key: edSigner.PublicKey(), wantFound: true, wantPorts: "22,8000-8100"},
+		{name: "key with expiry", uid: "dave", key: edSigner.PublicKey(), wantFound: true, wantExpire: time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC)},
+		{name: "malformed expiry", uid: "dave", key: rsaSigner.PublicKey(), wantErr: true},
+		{name: "key without ports", uid: "alice", key: rsaSigner.PublicKey(), wantFound: true},
+		{name: "key not authorized", uid: "alice", key: otherSigner.PublicKey()},
+		{name: "unknown user", uid: "carol", key: edSigner.PublicKey()},
+		{name: "uid escaping dir", uid: "../" + filepath.Base(dir) + "/alice", key: edSigner.PublicKey()},
+		{name: "malformed ports", uid: "bob", key: edSigner.PublicKey(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ak, err := keys.Lookup(tt.uid, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (ak != nil) != tt.wantFound {
+				t.Fatalf("Lookup() = %+v, want found %v", ak, tt.wantFound)
+			}
+			if ak != nil && (ak.Ports != tt.wantPorts || ak.HasPorts != (len(tt.wantPorts) != 0)) {
+				t.Errorf("Lookup() ports %s, want %s", ak.Ports, tt.wantPorts)
+			}
+			if ak != nil && !ak.ExpiresAt.Equal(tt.wantExpire) {
+				t.Errorf("Lookup() expires at %s, want %s", ak.ExpiresAt, tt.wantExpire)
+			}
+		})
+	}
+
+	if _, err := NewAuthorizedKeys(filepath.Join(dir, "alice")); err == nil {
+		t.Error("NewAuthorizedKeys() of file succeed")
+	}
+}
+
+func TestProxyServer_keyAuth(t *testing.T) {
+	edSigner := newSigner(t, false)
+	rsaSigner := newSigner(t, true)
+	otherSigner := newSigner(t, false)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "alice"), []byte(authorizedLine(`ports="8000-8100"`, edSigner)+
+		authorizedLine("", rsaSigner)), 0600)
+	os.WriteFile(filepath.Join(dir, "bob"), []byte(authorizedLine(`expiry-time="20240601"`, edSigner)), 0600)
+	keys, _ := NewAuthorizedKeys(dir)
+
+	tests := []struct {
+		name      string
+		keys      *AuthorizedKeys
+		uid       string
+		signer    ssh.Signer
+		wantErr   bool
+		wantGrant bool
+	}{
+		{name: "ed25519 key with ports", keys: keys, uid: "alice", signer: edSigner, wantGrant: true},
+		{name: "rsa key by user store", keys: keys, uid: "alice", signer: rsaSigner},
+		{name: "key not authorized", keys: keys, uid: "alice", signer: otherSigner, wantErr: true},
+		{name: "key of other user", keys: keys, uid: "bob", signer: rsaSigner, wantErr: true},
+		{name: "key expired", keys: keys, uid: "bob", signer: edSigner, wantErr: true},
+		{name: "key auth disabled", uid: "alice", signer: edSigner, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewProxyServer(Users(map[string]string{"alice": "22"}), KeyAuth(tt.keys), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+			sConn, cConn := net.Pipe()
+			defer cConn.Close()
+			conn := connection.NewServerConnection(sConn)
+			client := connection.NewClient(cConn, connection.AuthKey(tt.signer))
+			errCh := make(chan error, 1)
+			go func() { errCh <- client.Auth(tt.uid) }()
+
+			_, err := s.auth(context.Background(), conn)
+			s.replyRefusal(conn, err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProxyServer.auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cErr := <-errCh; (cErr != nil) != tt.wantErr {
+				t.Fatalf("Client.Auth() error = %v, wantErr %v", cErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if uid := conn.GetArrs().UID; uid != tt.uid {
+				t.Errorf("uid of connection %s, want %s", uid, tt.uid)
+			}
+			// Ports option of key takes precedence over user store
+			ctx := context.Background()
+			if tt.wantGrant && (!s.permitPort(ctx, conn, 8080) || s.permitPort(ctx, conn, 22)) {
+				t.Error("permitPort() not match ports option of key")
+			}
+			if !tt.wantGrant && (s.permitPort(ctx, conn, 8080) || !s.permitPort(ctx, conn, 22)) {
+				t.Error("permitPort() not match ports of user store")
+			}
+		})
+	}
+}
+
+func TestReadIdentityFile(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	dir := t.TempDir()
+
+	block, _ := ssh.MarshalPrivateKey(key, "")
+	plain := filepath.Join(dir, "id_ed25519")
+	os.WriteFile(plain, pem.EncodeToMemory(block), 0600)
+	block, _ = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	protected := filepath.Join(dir, "id_protected")
+	os.WriteFile(protected, pem.EncodeToMemory(block), 0600)
+	pub, _ := ssh.NewPublicKey(key.Public())
+
+	signer, err := ReadIdentityFile(plain)
+	if err != nil || string(signer.PublicKey().Marshal()) != string(pub.Marshal()) {
+		t.Fatalf("ReadIdentityFile() = %v, error %v", signer, err)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := ReadIdentityFile(protected); err == nil {
+		t.Error("ReadIdentityFile() protected key without ssh-agent succeed")
+	}
+
+	// Serve an ssh-agent holding the key
+	sock := filepath.Join(dir, "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	keyring := agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	if _, err := ReadIdentityFile(protected); err == nil {
+		t.Error("ReadIdentityFile() key not added to ssh-agent succeed")
+	}
+	keyring.Add(agent.AddedKey{PrivateKey: key})
+	signer, err = ReadIdentityFile(protected)
+	if err != nil || string(signer.PublicKey().Marshal()) != string(pub.Marshal()) {
+		t.Errorf("ReadIdentityFile() through ssh-agent = %v, error %v", signer, err)
+	}
+}
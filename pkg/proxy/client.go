@@ -1,62 +1,178 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 
 	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
 	"github.com/lucheng0127/narwhal/internal/pkg/utils"
 	"github.com/lucheng0127/narwhal/pkg/connection"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+	"golang.org/x/crypto/ssh"
 )
 
 type ClientServer struct {
-	host   string
-	rPort  uint16
-	lPort  uint16
-	uid    string
-	client connection.Client
+	host    string
+	remote  *transport.Endpoint // Server, tcp address of host by default
+	rPort   uint16
+	lPort   uint16
+	uid     string
+	token   string     // Sent with uid on auth
+	signer  ssh.Signer // Sign challenge of server on auth, instead of token
+	service string     // Secret service name
+	key     string     // Secret service key
+	visitor bool       // Visit secret service instead of serving local port
+	target  string     // Forward local port to target dialed by server
+	mu      sync.Mutex // Protect client and localLn
+	client  connection.Client
+	localLn net.Listener // Listener of local port in visitor and forward mode
+	log     logger.Logger
 }
 
 func NewClientServer(opts ...COption) Server {
 	s := new(ClientServer)
-
 	for _, o := range opts {
 		o(s)
 	}
-
+	if s.log == nil {
+		s.log = logger.Default()
+	}
+	if s.remote == nil {
+		s.remote = transport.TCP(s.host)
+	}
 	return s
 }
 
 func (c *ClientServer) Launch() error {
+	if c.visitor {
+		return c.serveLocal("secret service "+c.service, c.visit)
+	}
+	if len(c.target) != 0 {
+		return c.serveLocal("forward target "+c.target, c.forward)
+	}
+
 	// Connect to host
 	ctx := utils.NewTraceContext()
-	conn, err := net.Dial("tcp", c.host)
+	conn, err := c.remote.Dial(ctx)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("connection to server [%s] %s", c.host, err.Error()))
+		c.log.Error(ctx, "connect to server", logger.Fields{logger.FieldRemoteAddr: c.remote.String(), logger.FieldError: err})
 		return err
 	}
-	c.client = connection.NewClient(conn)
+	client := c.newClient(conn)
+	c.mu.Lock()
+	c.client = client
+	c.mu.Unlock()
 
 	// Auth
-	err = c.client.Auth(c.uid)
+	err = client.Auth(c.uid)
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("auth %s", err.Error()))
+		c.log.Error(ctx, "auth", logger.Fields{logger.FieldUID: c.uid, logger.FieldError: err})
 		return err
 	}
 
-	// Bind port
-	err = c.client.Bind(c.rPort)
+	if len(c.service) != 0 {
+		// Register secret service
+		err = client.Register(c.service, c.key)
+		if err != nil {
+			c.log.Error(ctx, "register", logger.Fields{logger.FieldService: c.service, logger.FieldError: err})
+			return err
+		}
+	} else {
+		// Bind port
+		err = client.Bind(c.rPort)
+		if err != nil {
+			c.log.Error(ctx, "bind", logger.Fields{logger.FieldBindPort: c.rPort, logger.FieldError: err})
+			return err
+		}
+	}
+
+	// Monitor and proxy
+	err = client.MonitorAndProxy(c.lPort)
+	if errors.Is(err, connection.ErrSessionReplaced) {
+		c.log.Warn(ctx, "session replaced by another client of uid", logger.Fields{logger.FieldUID: c.uid})
+	}
+	return err
+}
+
+// serveLocal listen local port, handle each connection of it with a new
+// connection to server
+func (c *ClientServer) serveLocal(desc string, handle func(client connection.Client, lConn net.Conn) error) error {
+	ctx := utils.NewTraceContext()
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", c.lPort))
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("bind %s", err.Error()))
+		c.log.Error(ctx, "listen local port", logger.Fields{logger.FieldLocalPort: c.lPort, logger.FieldError: err})
 		return err
 	}
+	c.mu.Lock()
+	c.localLn = ln
+	c.mu.Unlock()
+	c.log.Info(ctx, "proxy local port to "+desc, logger.Fields{logger.FieldLocalPort: c.lPort})
 
-	// Monitor and proxy
-	return c.client.MonitorAndProxy(c.lPort)
+	for {
+		lConn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			c.log.Error(ctx, "accept local port", logger.Fields{logger.FieldLocalPort: c.lPort, logger.FieldError: err})
+			continue
+		}
+
+		go func(lConn net.Conn) {
+			ctx := utils.NewTraceContext()
+			conn, err := c.remote.Dial(ctx)
+			if err != nil {
+				c.log.Error(ctx, "connect to server", logger.Fields{logger.FieldRemoteAddr: c.remote.String(), logger.FieldError: err})
+				lConn.Close()
+				return
+			}
+
+			err = handle(c.newClient(conn), lConn)
+			if err != nil {
+				c.log.Error(ctx, "proxy local connection", logger.Fields{
+					logger.FieldLocalAddr: lConn.RemoteAddr().String(),
+					logger.FieldError:     err,
+				})
+			}
+		}(lConn)
+	}
+}
+
+func (c *ClientServer) newClient(conn net.Conn) connection.Client {
+	opts := []connection.COption{connection.ClientLogger(c.log), connection.AuthToken(c.token), connection.Remote(c.remote)}
+	if c.signer != nil {
+		opts = append(opts, connection.AuthKey(c.signer))
+	}
+	return connection.NewClient(conn, opts...)
+}
+
+// visit proxy vConn to secret service
+func (c *ClientServer) visit(client connection.Client, vConn net.Conn) error {
+	return client.Visit(c.service, c.key, vConn)
+}
+
+// forward proxy lConn to target dialed by server
+func (c *ClientServer) forward(client connection.Client, lConn net.Conn) error {
+	err := client.Auth(c.uid)
+	if err != nil {
+		lConn.Close()
+		client.Close()
+		return err
+	}
+	return client.Forward(c.target, lConn)
 }
 
 func (c *ClientServer) Stop() {
 	ctx := utils.NewTraceContext()
-	logger.Info(ctx, "stop client server ...")
-	c.client.Close()
+	c.log.Info(ctx, "stop client server ...")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localLn != nil {
+		c.localLn.Close()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
 }
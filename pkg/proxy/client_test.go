@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+)
+
+// launchTestServer serve a ProxyServer on a random loopback port
+func launchTestServer(t *testing.T, opts ...Option) *ProxyServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewProxyServer(opts...).(*ProxyServer)
+	s.ln = ln
+	go s.serve()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// launchEchoServer serve a tcp echo service, return its port
+func launchEchoServer(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// freePort return a loopback port not listened
+func freePort(t *testing.T) uint16 {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// waitFor poll cond until it's true or timeout
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("wait for condition timeout")
+}
+
+// waitListen wait until port listened
+func waitListen(t *testing.T, port uint16) {
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+// echo send msg through port and return what read back
+func echo(port uint16, msg string) (string, error) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	rep, err := io.ReadAll(conn)
+	return string(rep), err
+}
+
+func TestClientServer_bindPort(t *testing.T) {
+	monkey.UnpatchAll()
+
+	s := launchTestServer(t, Users(map[string]string{"user": "0"}))
+	rPort := freePort(t)
+	c := NewClientServer(
+		Host(s.ln.Addr().String()),
+		Uid("user"),
+		RemotePort(rPort),
+		LocalPort(launchEchoServer(t)),
+	)
+	go c.Launch()
+	t.Cleanup(c.Stop)
+
+	var got string
+	waitFor(t, func() bool {
+		got, _ = echo(rPort, "ping")
+		return got == "ping"
+	})
+}
+
+func TestClientServer_secretService(t *testing.T) {
+	monkey.UnpatchAll()
+
+	s := launchTestServer(t, Users(map[string]string{"user": "0"}), Guard(GuardPolicy{BaseDelay: -1}))
+	host := s.ln.Addr().String()
+
+	owner := NewClientServer(
+		Host(host),
+		Uid("user"),
+		LocalPort(launchEchoServer(t)),
+		SecretService("db", "secret"),
+	)
+	go owner.Launch()
+	t.Cleanup(owner.Stop)
+	waitFor(t, func() bool {
+		return len(s.getSecretService("db", "secret")) != 0
+	})
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{
+			name: "visit ok",
+			key:  "secret",
+		},
+		{
+			name:    "visit with wrong key",
+			key:     "guess",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vPort := freePort(t)
+			visitor := NewClientServer(
+				Host(host),
+				LocalPort(vPort),
+				SecretService("db", tt.key),
+				Visitor(true),
+			)
+			go visitor.Launch()
+			defer visitor.Stop()
+			waitListen(t, vPort)
+
+			got, err := echo(vPort, "ping")
+			if tt.wantErr {
+				if got == "ping" {
+					t.Errorf("visit secret service with wrong key got %q", got)
+				}
+				return
+			}
+			if err != nil || got != "ping" {
+				t.Errorf("visit secret service got %q error %v, want %q", got, err, "ping")
+			}
+		})
+	}
+}
+
+func TestClientServer_forward(t *testing.T) {
+	monkey.UnpatchAll()
+
+	target := fmt.Sprintf("127.0.0.1:%d", launchEchoServer(t))
+	s := launchTestServer(
+		t,
+		Users(map[string]string{"user": "0"}),
+		Forwards(map[string][]string{"user": {target}}),
+		Guard(GuardPolicy{BaseDelay: -1}),
+	)
+
+	tests := []struct {
+		name    string
+		target  string
+		wantErr bool
+	}{
+		{
+			name:   "forward ok",
+			target: target,
+		},
+		{
+			name:    "forward not permitted",
+			target:  s.ln.Addr().String(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lPort := freePort(t)
+			c := NewClientServer(
+				Host(s.ln.Addr().String()),
+				Uid("user"),
+				LocalPort(lPort),
+				Target(tt.target),
+			)
+			go c.Launch()
+			defer c.Stop()
+
+			waitListen(t, lPort)
+
+			got, err := echo(lPort, "ping")
+			if tt.wantErr {
+				if got == "ping" {
+					t.Errorf("forward to not permitted target got %q", got)
+				}
+				return
+			}
+			if err != nil || got != "ping" {
+				t.Errorf("forward got %q error %v, want %q", got, err, "ping")
+			}
+		})
+	}
+}
+
+func TestClientServer_accessLog(t *testing.T) {
+	monkey.UnpatchAll()
+
+	file := filepath.Join(t.TempDir(), "access.log")
+	s := launchTestServer(t, Users(map[string]string{"user": "0"}), AccessLog(AccessLogPolicy{File: file}))
+	rPort := freePort(t)
+	c := NewClientServer(
+		Host(s.ln.Addr().String()),
+		Uid("user"),
+		RemotePort(rPort),
+		LocalPort(launchEchoServer(t)),
+	)
+	go c.Launch()
+	t.Cleanup(c.Stop)
+
+	waitListen(t, rPort)
+	if got, err := echo(rPort, "ping"); err != nil || got != "ping" {
+		t.Fatalf("echo got %q error %v, want %q", got, err, "ping")
+	}
+
+	// The probe of waitListen is logged too, find the line of echo
+	var entry accessEntry
+	waitFor(t, func() bool {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if json.Unmarshal([]byte(line), &entry) == nil && entry.BytesIn == 4 {
+				return true
+			}
+		}
+		return false
+	})
+
+	if entry.UID != "user" || entry.BindPort != int(rPort) || entry.BytesOut != 4 ||
+		entry.Reason != connection.ReasonEOF || len(entry.SessionID) == 0 {
+		t.Errorf("access log entry %+v not match", entry)
+	}
+}
+
+// writeSelfSigned write certificate of 127.0.0.1 and its key into dir
+func writeSelfSigned(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "narwhal"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestClientServer_transport(t *testing.T) {
+	monkey.UnpatchAll()
+
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir)
+	serverTLS, err := transport.ServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := transport.ClientTLSConfig(certFile, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		listen    string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+	}{
+		{name: "tls", listen: "tls://127.0.0.1:0", serverTLS: serverTLS, clientTLS: clientTLS},
+		{name: "unix", listen: "unix://" + filepath.Join(dir, "narwhal.sock")},
+		{name: "websocket", listen: "ws://127.0.0.1:0/narwhal"},
+		{name: "quic", listen: "quic://127.0.0.1:0", serverTLS: serverTLS, clientTLS: clientTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, _ := transport.Parse(tt.listen)
+			ep.TLS = tt.serverTLS
+			ln, err := ep.Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewProxyServer(Listen(ep), Users(map[string]string{"user": "0"})).(*ProxyServer)
+			s.ln = ln
+			go s.serve()
+			defer s.Stop()
+
+			u := *ep.URL
+			if len(u.Host) != 0 {
+				u.Host = ln.Addr().String()
+			}
+			remote := &transport.Endpoint{URL: &u, TLS: tt.clientTLS}
+			rPort := freePort(t)
+			c := NewClientServer(
+				Remote(remote),
+				Uid("user"),
+				RemotePort(rPort),
+				LocalPort(launchEchoServer(t)),
+			)
+			go c.Launch()
+			defer c.Stop()
+
+			// Proxy connections of visitors are dialed through the transport too
+			var got string
+			waitFor(t, func() bool {
+				got, _ = echo(rPort, "ping")
+				return got == "ping"
+			})
+		})
+	}
+}
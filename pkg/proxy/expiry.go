@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+)
+
+// sessionExpiry disconnect an authenticated connection when its credential
+// expires. Connections of user store users are checked again when users
+// reloaded, removed or invalid users are disconnected at once, and the
+// expiry of the user reloaded takes effect, bounded by expiry of the ssh key
+// authenticated with
+type sessionExpiry struct {
+	ctx    context.Context
+	uid    string
+	remote string
+	conn   connection.Connection
+	store  bool      // Permissions of conn come from user store
+	key    time.Time // Expiry of ssh key authenticated with, zero for none
+	log    logger.Logger
+	mu     sync.Mutex // Protect expire and timer
+	expire time.Time  // Zero for never
+	timer  *time.Timer
+}
+
+// arm disconnect conn at expire, zero expire never
+func (e *sessionExpiry) arm(expire time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.expire = expire
+	if expire.IsZero() {
+		return
+	}
+	e.timer = time.AfterFunc(time.Until(expire), func() {
+		e.disconnect("credential expired, disconnect", nil)
+	})
+}
+
+// rearm arm with expire of user reloaded, key expiry is kept when it's
+// earlier
+func (e *sessionExpiry) rearm(expire time.Time) {
+	if !e.key.IsZero() && (expire.IsZero() || e.key.Before(expire)) {
+		expire = e.key
+	}
+	e.mu.Lock()
+	current := e.expire
+	e.mu.Unlock()
+	if expire.Equal(current) {
+		return
+	}
+	e.arm(expire)
+}
+
+func (e *sessionExpiry) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+}
+
+func (e *sessionExpiry) disconnect(msg string, err error) {
+	fields := logger.Fields{logger.FieldUID: e.uid, logger.FieldRemoteAddr: e.remote}
+	if err != nil {
+		fields[logger.FieldError] = err
+	}
+	e.log.Info(e.ctx, msg, fields)
+	e.conn.Terminate()
+}
+
+// watchExpiry disconnect conn of authCtx when it expires, until
+// delAuthedConn
+func (s *ProxyServer) watchExpiry(ctx context.Context, authCtx string, conn connection.Connection) {
+	cArrs := conn.GetArrs()
+	e := &sessionExpiry{
+		ctx:    ctx,
+		uid:    cArrs.UID,
+		remote: cArrs.Conn.RemoteAddr().String(),
+		conn:   conn,
+		store:  cArrs.Grant == nil && s.webhook == nil,
+		key:    cArrs.KeyExpire,
+		log:    s.log,
+	}
+	e.arm(cArrs.Expire)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiries == nil {
+		s.expiries = make(map[string]*sessionExpiry)
+	}
+	s.expiries[authCtx] = e
+}
+
+// recheckSessions look up users of connections authorized by user store,
+// connections of users removed or out of validity are disconnected, and
+// validity of the others is re-armed, extended or shortened
+func (s *ProxyServer) recheckSessions() {
+	s.mu.RLock()
+	var es []*sessionExpiry
+	for _, e := range s.expiries {
+		if e.store {
+			es = append(es, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for _, e := range es {
+		user, err := s.store.Lookup(e.uid)
+		if err != nil {
+			// Keep the session, the store may be back soon
+			s.log.Error(e.ctx, "look up user", logger.Fields{logger.FieldUID: e.uid, logger.FieldError: err})
+			continue
+		}
+		if user == nil {
+			e.disconnect("user removed, disconnect", nil)
+			continue
+		}
+		if err := user.check(now); err != nil {
+			e.disconnect("user out of validity, disconnect", err)
+			continue
+		}
+		e.rearm(user.ExpiresAt)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/connection"
+	"github.com/lucheng0127/narwhal/pkg/protocol"
+)
+
+// DefaultDialTimeout is the timeout of server dialing forward target
+const DefaultDialTimeout = 10 * time.Second
+
+// Target can be forwarded by user
+// user.Targets, list of host:ports:
+//
+//	10.0.0.5:5432 - only 10.0.0.5 port 5432
+//	db.internal:5432,3306 - host db.internal port 5432 and 3306
+//	10.1.0.0/16:22 - port 22 of ip in 10.1.0.0/16
+//	*:8000-8100 - port from 8000 to 8100 of any host
+//	10.0.0.5:0 - all ports of 10.0.0.5
+//
+// Ports has the same format as user.Ports, hostname only matches the
+// same hostname, cidr only matches ip address, no name resolving
+func (s *ProxyServer) availabledTarget(uid, target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return false
+	}
+
+	s.usersMu.RLock()
+	rules := s.forwards[uid]
+	s.usersMu.RUnlock()
+
+	for _, rule := range rules {
+		idx := strings.LastIndex(rule, ":")
+		if idx == -1 {
+			continue
+		}
+
+		if matchHost(rule[:idx], host) && portInSpec(rule[idx+1:], port) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ipNet.Contains(ip)
+	}
+
+	pattern = strings.Trim(pattern, "[]")
+	if pIP := net.ParseIP(pattern); pIP != nil {
+		return pIP.Equal(net.ParseIP(host))
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// forward dial target requested by client, return connection to target
+func (s *ProxyServer) forward(conn connection.Connection, pkt protocol.PKG) (net.Conn, error) {
+	cArrs := conn.GetArrs()
+	rPayload := make([]byte, 1)
+	target := pkt.GetPayload().String()
+	if !s.availabledTarget(cArrs.UID, target) {
+		rPayload[0] = protocol.RetFailed
+		rPkt := protocol.NewPkt(protocol.RepForward, rPayload)
+		rPkt.SendToConn(cArrs.Conn)
+		return nil, fmt.Errorf("not permitted forward target [%s]", target)
+	}
+
+	tConn, err := net.DialTimeout("tcp", target, DefaultDialTimeout)
+	if err != nil {
+		rPayload[0] = protocol.RetFailed
+		rPkt := protocol.NewPkt(protocol.RepForward, rPayload)
+		rPkt.SendToConn(cArrs.Conn)
+		return nil, fmt.Errorf("dial forward target [%s] %s", target, err.Error())
+	}
+
+	// Dialing may take most of bind phase
+	cArrs.Conn.SetWriteDeadline(deadline(s.bindTimeout))
+	rPayload[0] = protocol.RetSucceed
+	rPkt := protocol.NewPkt(protocol.RepForward, rPayload)
+	if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+		tConn.Close()
+		return nil, fmt.Errorf("reply forward %w", phaseErr(phaseBind, err))
+	}
+	return tConn, nil
+}
+
+// ValidateForwardRule check the format of forward rule, see
+// availabledTarget for the format
+func ValidateForwardRule(rule string) error {
+	idx := strings.LastIndex(rule, ":")
+	if idx <= 0 {
+		return fmt.Errorf("invalidate forward rule [%s], host:ports expected", rule)
+	}
+
+	host := rule[:idx]
+	if strings.Contains(host, "/") {
+		if _, _, err := net.ParseCIDR(host); err != nil {
+			return fmt.Errorf("invalidate forward rule [%s] %s", rule, err.Error())
+		}
+	}
+	return ValidatePortSpec(rule[idx+1:])
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import "testing"
+
+func TestProxyServer_availabledTarget(t *testing.T) {
+	forwards := map[string][]string{
+		"user": {
+			"10.0.0.5:5432",
+			"db.internal:5432,3306",
+			"10.1.0.0/16:22",
+			"*:8000-8100",
+			"[fd00::1]:0",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		uid    string
+		target string
+		want   bool
+	}{
+		{name: "ip port ok", uid: "user", target: "10.0.0.5:5432", want: true},
+		{name: "ip port not ok", uid: "user", target: "10.0.0.5:22", want: false},
+		{name: "hostname multi port ok", uid: "user", target: "DB.internal:3306", want: true},
+		{name: "hostname not ok", uid: "user", target: "db.external:3306", want: false},
+		{name: "cidr ok", uid: "user", target: "10.1.2.3:22", want: true},
+		{name: "cidr not ok", uid: "user", target: "10.2.2.3:22", want: false},
+		{name: "cidr not match hostname", uid: "user", target: "host.10.1.2.3:22", want: false},
+		{name: "any host port range ok", uid: "user", target: "example.com:8080", want: true},
+		{name: "ipv6 all ports ok", uid: "user", target: "[fd00::1]:443", want: true},
+		{name: "user not exist", uid: "user1", target: "10.0.0.5:5432", want: false},
+		{name: "error format target", uid: "user", target: "10.0.0.5", want: false},
+		{name: "error format port", uid: "user", target: "10.0.0.5:xx", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ProxyServer{forwards: forwards}
+			if got := s.availabledTarget(tt.uid, tt.target); got != tt.want {
+				t.Errorf("ProxyServer.availabledTarget() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateForwardRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr bool
+	}{
+		{rule: "10.0.0.5:5432"},
+		{rule: "db.internal:5432,3306"},
+		{rule: "10.1.0.0/16:22"},
+		{rule: "*:8000-8100"},
+		{rule: "[::1]:0"},
+		{rule: "10.0.0.5", wantErr: true},
+		{rule: ":22", wantErr: true},
+		{rule: "10.1.0.0/33:22", wantErr: true},
+		{rule: "10.0.0.5:8100-8000", wantErr: true},
+		{rule: "10.0.0.5:22,abc", wantErr: true},
+		{rule: "10.0.0.5:70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			if err := ValidateForwardRule(tt.rule); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateForwardRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
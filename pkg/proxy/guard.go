@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/utils"
+)
+
+// GuardPolicy decide how auth failures are punished
+//
+// MaxFailures: failures of an ip within Window before it get banned,
+// negative means never ban
+// Window: failures older than Window are forgotten
+// BanDuration: how long a banned ip is refused
+// BaseDelay: delay of auth failure reply, doubled for each following
+// failure of the same ip or uid, negative means no delay
+// MaxDelay: upper limit of the reply delay
+//
+// Zero fields are replaced by DefaultGuardPolicy
+type GuardPolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	BanDuration time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultGuardPolicy = GuardPolicy{
+	MaxFailures: 5,
+	Window:      10 * time.Minute,
+	BanDuration: 30 * time.Minute,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// Ban is an ip refused by server until Until
+type Ban struct {
+	IP    string
+	Until time.Time
+}
+
+type failures struct {
+	count int
+	last  time.Time
+}
+
+// authGuard track auth failures by source ip and claimed uid
+type authGuard struct {
+	mu     sync.Mutex
+	policy GuardPolicy
+	ips    map[string]*failures
+	uids   map[string]*failures
+	bans   map[string]time.Time
+	lastGC time.Time
+	log    logger.Logger
+}
+
+func newAuthGuard(policy GuardPolicy) *authGuard {
+	if policy.MaxFailures == 0 {
+		policy.MaxFailures = DefaultGuardPolicy.MaxFailures
+	}
+	if policy.Window == 0 {
+		policy.Window = DefaultGuardPolicy.Window
+	}
+	if policy.BanDuration == 0 {
+		policy.BanDuration = DefaultGuardPolicy.BanDuration
+	}
+	if policy.BaseDelay == 0 {
+		policy.BaseDelay = DefaultGuardPolicy.BaseDelay
+	}
+	if policy.MaxDelay == 0 {
+		policy.MaxDelay = DefaultGuardPolicy.MaxDelay
+	}
+
+	return &authGuard{
+		policy: policy,
+		ips:    make(map[string]*failures),
+		uids:   make(map[string]*failures),
+		bans:   make(map[string]time.Time),
+		log:    logger.Default(),
+	}
+}
+
+// remoteIP return ip of conn remote address, empty when it's not an ip
+// like peers of unix socket, they all share the same address
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// record add a failure of key into m, return failures within window
+func (g *authGuard) record(m map[string]*failures, key string, now time.Time) int {
+	f, ok := m[key]
+	if !ok || now.Sub(f.last) > g.policy.Window {
+		f = new(failures)
+		m[key] = f
+	}
+	f.count++
+	f.last = now
+	return f.count
+}
+
+// gc drop failures out of window and expired bans
+func (g *authGuard) gc(now time.Time) {
+	if now.Sub(g.lastGC) < g.policy.Window {
+		return
+	}
+	g.lastGC = now
+
+	for _, m := range []map[string]*failures{g.ips, g.uids} {
+		for k, f := range m {
+			if now.Sub(f.last) > g.policy.Window {
+				delete(m, k)
+			}
+		}
+	}
+	for ip, until := range g.bans {
+		if now.After(until) {
+			g.unban(ip)
+		}
+	}
+}
+
+func (g *authGuard) unban(ip string) {
+	delete(g.bans, ip)
+	ctx := utils.NewTraceContext()
+	g.log.Info(ctx, "ban of ip expired", logger.Fields{logger.FieldIP: ip})
+}
+
+// banned check whether ip is refused now
+func (g *authGuard) banned(ip string) bool {
+	if len(ip) == 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	until, ok := g.bans[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		g.unban(ip)
+		return false
+	}
+	return true
+}
+
+// fail record an auth failure of ip claimed uid, return how long the reply
+// should be delayed, uid can be empty when no uid claimed. Failures without
+// ip are counted by uid only, and never banned
+func (g *authGuard) fail(ctx context.Context, ip, uid string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.gc(now)
+
+	count := 0
+	if len(ip) != 0 {
+		count = g.record(g.ips, ip, now)
+	}
+	if len(uid) != 0 {
+		if uCount := g.record(g.uids, uid, now); uCount > count {
+			count = uCount
+		}
+	}
+
+	if len(ip) != 0 && g.policy.MaxFailures > 0 && g.ips[ip].count >= g.policy.MaxFailures {
+		until := now.Add(g.policy.BanDuration)
+		g.bans[ip] = until
+		delete(g.ips, ip)
+		g.log.Warn(ctx, "ban ip after auth failures", logger.Fields{
+			logger.FieldIP: ip,
+			"until":        until.Format(time.RFC3339),
+			"failures":     count,
+		})
+	}
+
+	if g.policy.BaseDelay < 0 {
+		return 0
+	}
+	delay := g.policy.BaseDelay
+	for i := 1; i < count && delay < g.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.policy.MaxDelay {
+		delay = g.policy.MaxDelay
+	}
+	return delay
+}
+
+// succeed forget failures of ip and uid
+func (g *authGuard) succeed(ip, uid string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.ips, ip)
+	delete(g.uids, uid)
+}
+
+// list return bans not expired yet, sorted by ip
+func (g *authGuard) list() []Ban {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(g.bans))
+	for ip, until := range g.bans {
+		if now.After(until) {
+			continue
+		}
+		bans = append(bans, Ban{IP: ip, Until: until})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthGuard_fail(t *testing.T) {
+	policy := GuardPolicy{
+		MaxFailures: 3,
+		Window:      time.Minute,
+		BanDuration: time.Minute,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    300 * time.Millisecond,
+	}
+
+	type attempt struct {
+		ip     string
+		uid    string
+		delay  time.Duration
+		banned bool
+	}
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{
+			name: "progressive delay then ban",
+			attempts: []attempt{
+				{ip: "10.0.0.1", uid: "user", delay: 100 * time.Millisecond},
+				{ip: "10.0.0.1", uid: "user", delay: 200 * time.Millisecond},
+				{ip: "10.0.0.1", uid: "user", delay: 300 * time.Millisecond, banned: true},
+			},
+		},
+		{
+			name: "delay by uid across ips",
+			attempts: []attempt{
+				{ip: "10.0.0.1", uid: "user", delay: 100 * time.Millisecond},
+				{ip: "10.0.0.2", uid: "user", delay: 200 * time.Millisecond},
+				{ip: "10.0.0.3", uid: "user", delay: 300 * time.Millisecond},
+			},
+		},
+		{
+			name: "ban by ip across uids",
+			attempts: []attempt{
+				{ip: "10.0.0.1", uid: "user1", delay: 100 * time.Millisecond},
+				{ip: "10.0.0.1", uid: "user2", delay: 200 * time.Millisecond},
+				{ip: "10.0.0.1", uid: "", delay: 300 * time.Millisecond, banned: true},
+			},
+		},
+		{
+			name: "without ip by uid only",
+			attempts: []attempt{
+				{ip: "", uid: "user1", delay: 100 * time.Millisecond},
+				{ip: "", uid: "user1", delay: 200 * time.Millisecond},
+				{ip: "", uid: "user1", delay: 300 * time.Millisecond},
+				{ip: "", uid: "user2", delay: 100 * time.Millisecond},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newAuthGuard(policy)
+			for i, a := range tt.attempts {
+				if got := g.fail(context.Background(), a.ip, a.uid); got != a.delay {
+					t.Errorf("authGuard.fail() attempt %d delay = %v, want %v", i, got, a.delay)
+				}
+				if got := g.banned(a.ip); got != a.banned {
+					t.Errorf("authGuard.banned() attempt %d = %v, want %v", i, got, a.banned)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthGuard_banExpire(t *testing.T) {
+	g := newAuthGuard(GuardPolicy{
+		MaxFailures: 1,
+		BanDuration: 50 * time.Millisecond,
+		BaseDelay:   -1,
+	})
+
+	if delay := g.fail(context.Background(), "10.0.0.1", "user"); delay != 0 {
+		t.Errorf("authGuard.fail() delay = %v, want 0", delay)
+	}
+	if bans := g.list(); len(bans) != 1 || bans[0].IP != "10.0.0.1" {
+		t.Errorf("authGuard.list() = %v, want ban of 10.0.0.1", bans)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if g.banned("10.0.0.1") {
+		t.Error("authGuard.banned() = true after ban expired")
+	}
+	if bans := g.list(); len(bans) != 0 {
+		t.Errorf("authGuard.list() = %v, want empty", bans)
+	}
+}
+
+func TestAuthGuard_succeed(t *testing.T) {
+	g := newAuthGuard(GuardPolicy{MaxFailures: 2})
+
+	g.fail(context.Background(), "10.0.0.1", "user")
+	g.succeed("10.0.0.1", "user")
+	g.fail(context.Background(), "10.0.0.1", "user")
+	if g.banned("10.0.0.1") {
+		t.Error("authGuard.banned() = true, failures should be reset by success")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		want    string
+	}{
+		{name: "tcp", network: "tcp", addr: "127.0.0.1:0", want: "127.0.0.1"},
+		{name: "unix", network: "unix", addr: filepath.Join(t.TempDir(), "narwhal.sock")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen(tt.network, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			network, addr := tt.network, ln.Addr().String()
+			go func() {
+				if conn, err := net.Dial(network, addr); err == nil {
+					defer conn.Close()
+				}
+			}()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := remoteIP(conn); got != tt.want {
+				t.Errorf("remoteIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
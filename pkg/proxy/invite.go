@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InvitePrefix is the prefix of invite tokens, it tells them from JWTs
+const InvitePrefix = "nwi_"
+
+// inviteExt is extension of invite files
+const inviteExt = ".json"
+
+// Invite is a single-use credential, the first auth with its token consumes
+// it, and the session lasts until it expires
+//
+// Uid: uid of the session, client must send it or nothing
+// Ports: port spec the session can bind
+type Invite struct {
+	Uid       string    `json:"uid"`
+	Ports     string    `json:"ports"`
+	NotBefore time.Time `json:"notBefore"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (i *Invite) validity() Validity {
+	return Validity{NotBefore: i.NotBefore, ExpiresAt: i.ExpiresAt}
+}
+
+// Invites keep pending invites in dir, a json file for each named by the
+// sha256 of its token, so tokens can't be read from dir. Files are read on
+// each redeem, invites minted take effect without reload
+type Invites struct {
+	dir string
+}
+
+// NewInvites return invites of dir, dir is created if not exist
+func NewInvites(dir string) (*Invites, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create invite dir %s", err.Error())
+	}
+	return &Invites{dir: dir}, nil
+}
+
+// file return path of invite file of token
+func (i *Invites) file(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return filepath.Join(i.dir, hex.EncodeToString(sum[:])+inviteExt)
+}
+
+// Mint save invite and return its token, expires at is required. Expired
+// invites in dir are removed
+func (i *Invites) Mint(invite Invite) (string, error) {
+	if err := validateUser(User{Uid: invite.Uid, Ports: invite.Ports, Validity: invite.validity()}); err != nil {
+		return "", err
+	}
+	if invite.ExpiresAt.IsZero() {
+		return "", errors.New("expires at of invite not set")
+	}
+	i.prune(time.Now())
+
+	data, err := json.Marshal(&invite)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	token := InvitePrefix + base64.RawURLEncoding.EncodeToString(key)
+
+	tmp, err := os.CreateTemp(i.dir, ".invite.tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), i.file(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Redeem consume invite of token at now, nil without error when no such
+// invite. Invite not valid yet is kept, the one expired is removed. Only
+// one of concurrent redeems of a token gets it
+func (i *Invites) Redeem(token string, now time.Time) (*Invite, error) {
+	if !strings.HasPrefix(token, InvitePrefix) {
+		return nil, nil
+	}
+	path := i.file(token)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	invite := new(Invite)
+	if err := json.Unmarshal(data, invite); err != nil {
+		return nil, fmt.Errorf("parse invite file %s %s", path, err.Error())
+	}
+
+	vErr := invite.validity().check(now)
+	if errors.Is(vErr, ErrNotYetValid) {
+		return nil, vErr
+	}
+	// Removing is the consumption, the one failed lost the race
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vErr != nil {
+		return nil, vErr
+	}
+	return invite, nil
+}
+
+// prune remove invites expired at now
+func (i *Invites) prune(now time.Time) {
+	paths, _ := filepath.Glob(filepath.Join(i.dir, "*"+inviteExt))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		invite := new(Invite)
+		if json.Unmarshal(data, invite) != nil {
+			continue
+		}
+		if errors.Is(invite.validity().check(now), ErrExpired) {
+			os.Remove(path)
+		}
+	}
+}
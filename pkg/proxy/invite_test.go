@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/connection"
+)
+
+func TestInvites(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "invites")
+	invites, err := NewInvites(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if _, err := invites.Mint(Invite{Uid: "alice", Ports: "22"}); err == nil {
+		t.Error("Mint() without expires at should fail")
+	}
+	if _, err := invites.Mint(Invite{Uid: "alice", Ports: "22-abc", ExpiresAt: now.Add(time.Hour)}); err == nil {
+		t.Error("Mint() invalidate ports should fail")
+	}
+	valid, err := invites.Mint(Invite{Uid: "alice", Ports: "22", ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Mint() error = %v", err)
+	}
+	if !strings.HasPrefix(valid, InvitePrefix) {
+		t.Errorf("Mint() token %s without prefix %s", valid, InvitePrefix)
+	}
+	later, _ := invites.Mint(Invite{Uid: "bob", Ports: "0", NotBefore: now.Add(time.Hour), ExpiresAt: now.Add(2 * time.Hour)})
+	expired, _ := invites.Mint(Invite{Uid: "carol", Ports: "0", ExpiresAt: now.Add(time.Minute)})
+
+	tests := []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantUid string
+		wantErr error
+	}{
+		{name: "not valid yet", token: later, now: now, wantErr: ErrNotYetValid},
+		{name: "valid", token: valid, now: now, wantUid: "alice"},
+		{name: "used", token: valid, now: now},
+		{name: "kept until valid", token: later, now: now.Add(90 * time.Minute), wantUid: "bob"},
+		{name: "expired", token: expired, now: now.Add(2 * time.Minute), wantErr: ErrExpired},
+		{name: "expired removed", token: expired, now: now},
+		{name: "unknown", token: InvitePrefix + "unknown", now: now},
+		{name: "not invite", token: "eyJhbGciOi.e30.sig", now: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invite, err := invites.Redeem(tt.token, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Redeem() error = %v, want %v", err, tt.wantErr)
+			}
+			if (invite != nil) != (len(tt.wantUid) != 0) || (invite != nil && invite.Uid != tt.wantUid) {
+				t.Errorf("Redeem() = %+v, want uid %s", invite, tt.wantUid)
+			}
+		})
+	}
+
+	// Expired invites are pruned on mint
+	os.WriteFile(filepath.Join(dir, "stale"+inviteExt), []byte(`{"uid":"dave","ports":"0","expiresAt":"2024-06-01T18:00:00Z"}`), 0600)
+	token, _ := invites.Mint(Invite{Uid: "erin", Ports: "0", ExpiresAt: now.Add(time.Hour)})
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(invites.file(token)) {
+		t.Errorf("files of invites %v, want the one of erin", entries)
+	}
+}
+
+func TestInvites_redeemOnce(t *testing.T) {
+	invites, _ := NewInvites(t.TempDir())
+	token, err := invites.Mint(Invite{Uid: "alice", Ports: "22", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if invite, _ := invites.Redeem(token, time.Now()); invite != nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if redeemed != 1 {
+		t.Errorf("invite redeemed %d times, want 1", redeemed)
+	}
+}
+
+func TestProxyServer_authInvite(t *testing.T) {
+	invites, _ := NewInvites(t.TempDir())
+	expire := time.Now().Add(time.Hour)
+	mint := func() string {
+		token, err := invites.Mint(Invite{Uid: "contractor", Ports: "8000-8100", ExpiresAt: expire})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	used := mint()
+	invites.Redeem(used, time.Now())
+
+	tests := []struct {
+		name    string
+		invites *Invites
+		uid     string
+		token   string
+		wantErr bool
+	}{
+		{name: "uid from invite", invites: invites, token: mint()},
+		{name: "uid match invite", invites: invites, uid: "contractor", token: mint()},
+		{name: "uid not match invite", invites: invites, uid: "alice", token: mint(), wantErr: true},
+		{name: "invite used", invites: invites, token: used, wantErr: true},
+		{name: "invite auth disabled", token: mint(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewProxyServer(Users(map[string]string{"alice": "0"}), InviteAuth(tt.invites), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+			sConn, cConn := net.Pipe()
+			defer cConn.Close()
+			conn := connection.NewServerConnection(sConn)
+			client := connection.NewClient(cConn, connection.AuthToken(tt.token))
+			errCh := make(chan error, 1)
+			go func() { errCh <- client.Auth(tt.uid) }()
+
+			_, err := s.auth(context.Background(), conn)
+			s.replyRefusal(conn, err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProxyServer.auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cErr := <-errCh; (cErr != nil) != tt.wantErr {
+				t.Fatalf("Client.Auth() error = %v, wantErr %v", cErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			cArrs := conn.GetArrs()
+			if cArrs.UID != "contractor" || !cArrs.Expire.Equal(expire) {
+				t.Errorf("uid %s expire %s of connection, want contractor %s", cArrs.UID, cArrs.Expire, expire)
+			}
+			if !s.permitPort(context.Background(), conn, 8080) || s.permitPort(context.Background(), conn, 22) {
+				t.Error("permitPort() not match ports of invite")
+			}
+		})
+	}
+}
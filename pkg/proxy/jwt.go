@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTPolicy is how client tokens are verified, offline against keys of a
+// JWKS file or a PEM public key file. Uid is the sub claim, port spec the
+// ports claim, e.g. "22,8000-8100" or ["22", "8000-8100"]
+//
+// JWKS: path of JWKS file, keys are picked by kid of tokens
+// PublicKey: path of PEM public key or certificate, used when JWKS empty
+// Audience: required audience of tokens
+// Issuer: required issuer of tokens, any issuer when empty
+// Leeway: allowed clock skew checking exp, nbf and iat
+type JWTPolicy struct {
+	JWKS      string
+	PublicKey string
+	Audience  string
+	Issuer    string
+	Leeway    time.Duration
+}
+
+// JWTClaims is what a verified token grants
+type JWTClaims struct {
+	UID    string
+	Ports  string
+	Expire time.Time
+}
+
+// JWTVerifier verify tokens with keys of JWTPolicy, call Reload to pick up
+// rotated keys
+type JWTVerifier struct {
+	policy JWTPolicy
+	parser *jwt.Parser
+	mu     sync.RWMutex
+	keys   map[string]crypto.PublicKey // Keys of JWKS by kid, or the only key by ""
+}
+
+// NewJWTVerifier return verifier with keys of policy loaded
+func NewJWTVerifier(policy JWTPolicy) (*JWTVerifier, error) {
+	if len(policy.JWKS) == 0 && len(policy.PublicKey) == 0 {
+		return nil, errors.New("jwks or public key not set")
+	}
+	if len(policy.Audience) == 0 {
+		return nil, errors.New("audience not set")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithAudience(policy.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(policy.Leeway),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512", "EdDSA"}),
+	}
+	if len(policy.Issuer) != 0 {
+		opts = append(opts, jwt.WithIssuer(policy.Issuer))
+	}
+	v := &JWTVerifier{policy: policy, parser: jwt.NewParser(opts...)}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload read keys again, keys in use are kept when it fails
+func (v *JWTVerifier) Reload() error {
+	var keys map[string]crypto.PublicKey
+	var err error
+	if len(v.policy.JWKS) != 0 {
+		keys, err = readJWKS(v.policy.JWKS)
+	} else {
+		var key crypto.PublicKey
+		key, err = readPEMPublicKey(v.policy.PublicKey)
+		keys = map[string]crypto.PublicKey{"": key}
+	}
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	return nil
+}
+
+// key return key of token by kid, kid may be absent when only one key
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := v.keys[kid]
+	if !ok && len(kid) == 0 && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok && len(v.policy.JWKS) == 0 {
+		// Kid means nothing to a single PEM key
+		key, ok = v.keys[""]
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key of kid [%s]", kid)
+	}
+
+	// Algorithm must match type of key
+	var match bool
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, match = token.Method.(*jwt.SigningMethodRSA)
+		if !match {
+			_, match = token.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, match = token.Method.(*jwt.SigningMethodECDSA)
+	case ed25519.PublicKey:
+		_, match = token.Method.(*jwt.SigningMethodEd25519)
+	}
+	if !match {
+		return nil, fmt.Errorf("algorithm [%s] not match key of kid [%s]", token.Method.Alg(), kid)
+	}
+	return key, nil
+}
+
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Ports interface{} `json:"ports,omitempty"`
+}
+
+// Verify check signature, expiry, audience and issuer of token, and return
+// its claims
+func (v *JWTVerifier) Verify(token string) (*JWTClaims, error) {
+	claims := new(jwtClaims)
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, err
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("sub claim not set")
+	}
+	ports, err := portsClaim(claims.Ports)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTClaims{UID: claims.Subject, Ports: ports, Expire: claims.ExpiresAt.Time}, nil
+}
+
+// portsClaim return port spec of ports claim, a spec string, a port number
+// or a list of them, empty when absent means no port can be bound
+func portsClaim(claim interface{}) (string, error) {
+	var specs []string
+	switch c := claim.(type) {
+	case nil:
+		return "", nil
+	case string:
+		specs = append(specs, c)
+	case float64:
+		specs = append(specs, fmt.Sprintf("%d", int(c)))
+	case []interface{}:
+		for _, item := range c {
+			spec, err := portsClaim(item)
+			if err != nil {
+				return "", err
+			}
+			specs = append(specs, spec)
+		}
+	default:
+		return "", fmt.Errorf("ports claim of type %T", claim)
+	}
+
+	spec := strings.Join(specs, ",")
+	if len(spec) == 0 {
+		return "", nil
+	}
+	if err := ValidatePortSpec(spec); err != nil {
+		return "", fmt.Errorf("ports claim %s", err.Error())
+	}
+	return spec, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// readJWKS read signing keys of JWKS file by kid, RSA, EC and Ed25519 keys
+// are supported, keys of other types or uses are skipped
+func readJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks %s %s", path, err.Error())
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if len(k.Use) != 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key [%s] of jwks %s %s", k.Kid, path, err.Error())
+		}
+		if key == nil {
+			continue
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return nil, fmt.Errorf("duplicate kid [%s] of jwks %s", k.Kid, path)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing key in jwks %s", path)
+	}
+	return keys, nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey return key of jwk, nil for unsupported types
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n %s", err.Error())
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e %s", err.Error())
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("e too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve [%s]", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x %s", err.Error())
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y %s", err.Error())
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve [%s]", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x %s", err.Error())
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalidate ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+// readPEMPublicKey read the first public key or certificate of PEM file
+func readPEMPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no public key in %s", path)
+		}
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return cert.PublicKey, nil
+		}
+	}
+}
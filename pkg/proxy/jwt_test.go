@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// writeJWKS write keys by kid into a JWKS file of dir
+func writeJWKS(t *testing.T, path string, keys map[string]interface{}) {
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		var k map[string]string
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			k = map[string]string{"kty": "RSA", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+		case *ecdsa.PublicKey:
+			k = map[string]string{"kty": "EC", "crv": "P-256", "x": b64(pub.X.Bytes()), "y": b64(pub.Y.Bytes())}
+		case ed25519.PublicKey:
+			k = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(pub)}
+		}
+		k["kid"] = kid
+		k["use"] = "sig"
+		set.Keys = append(set.Keys, k)
+	}
+	// Keys of other uses are skipped
+	set.Keys = append(set.Keys, map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"})
+	data, _ := json.Marshal(set)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if len(kid) != 0 {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func claimsOf(sub string, ports interface{}, exp time.Duration) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"sub": sub,
+		"aud": "narwhal",
+		"iss": "ci",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(exp).Unix(),
+	}
+	if ports != nil {
+		c["ports"] = ports
+	}
+	return c
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "ed": edPub})
+	v, err := NewJWTVerifier(JWTPolicy{JWKS: jwks, Audience: "narwhal", Issuer: "ci"})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantUID   string
+		wantPorts string
+		wantErr   bool
+	}{
+		{
+			name:      "rsa",
+			token:     signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claimsOf("job-1", "22,8000-8100", time.Minute)),
+			wantUID:   "job-1",
+			wantPorts: "22,8000-8100",
+		},
+		{
+			name:      "ec with list of ports",
+			token:     signToken(t, jwt.SigningMethodES256, ecKey, "ec", claimsOf("job-2", []interface{}{22, "80"}, time.Minute)),
+			wantUID:   "job-2",
+			wantPorts: "22,80",
+		},
+		{
+			name:    "ed25519 without ports",
+			token:   signToken(t, jwt.SigningMethodEdDSA, edKey, "ed", claimsOf("job-3", nil, time.Minute)),
+			wantUID: "job-3",
+		},
+		{
+			name:    "expired",
+			token:   signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claimsOf("job-1", "22", -time.Minute)),
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{
+				"sub": "job-1", "aud": "other", "iss": "ci", "exp": time.Now().Add(time.Minute).Unix(),
+			}),
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{
+				"sub": "job-1", "aud": "narwhal", "iss": "other", "exp": time.Now().Add(time.Minute).Unix(),
+			}),
+			wantErr: true,
+		},
+		{
+			name: "no expiry",
+			token: signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", jwt.MapClaims{
+				"sub": "job-1", "aud": "narwhal", "iss": "ci",
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "no sub",
+			token:   signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claimsOf("", "22", time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "unknown kid",
+			token:   signToken(t, jwt.SigningMethodRS256, rsaKey, "gone", claimsOf("job-1", "22", time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "signed by other key",
+			token:   signToken(t, jwt.SigningMethodRS256, otherKey, "rsa", claimsOf("job-1", "22", time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "algorithm not match key",
+			token:   signToken(t, jwt.SigningMethodES256, ecKey, "rsa", claimsOf("job-1", "22", time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "hmac",
+			token:   signToken(t, jwt.SigningMethodHS256, []byte("secret"), "rsa", claimsOf("job-1", "22", time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "invalidate ports",
+			token:   signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", claimsOf("job-1", "22-", time.Minute)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if claims.UID != tt.wantUID || claims.Ports != tt.wantPorts {
+				t.Errorf("Verify() = %+v, want uid %s ports %s", claims, tt.wantUID, tt.wantPorts)
+			}
+		})
+	}
+}
+
+func TestJWTVerifier_publicKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+
+	v, err := NewJWTVerifier(JWTPolicy{PublicKey: path, Audience: "narwhal"})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() error = %v", err)
+	}
+	// Kid means nothing to a single PEM key
+	for _, kid := range []string{"", "any"} {
+		if _, err := v.Verify(signToken(t, jwt.SigningMethodPS256, key, kid, claimsOf("job-1", "22", time.Minute))); err != nil {
+			t.Errorf("Verify() with kid [%s] error = %v", kid, err)
+		}
+	}
+
+	if _, err := NewJWTVerifier(JWTPolicy{PublicKey: path}); err == nil {
+		t.Error("NewJWTVerifier() without audience succeed")
+	}
+	if _, err := NewJWTVerifier(JWTPolicy{PublicKey: filepath.Join(t.TempDir(), "none.pem"), Audience: "narwhal"}); err == nil {
+		t.Error("NewJWTVerifier() of missing key file succeed")
+	}
+}
+
+func TestJWTVerifier_Reload(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, map[string]interface{}{"2024": &oldKey.PublicKey})
+
+	v, err := NewJWTVerifier(JWTPolicy{JWKS: jwks, Audience: "narwhal"})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier() error = %v", err)
+	}
+	oldToken := signToken(t, jwt.SigningMethodES256, oldKey, "2024", claimsOf("job-1", "22", time.Minute))
+	newToken := signToken(t, jwt.SigningMethodES256, newKey, "2025", claimsOf("job-1", "22", time.Minute))
+	if _, err := v.Verify(newToken); err == nil {
+		t.Error("Verify() token of key not rotated yet succeed")
+	}
+
+	writeJWKS(t, jwks, map[string]interface{}{"2025": &newKey.PublicKey})
+	if err := v.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if _, err := v.Verify(newToken); err != nil {
+		t.Errorf("Verify() token of rotated key error = %v", err)
+	}
+	if _, err := v.Verify(oldToken); err == nil {
+		t.Error("Verify() token of retired key succeed")
+	}
+
+	// Keys in use are kept when reload failed
+	os.WriteFile(jwks, []byte("{"), 0600)
+	if err := v.Reload(); err == nil {
+		t.Error("Reload() of broken jwks succeed")
+	}
+	if _, err := v.Verify(newToken); err != nil {
+		t.Errorf("Verify() after failed reload error = %v", err)
+	}
+}
+
+func TestProxyServer_authToken(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, map[string]interface{}{"k1": &key.PublicKey})
+	v, err := NewJWTVerifier(JWTPolicy{JWKS: jwks, Audience: "narwhal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, jwt.SigningMethodRS256, key, "k1", claimsOf("job-1", "8000-8100", time.Minute))
+
+	tests := []struct {
+		name    string
+		jwt     *JWTVerifier
+		uid     string
+		token   string
+		wantErr bool
+	}{
+		{name: "uid from token", jwt: v, token: token},
+		{name: "uid match token", jwt: v, uid: "job-1", token: token},
+		{name: "uid not match token", jwt: v, uid: "job-2", token: token, wantErr: true},
+		{name: "invalidate token", jwt: v, token: token[:len(token)-4], wantErr: true},
+		{name: "token auth disabled", token: token, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewProxyServer(Users(map[string]string{"job-2": "0"}), JWT(tt.jwt), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+			sConn, cConn := net.Pipe()
+			defer cConn.Close()
+			conn := connection.NewServerConnection(sConn)
+			client := connection.NewClient(cConn, connection.AuthToken(tt.token))
+			errCh := make(chan error, 1)
+			go func() { errCh <- client.Auth(tt.uid) }()
+
+			_, err := s.auth(context.Background(), conn)
+			s.replyRefusal(conn, err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProxyServer.auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cErr := <-errCh; (cErr != nil) != tt.wantErr {
+				t.Fatalf("Client.Auth() error = %v, wantErr %v", cErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if uid := conn.GetArrs().UID; uid != "job-1" {
+				t.Errorf("uid of connection %s, want job-1", uid)
+			}
+			// Ports of token take precedence over user store
+			if !s.permitPort(context.Background(), conn, 8080) || s.permitPort(context.Background(), conn, 22) {
+				t.Error("permitPort() not match ports of token")
+			}
+		})
+	}
+}
@@ -1,5 +1,13 @@
 package proxy
 
+import (
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/logging"
+	"github.com/lucheng0127/narwhal/pkg/transport"
+	"golang.org/x/crypto/ssh"
+)
+
 type Option func(s *ProxyServer)
 type COption func(c *ClientServer)
 
@@ -9,9 +17,32 @@ func ListenPort(port int) Option {
 	}
 }
 
+// Listen serve on ep instead of tcp port of ListenPort
+func Listen(ep *transport.Endpoint) Option {
+	return func(s *ProxyServer) {
+		s.listen = ep
+	}
+}
+
 func Users(users map[string]string) Option {
 	return func(s *ProxyServer) {
-		s.users = users
+		s.store = NewStaticUserStore(users)
+	}
+}
+
+// StaticUsers is Users with validity of users
+func StaticUsers(users []User) Option {
+	return func(s *ProxyServer) {
+		store := new(StaticUserStore)
+		store.SetUsers(users)
+		s.store = store
+	}
+}
+
+// Store look up users with store instead of users of Users
+func Store(store UserStore) Option {
+	return func(s *ProxyServer) {
+		s.store = store
 	}
 }
 
@@ -21,6 +52,13 @@ func Host(host string) COption {
 	}
 }
 
+// Remote connect to server at ep instead of tcp address of Host
+func Remote(ep *transport.Endpoint) COption {
+	return func(c *ClientServer) {
+		c.remote = ep
+	}
+}
+
 func RemotePort(port uint16) COption {
 	return func(c *ClientServer) {
 		c.rPort = port
@@ -38,3 +76,163 @@ func Uid(uid string) COption {
 		c.uid = uid
 	}
 }
+
+// HelloTimeout limit the time from accepting a connection to receiving its
+// first request, 0 means DefaultHelloTimeout
+func HelloTimeout(d time.Duration) Option {
+	return func(s *ProxyServer) {
+		s.helloTimeout = d
+	}
+}
+
+// AuthTimeout limit the time to answer the auth request, 0 means
+// DefaultAuthTimeout
+func AuthTimeout(d time.Duration) Option {
+	return func(s *ProxyServer) {
+		s.authTimeout = d
+	}
+}
+
+// BindTimeout limit the time from auth succeed to bind finished, 0 means
+// DefaultBindTimeout
+func BindTimeout(d time.Duration) Option {
+	return func(s *ProxyServer) {
+		s.bindTimeout = d
+	}
+}
+
+// IdleTimeout close proxy streams without traffic for d, 0 means never
+func IdleTimeout(d time.Duration) Option {
+	return func(s *ProxyServer) {
+		s.idleTimeout = d
+	}
+}
+
+// MaxHandshakes limit the number of concurrent unauthenticated connections,
+// 0 means DefaultMaxHandshakes and negative means unlimited
+func MaxHandshakes(n int) Option {
+	return func(s *ProxyServer) {
+		s.maxHandshakes = n
+	}
+}
+
+// Guard set how auth failures are punished, see GuardPolicy
+func Guard(policy GuardPolicy) Option {
+	return func(s *ProxyServer) {
+		s.guard = newAuthGuard(policy)
+	}
+}
+
+// SecretService serve lPort as secret service name, or visit it in
+// visitor mode, key is shared by client and visitors
+func SecretService(name, key string) COption {
+	return func(c *ClientServer) {
+		c.service = name
+		c.key = key
+	}
+}
+
+// Visitor listen lPort and proxy it to secret service
+func Visitor(visitor bool) COption {
+	return func(c *ClientServer) {
+		c.visitor = visitor
+	}
+}
+
+// Forwards set targets can be forwarded by user, see availabledTarget
+func Forwards(forwards map[string][]string) Option {
+	return func(s *ProxyServer) {
+		s.forwards = forwards
+	}
+}
+
+// Target forward lPort to target host:port dialed by server
+func Target(target string) COption {
+	return func(c *ClientServer) {
+		c.target = target
+	}
+}
+
+// ServerLogger log through l instead of the default logger, including
+// connections served
+func ServerLogger(l logging.Logger) Option {
+	return func(s *ProxyServer) {
+		s.log = l
+	}
+}
+
+// ClientLogger log through l instead of the default logger, including
+// connections to server
+func ClientLogger(l logging.Logger) COption {
+	return func(c *ClientServer) {
+		c.log = l
+	}
+}
+
+// AccessLog write a json line for each visitor connection when it closed,
+// access log is disabled when policy.File is empty
+func AccessLog(policy AccessLogPolicy) Option {
+	return func(s *ProxyServer) {
+		if len(policy.File) == 0 {
+			return
+		}
+		s.access = newAccessLog(policy)
+	}
+}
+
+// Webhook decide auth and bind with webhook of policy instead of user
+// store, and visitors when policy.Visitors, disabled when url empty
+func Webhook(policy WebhookPolicy) Option {
+	return func(s *ProxyServer) {
+		if len(policy.URL) == 0 {
+			return
+		}
+		s.webhook = newWebhook(policy)
+	}
+}
+
+// JWT accept tokens verified by v on auth, uid and ports are taken from
+// tokens instead of user store
+func JWT(v *JWTVerifier) Option {
+	return func(s *ProxyServer) {
+		s.jwt = v
+	}
+}
+
+// Token send token with uid on auth, uid may be empty when server takes it
+// from token
+func Token(token string) COption {
+	return func(c *ClientServer) {
+		c.token = token
+	}
+}
+
+// KeyAuth accept clients signing challenges with ssh private keys
+// of public keys in keys
+func KeyAuth(keys *AuthorizedKeys) Option {
+	return func(s *ProxyServer) {
+		s.authKeys = keys
+	}
+}
+
+// InviteAuth accept clients with tokens of invites, each token once
+func InviteAuth(invites *Invites) Option {
+	return func(s *ProxyServer) {
+		s.invites = invites
+	}
+}
+
+// Sessions set policy of binding or registering while previous session
+// of the same uid is alive
+func Sessions(policy SessionPolicy) Option {
+	return func(s *ProxyServer) {
+		s.sessionPolicy = policy
+	}
+}
+
+// Signer auth by signing challenge of server with signer instead of token
+func Signer(signer ssh.Signer) COption {
+	return func(c *ClientServer) {
+		c.signer = signer
+	}
+}
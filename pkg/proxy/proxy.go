@@ -1,7 +1,13 @@
 package proxy
 
+import "time"
+
 const (
-	DefaultPort int = 8888
+	DefaultPort          int           = 8888
+	DefaultHelloTimeout  time.Duration = 10 * time.Second
+	DefaultAuthTimeout   time.Duration = 10 * time.Second
+	DefaultBindTimeout   time.Duration = 10 * time.Second
+	DefaultMaxHandshakes int           = 1024
 )
 
 type Server interface {
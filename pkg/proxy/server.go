@@ -1,24 +1,92 @@
 package proxy
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/internal/pkg/telemetry"
 	"github.com/lucheng0127/narwhal/internal/pkg/utils"
 	"github.com/lucheng0127/narwhal/pkg/connection"
 	"github.com/lucheng0127/narwhal/pkg/protocol"
+	"github.com/lucheng0127/narwhal/pkg/transport"
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/crypto/ssh"
 )
 
+// Handshake phases of a connection
+const (
+	phaseHello = "hello" // Accepted, waiting for the first request
+	phaseAuth  = "auth"  // First request received, replying auth result
+	phaseBind  = "bind"  // Authenticated, waiting for bind request
+)
+
+// phaseTimeoutError is returned when a handshake phase exceeded its deadline
+type phaseTimeoutError struct {
+	phase string
+}
+
+func (e *phaseTimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout", e.phase)
+}
+
+// phaseErr convert deadline exceeded err into phaseTimeoutError
+func phaseErr(phase string, err error) error {
+	var nErr net.Error
+	if errors.As(err, &nErr) && nErr.Timeout() {
+		return &phaseTimeoutError{phase: phase}
+	}
+	return err
+}
+
+// deadline return the deadline of a phase start from now
+func deadline(d time.Duration) time.Time {
+	return time.Now().Add(d)
+}
+
+// secretService is served by an authenticated connection without port
+// listened, only visitors with key can reach it
+type secretService struct {
+	key     string
+	authCtx string // Auth ctx of the connection serving it
+}
+
 type ProxyServer struct {
-	port       int // Service port
-	ln         net.Listener
-	users      map[string]string // TODO(shawnlu): Use sync map
-	authedConn map[string]connection.Connection
+	port          int                 // Service port
+	listen        *transport.Endpoint // Listened instead of tcp port when set
+	ln            net.Listener
+	store         UserStore
+	usersMu       sync.RWMutex // Protect forwards and sessionPolicy
+	mu            sync.RWMutex // Protect authedConn, secrets, sessions and expiries
+	authedConn    map[string]connection.Connection
+	secrets       map[string]*secretService
+	forwards      map[string][]string // Targets can be forwarded by user
+	helloTimeout  time.Duration
+	authTimeout   time.Duration
+	bindTimeout   time.Duration
+	idleTimeout   time.Duration
+	maxHandshakes int
+	handshakeSem  chan struct{} // Slots of unauthenticated connections
+	guard         *authGuard
+	log           logger.Logger
+	access        *accessLog      // Access log of visitor connections, nil to disable
+	webhook       *webhook        // Decide auth, bind and visitors, nil to use user store
+	jwt           *JWTVerifier    // Verify tokens clients auth with, nil to refuse tokens
+	authKeys      *AuthorizedKeys // Ssh public keys of users, nil to refuse key auth
+	invites       *Invites        // Pending invites, nil to refuse invite tokens
+	sessionPolicy SessionPolicy   // Protected by usersMu
+	sessions      map[string]*session
+	expiries      map[string]*sessionExpiry
 }
 
 func NewProxyServer(opts ...Option) Server {
@@ -27,14 +95,124 @@ func NewProxyServer(opts ...Option) Server {
 		o(s)
 	}
 
+	if s.log == nil {
+		s.log = logger.Default()
+	}
 	ctx := utils.NewTraceContext()
-	if s.port == 0 {
-		logger.Warn(ctx, fmt.Sprintf("Port not configured, use [%d]\n", DefaultPort))
+	if s.port == 0 && s.listen == nil {
+		s.log.Warn(ctx, "port not configured, use default", logger.Fields{"port": DefaultPort})
 		s.port = DefaultPort
 	}
+	if s.helloTimeout == 0 {
+		s.helloTimeout = DefaultHelloTimeout
+	}
+	if s.authTimeout == 0 {
+		s.authTimeout = DefaultAuthTimeout
+	}
+	if s.bindTimeout == 0 {
+		s.bindTimeout = DefaultBindTimeout
+	}
+	if s.maxHandshakes == 0 {
+		s.maxHandshakes = DefaultMaxHandshakes
+	}
+	if s.store == nil {
+		s.store = NewStaticUserStore(nil)
+	}
+	if s.guard == nil {
+		s.guard = newAuthGuard(DefaultGuardPolicy)
+	}
+	s.guard.log = s.log
+	if s.access != nil {
+		s.access.log = s.log
+	}
+	if s.webhook != nil {
+		s.webhook.log = s.log
+	}
+	s.authedConn = make(map[string]connection.Connection)
+	s.secrets = make(map[string]*secretService)
 	return s
 }
 
+// Reload replace users and forwards, it takes effect on following auth and
+// bind requests. Connections of users removed or out of validity are
+// disconnected, changed validity applies to the others. Users are
+// ignored when user store is not static, such stores change without reload
+func (s *ProxyServer) Reload(users []User, forwards map[string][]string) {
+	if store, ok := s.store.(*StaticUserStore); ok {
+		store.SetUsers(users)
+	}
+
+	s.usersMu.Lock()
+	s.forwards = forwards
+	s.usersMu.Unlock()
+
+	s.recheckSessions()
+}
+
+// ReloadKeys read keys verifying tokens again, keys in use are kept when
+// it fails
+func (s *ProxyServer) ReloadKeys() error {
+	if s.jwt == nil {
+		return nil
+	}
+	return s.jwt.Reload()
+}
+
+// Bans return ips banned for auth failures currently
+func (s *ProxyServer) Bans() []Ban {
+	if s.guard == nil {
+		return nil
+	}
+	return s.guard.list()
+}
+
+// authFailure is auth refused, refusal with rCode is replied after delay
+// so brute force is slowed down
+type authFailure struct {
+	rCode byte
+	delay time.Duration
+	err   error
+}
+
+func (e *authFailure) Error() string {
+	return e.err.Error()
+}
+
+func (e *authFailure) Unwrap() error {
+	return e.err
+}
+
+// authFailed record auth failure of conn, return err with the refusal to
+// reply and its delay
+func (s *ProxyServer) authFailed(ctx context.Context, conn net.Conn, uid string, rCode byte, err error) error {
+	failure := &authFailure{rCode: rCode, err: err}
+	if s.guard != nil {
+		failure.delay = s.guard.fail(ctx, remoteIP(conn), uid)
+	}
+	return failure
+}
+
+// replyRefusal reply refusal of auth failure err after its delay, nothing
+// for other errors
+func (s *ProxyServer) replyRefusal(conn connection.Connection, err error) {
+	var failure *authFailure
+	if !errors.As(err, &failure) {
+		return
+	}
+	time.Sleep(failure.delay)
+	cArrs := conn.GetArrs()
+	cArrs.Conn.SetWriteDeadline(deadline(s.authTimeout))
+	rPkt := protocol.NewPkt(failure.rCode, []byte{protocol.RetFailed})
+	rPkt.SendToConn(cArrs.Conn)
+}
+
+func (s *ProxyServer) authSucceed(conn net.Conn, uid string) {
+	if s.guard == nil {
+		return
+	}
+	s.guard.succeed(remoteIP(conn), uid)
+}
+
 // Port can be bound by user
 // user.Ports:
 //
@@ -42,65 +220,221 @@ func NewProxyServer(opts ...Option) Server {
 //	80 - only 80 can be bind
 //	80,22 - port 80 and 22 can be bind
 //	1000-1010 - port from 1000 to 1020 can be bind
+//	22,8000-8100 - port 22 and ports from 8000 to 8100 can be bind
 //
 // port contained by user.Ports
 func (s *ProxyServer) availabledPort(uid string, port int) bool {
-	pr, ok := s.users[uid]
-	if !ok {
+	ok, err := s.store.AvailablePort(uid, port)
+	if err != nil {
+		s.log.Error(utils.NewTraceContext(), "look up user", logger.Fields{logger.FieldUID: uid, logger.FieldError: err})
 		return false
 	}
+	return ok
+}
 
-	if strings.Contains(pr, "-") {
-		prArray := strings.Split(pr, "-")
-		if len(prArray) != 2 {
-			return false
+// portSpec is a parsed port spec, see availabledPort for the format
+type portSpec struct {
+	all    bool     // Spec 0, all ports
+	ranges [][2]int // First and last port of listed ports and ranges
+}
+
+// parsePortSpec parse port spec pr, see availabledPort for the format
+func parsePortSpec(pr string) (*portSpec, error) {
+	atoi := func(s string) (int, error) {
+		p, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || p < 1 || p > 65535 {
+			return 0, fmt.Errorf("invalidate port [%s] in port spec [%s]", s, pr)
+		}
+		return p, nil
+	}
+
+	if strings.TrimSpace(pr) == "0" {
+		return &portSpec{all: true}, nil
+	}
+
+	ps := new(portSpec)
+	for _, item := range strings.Split(pr, ",") {
+		if !strings.Contains(item, "-") {
+			p, err := atoi(item)
+			if err != nil {
+				return nil, err
+			}
+			ps.ranges = append(ps.ranges, [2]int{p, p})
+			continue
 		}
 
-		prL, err := strconv.Atoi(prArray[0])
+		prArray := strings.Split(item, "-")
+		if len(prArray) != 2 {
+			return nil, fmt.Errorf("invalidate port range [%s]", item)
+		}
+		prL, err := atoi(prArray[0])
 		if err != nil {
-			return false
+			return nil, err
 		}
-		prR, err := strconv.Atoi(prArray[1])
+		prR, err := atoi(prArray[1])
 		if err != nil {
-			return false
+			return nil, err
+		}
+		if prL > prR {
+			return nil, fmt.Errorf("invalidate port range [%s], start greater than end", item)
 		}
+		ps.ranges = append(ps.ranges, [2]int{prL, prR})
+	}
+	return ps, nil
+}
 
-		if prL <= port && port <= prR {
+func (ps *portSpec) contains(port int) bool {
+	if ps.all {
+		return true
+	}
+	for _, rng := range ps.ranges {
+		if rng[0] <= port && port <= rng[1] {
 			return true
 		}
+	}
+	return false
+}
+
+// ValidatePortSpec check the format of port spec pr, see availabledPort
+// for the format
+func ValidatePortSpec(pr string) error {
+	_, err := parsePortSpec(pr)
+	return err
+}
+
+// portInSpec check whether port contained by port spec pr, see
+// availabledPort for the format of pr
+func portInSpec(pr string, port int) bool {
+	ps, err := parsePortSpec(pr)
+	if err != nil {
 		return false
 	}
+	return ps.contains(port)
+}
 
-	if strings.Contains(pr, ",") {
-		prArray := strings.Split(pr, ",")
-		for _, prIStr := range prArray {
-			prI, err := strconv.Atoi(prIStr)
-			if err == nil && prI == port {
-				return true
-			}
-		}
+func (s *ProxyServer) getUserByUid(uid string) string {
+	user, err := s.store.Lookup(uid)
+	if err != nil {
+		s.log.Error(utils.NewTraceContext(), "look up user", logger.Fields{logger.FieldUID: uid, logger.FieldError: err})
+		return ""
+	}
+	if user == nil {
+		return ""
+	}
+	return user.Uid
+}
+
+// authorizeUser decide whether uid can authenticate by user store, users out
+// of validity are refused, and conn expires with the user
+func (s *ProxyServer) authorizeUser(ctx context.Context, conn connection.Connection, uid string) bool {
+	user, err := s.store.Lookup(uid)
+	if err != nil {
+		s.log.Error(ctx, "look up user", logger.Fields{logger.FieldUID: uid, logger.FieldError: err})
+		return false
+	}
+	if user == nil {
+		return false
+	}
+	if err := user.check(time.Now()); err != nil {
+		s.log.Warn(ctx, "user refused", logger.Fields{logger.FieldUID: uid, logger.FieldError: err})
 		return false
 	}
+	if !user.ExpiresAt.IsZero() {
+		conn.SetExpire(user.ExpiresAt)
+	}
+	return true
+}
 
-	prI, err := strconv.Atoi(pr)
-	if err == nil {
-		if prI == 0 || prI == port {
-			return true
-		}
+// authorize decide whether uid can authenticate with conn, by webhook when
+// configured, otherwise by user store. Limits replied by webhook are set
+// to conn. Error is returned when webhook unavailable, it isn't an auth
+// failure of client
+func (s *ProxyServer) authorize(ctx context.Context, conn connection.Connection, uid string) (bool, error) {
+	if s.webhook == nil {
+		return s.authorizeUser(ctx, conn, uid), nil
 	}
 
-	return false
+	d, err := s.webhook.decide(ctx, WebhookRequest{
+		Event:      WebhookAuth,
+		UID:        uid,
+		ClientAddr: conn.GetArrs().Conn.RemoteAddr().String(),
+	})
+	if d.Allow {
+		conn.SetLimits(d.limits(connection.Limits{}))
+	}
+	return d.Allow, err
 }
 
-func (s *ProxyServer) getUserByUid(uid string) string {
-	_, ok := s.users[uid]
-	if ok {
-		return uid
+// authorizeToken verify token of conn, an invite or JWT, uid is taken from
+// token, and must match uid sent by client if any. Ports of token are
+// granted to conn until token expires
+func (s *ProxyServer) authorizeToken(conn connection.Connection, uid, token string) (string, error) {
+	if strings.HasPrefix(token, InvitePrefix) {
+		return s.redeemInvite(conn, uid, token)
+	}
+	if s.jwt == nil {
+		return uid, errors.New("token auth not enabled")
 	}
-	return ""
+	claims, err := s.jwt.Verify(token)
+	if err != nil {
+		return uid, fmt.Errorf("verify token %s", err.Error())
+	}
+	if len(uid) != 0 && uid != claims.UID {
+		return uid, fmt.Errorf("uid not match sub [%s] of token", claims.UID)
+	}
+	conn.SetGrant(&connection.Grant{Ports: claims.Ports})
+	conn.SetExpire(claims.Expire)
+	return claims.UID, nil
+}
+
+// redeemInvite consume invite of token, it can't be used again even auth
+// failed after that
+func (s *ProxyServer) redeemInvite(conn connection.Connection, uid, token string) (string, error) {
+	if s.invites == nil {
+		return uid, errors.New("invite auth not enabled")
+	}
+	invite, err := s.invites.Redeem(token, time.Now())
+	if err != nil {
+		return uid, fmt.Errorf("redeem invite %s", err.Error())
+	}
+	if invite == nil {
+		return uid, errors.New("invite not exist or used already")
+	}
+	if len(uid) != 0 && uid != invite.Uid {
+		return uid, fmt.Errorf("uid not match uid [%s] of invite", invite.Uid)
+	}
+	conn.SetGrant(&connection.Grant{Ports: invite.Ports})
+	conn.SetExpire(invite.ExpiresAt)
+	return invite.Uid, nil
+}
+
+// permitPort decide whether authenticated conn can bind port, by grant of
+// its credential, webhook when configured, otherwise by user store
+func (s *ProxyServer) permitPort(ctx context.Context, conn connection.Connection, port int) bool {
+	cArrs := conn.GetArrs()
+	if cArrs.Grant != nil {
+		return portInSpec(cArrs.Grant.Ports, port)
+	}
+	if s.webhook == nil {
+		return s.availabledPort(cArrs.UID, port)
+	}
+
+	d, _ := s.webhook.decide(ctx, WebhookRequest{
+		Event:      WebhookBind,
+		UID:        cArrs.UID,
+		ClientAddr: cArrs.Conn.RemoteAddr().String(),
+		Port:       port,
+	})
+	if d.Allow {
+		conn.SetLimits(d.limits(cArrs.Limits))
+	}
+	return d.Allow
 }
 
 func (s *ProxyServer) getAuthedConn(authCtx string) connection.Connection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	conn, ok := s.authedConn[authCtx]
 	if ok {
 		return conn
@@ -108,41 +442,95 @@ func (s *ProxyServer) getAuthedConn(authCtx string) connection.Connection {
 	return nil
 }
 
-func (s *ProxyServer) auth(conn connection.Connection) (string, error) {
+func (s *ProxyServer) addAuthedConn(authCtx string, conn connection.Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authedConn[authCtx] = conn
+}
+
+// delAuthedConn remove conn, its session and secret services registered by it
+func (s *ProxyServer) delAuthedConn(authCtx string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.authedConn, authCtx)
+	s.releaseSession(authCtx)
+	if e, ok := s.expiries[authCtx]; ok {
+		e.stop()
+		delete(s.expiries, authCtx)
+	}
+	for name, svc := range s.secrets {
+		if svc.authCtx == authCtx {
+			delete(s.secrets, name)
+		}
+	}
+}
+
+// getSecretService return authCtx of connection serving name, key must match
+func (s *ProxyServer) getSecretService(name, key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	svc, ok := s.secrets[name]
+	if !ok || subtle.ConstantTimeCompare([]byte(svc.key), []byte(key)) != 1 {
+		return ""
+	}
+	return svc.authCtx
+}
+
+func (s *ProxyServer) auth(ctx context.Context, conn connection.Connection) (string, error) {
 	// Parse pkt
 	cArrs := conn.GetArrs()
+	cArrs.Conn.SetReadDeadline(deadline(s.helloTimeout))
 	pkt, err := protocol.ReadFromConn(cArrs.Conn)
 	if err != nil {
-		return "", fmt.Errorf("parse auth request %s", err.Error())
+		return "", fmt.Errorf("parse auth request %w", phaseErr(phaseHello, err))
 	}
+	cArrs.Conn.SetWriteDeadline(deadline(s.authTimeout))
 
 	// Switch req code
 	rPayload := make([]byte, 1)
 	switch pkt.GetPCode() {
 	case protocol.ReqAuth:
-		uid := pkt.GetPayload().String()
-		if len(s.getUserByUid(uid)) == 0 {
+		// Payload is uid, or uid and token, uid may be empty with token
+		var uid, token string
+		fields := pkt.GetPayload().Fields()
+		if len(fields) > 0 {
+			uid = fields[0]
+		}
+		if len(fields) == 2 {
+			token = fields[1]
+		}
+		if len(token) != 0 {
+			var err error
+			uid, err = s.authorizeToken(conn, uid, token)
+			if err != nil {
+				return "", s.authFailed(ctx, cArrs.Conn, uid, protocol.RepAuth, fmt.Errorf("token auth of user [%s] %s", uid, err.Error()))
+			}
+		} else if allowed, err := s.authorize(ctx, conn, uid); !allowed {
+			if err == nil {
+				return "", s.authFailed(ctx, cArrs.Conn, uid, protocol.RepAuth, fmt.Errorf("no such user [%s]", uid))
+			}
 			rPayload[0] = protocol.RetFailed
 			rPkt := protocol.NewPkt(protocol.RepAuth, rPayload)
 			rPkt.SendToConn(cArrs.Conn)
-			return "", fmt.Errorf("no such user [%s]", uid)
+			return "", fmt.Errorf("authorize user [%s] %s", uid, err.Error())
 		}
-		conn.SetUID(uid)
-
-		// Generate auth ctx
-		authCtx := uuid.NewV4().String()
-		conn.SetAuthCtx(authCtx)
-
-		// Reply and return
-		rPayload[0] = protocol.RetSucceed
-		rPkt := protocol.NewPkt(protocol.RepAuth, rPayload)
-		rPkt.SendToConn(cArrs.Conn)
-		return authCtx, nil
+		return s.authed(conn, uid, protocol.RepAuth)
+	case protocol.ReqKeyAuth:
+		uid, err := s.keyAuth(ctx, conn, pkt)
+		if err != nil {
+			return "", fmt.Errorf("key auth of user [%s] %w", uid, err)
+		}
+		return s.authed(conn, uid, protocol.RepKeySign)
 	case protocol.ReqPConn:
 		authCtx := pkt.GetPayload().String()
-		conn := s.getAuthedConn(authCtx)
+		aConn := s.getAuthedConn(authCtx)
 
-		if conn == nil {
+		if aConn == nil {
+			// Not a failure, auth ctx is staled when server restarted
+			// or session closed
 			rPayload[0] = protocol.RetFailed
 			rPkt := protocol.NewPkt(protocol.RepPConn, rPayload)
 			rPkt.SendToConn(cArrs.Conn)
@@ -154,23 +542,137 @@ func (s *ProxyServer) auth(conn connection.Connection) (string, error) {
 		// Reply and return
 		rPayload[0] = protocol.RetSucceed
 		rPkt := protocol.NewPkt(protocol.RepPConn, rPayload)
-		rPkt.SendToConn(cArrs.Conn)
-		return "", nil
+		if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+			return "", fmt.Errorf("reply proxy connection %w", phaseErr(phaseAuth, err))
+		}
+		return authCtx, nil
+	case protocol.ReqVisit:
+		fields := pkt.GetPayload().Fields()
+		authCtx := ""
+		if len(fields) == 2 {
+			authCtx = s.getSecretService(fields[0], fields[1])
+		}
+
+		if len(authCtx) == 0 {
+			return "", s.authFailed(ctx, cArrs.Conn, "", protocol.RepVisit, errors.New("visit secret service refused, invalidate name or key"))
+		}
+		conn.SetToVisitorConn()
+
+		rPayload[0] = protocol.RetSucceed
+		rPkt := protocol.NewPkt(protocol.RepVisit, rPayload)
+		if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+			return "", fmt.Errorf("reply visit %w", phaseErr(phaseAuth, err))
+		}
+		return authCtx, nil
 	default:
-		rPayload[0] = protocol.RetFailed
-		rPkt := protocol.NewPkt(protocol.RepNone, rPayload)
-		rPkt.SendToConn(cArrs.Conn)
-		return "", fmt.Errorf("invalidate auth request format")
+		return "", s.authFailed(ctx, cArrs.Conn, "", protocol.RepNone, errors.New("invalidate auth request format"))
+	}
+}
+
+// authed set uid and a new auth ctx to conn authenticated, and reply
+// success with rCode
+func (s *ProxyServer) authed(conn connection.Connection, uid string, rCode byte) (string, error) {
+	cArrs := conn.GetArrs()
+	s.authSucceed(cArrs.Conn, uid)
+	conn.SetUID(uid)
+
+	// Generate auth ctx
+	authCtx := uuid.NewV4().String()
+	conn.SetAuthCtx(authCtx)
+
+	// Reply and return
+	rPkt := protocol.NewPkt(rCode, []byte{protocol.RetSucceed})
+	if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+		return "", fmt.Errorf("reply auth %w", phaseErr(phaseAuth, err))
+	}
+	return authCtx, nil
+}
+
+// keyAuth challenge client to sign with private key of the ssh public key
+// it sent. Challenge is sent even the key isn't authorized, so keys of
+// users can't be probed. Ports option of the key is granted to conn
+func (s *ProxyServer) keyAuth(ctx context.Context, conn connection.Connection, pkt protocol.PKG) (string, error) {
+	cArrs := conn.GetArrs()
+	var uid string
+	fields := pkt.GetPayload().Fields()
+	if len(fields) > 0 {
+		uid = fields[0]
 	}
+	refuse := func(rCode byte, err error) error {
+		return s.authFailed(ctx, cArrs.Conn, uid, rCode, err)
+	}
+
+	if s.authKeys == nil {
+		return uid, refuse(protocol.RepKeyAuth, errors.New("key auth not enabled"))
+	}
+	if len(fields) != 2 {
+		return uid, refuse(protocol.RepKeyAuth, errors.New("invalidate key auth request, uid or public key not set"))
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+	if err != nil {
+		return uid, refuse(protocol.RepKeyAuth, fmt.Errorf("parse public key %s", err.Error()))
+	}
+	aKey, err := s.authKeys.Lookup(uid, pub)
+	if err != nil {
+		s.log.Error(ctx, "look up authorized keys", logger.Fields{logger.FieldUID: uid, logger.FieldError: err})
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return uid, err
+	}
+	rPkt := protocol.NewPkt(protocol.RepKeyAuth, append([]byte{protocol.RetSucceed}, challenge...))
+	if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+		return uid, fmt.Errorf("reply key auth %w", phaseErr(phaseAuth, err))
+	}
+
+	cArrs.Conn.SetReadDeadline(deadline(s.authTimeout))
+	sPkt, err := protocol.ReadFromConn(cArrs.Conn)
+	if err != nil {
+		return uid, fmt.Errorf("parse key sign request %w", phaseErr(phaseAuth, err))
+	}
+	sig := new(ssh.Signature)
+	if sPkt.GetPCode() != protocol.ReqKeySign || ssh.Unmarshal([]byte(sPkt.GetPayload().String()), sig) != nil {
+		return uid, refuse(protocol.RepKeySign, errors.New("invalidate key sign request format"))
+	}
+	if aKey == nil {
+		return uid, refuse(protocol.RepKeySign, errors.New("public key not authorized"))
+	}
+	if err := (Validity{ExpiresAt: aKey.ExpiresAt}).check(time.Now()); err != nil {
+		return uid, refuse(protocol.RepKeySign, fmt.Errorf("public key %s", err.Error()))
+	}
+	// SHA1 signatures of rsa keys are refused as OpenSSH does
+	if sig.Format == ssh.KeyAlgoRSA {
+		return uid, refuse(protocol.RepKeySign, errors.New("ssh-rsa signature not allowed, sign with rsa-sha2-256 or rsa-sha2-512"))
+	}
+	if err := pub.Verify(protocol.KeyAuthData(uid, challenge), sig); err != nil {
+		return uid, refuse(protocol.RepKeySign, fmt.Errorf("verify signature %s", err.Error()))
+	}
+
+	if aKey.HasPorts {
+		conn.SetGrant(&connection.Grant{Ports: aKey.Ports})
+	}
+	if !aKey.ExpiresAt.IsZero() {
+		conn.SetExpire(aKey.ExpiresAt)
+		conn.SetKeyExpire(aKey.ExpiresAt)
+	}
+	return uid, nil
 }
 
-func (s *ProxyServer) bind(conn connection.Connection) (int, error) {
+// negotiate read the request of authenticated connection, a port binding,
+// secret service registration or local port forwarding
+func (s *ProxyServer) negotiate(conn connection.Connection) (protocol.PKG, error) {
 	cArrs := conn.GetArrs()
+	cArrs.Conn.SetDeadline(deadline(s.bindTimeout))
 	pkt, err := protocol.ReadFromConn(cArrs.Conn)
 	if err != nil {
-		return -1, fmt.Errorf("parse bind request %s", err.Error())
+		return nil, fmt.Errorf("parse bind request %w", phaseErr(phaseBind, err))
 	}
+	return pkt, nil
+}
 
+func (s *ProxyServer) bind(ctx context.Context, conn connection.Connection, pkt protocol.PKG) (int, error) {
+	cArrs := conn.GetArrs()
 	rPayload := make([]byte, 1)
 	switch pkt.GetPCode() {
 	case protocol.ReqBind:
@@ -182,16 +684,28 @@ func (s *ProxyServer) bind(conn connection.Connection) (int, error) {
 			return -1, fmt.Errorf("invalidate bind request, binding port not set")
 		}
 
-		if !s.availabledPort(conn.GetArrs().UID, bPort) {
+		if !s.permitPort(ctx, conn, bPort) {
 			rPayload[0] = protocol.RetFailed
 			rPkt := protocol.NewPkt(protocol.RepBind, rPayload)
 			rPkt.SendToConn(cArrs.Conn)
 			return -1, fmt.Errorf("not permitted binding port [%d]", bPort)
 		}
 
-		rPayload[0] = protocol.RetSucceed
+		ret, err := s.claimSession(ctx, conn)
+		rPayload[0] = ret
 		rPkt := protocol.NewPkt(protocol.RepBind, rPayload)
-		rPkt.SendToConn(cArrs.Conn)
+		if err != nil {
+			rPkt.SendToConn(cArrs.Conn)
+			return -1, fmt.Errorf("bind port [%d] %s", bPort, err.Error())
+		}
+		if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+			return -1, fmt.Errorf("reply bind %w", phaseErr(phaseBind, err))
+		}
+		s.log.Info(ctx, "port bound", logger.Fields{
+			logger.FieldUID:        cArrs.UID,
+			logger.FieldBindPort:   bPort,
+			logger.FieldRemoteAddr: cArrs.Conn.RemoteAddr().String(),
+		})
 		return bPort, nil
 	default:
 		rPayload[0] = protocol.RetFailed
@@ -201,48 +715,201 @@ func (s *ProxyServer) bind(conn connection.Connection) (int, error) {
 	}
 }
 
-func (s *ProxyServer) serveConn(conn connection.Connection) {
+// register secret service with name and key, secret service is reachable
+// by visitors with key only, no port listened
+func (s *ProxyServer) register(ctx context.Context, conn connection.Connection, pkt protocol.PKG) (string, error) {
+	cArrs := conn.GetArrs()
+	rPayload := make([]byte, 1)
+	fields := pkt.GetPayload().Fields()
+	if len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
+		rPayload[0] = protocol.RetFailed
+		rPkt := protocol.NewPkt(protocol.RepSecret, rPayload)
+		rPkt.SendToConn(cArrs.Conn)
+		return "", fmt.Errorf("invalidate secret service request, name or key not set")
+	}
+
+	// Claim session first, service of the session replaced is released
+	ret, err := s.claimSession(ctx, conn)
+	if err != nil {
+		rPayload[0] = ret
+		rPkt := protocol.NewPkt(protocol.RepSecret, rPayload)
+		rPkt.SendToConn(cArrs.Conn)
+		return "", fmt.Errorf("register secret service %s", err.Error())
+	}
+
+	name := fields[0]
+	s.mu.Lock()
+	_, exist := s.secrets[name]
+	if !exist {
+		s.secrets[name] = &secretService{key: fields[1], authCtx: cArrs.AuthCtx}
+	}
+	s.mu.Unlock()
+
+	if exist {
+		rPayload[0] = protocol.RetFailed
+		rPkt := protocol.NewPkt(protocol.RepSecret, rPayload)
+		rPkt.SendToConn(cArrs.Conn)
+		return "", fmt.Errorf("secret service [%s] already registered", name)
+	}
+
+	rPayload[0] = ret
+	rPkt := protocol.NewPkt(protocol.RepSecret, rPayload)
+	if err := rPkt.SendToConn(cArrs.Conn); err != nil {
+		return "", fmt.Errorf("reply secret service %w", phaseErr(phaseBind, err))
+	}
+	return name, nil
+}
+
+// logHandshakeErr log handshake error, timeout is logged with its phase
+func (s *ProxyServer) logHandshakeErr(ctx context.Context, conn connection.Connection, err error) {
+	cArrs := conn.GetArrs()
+	fields := logger.Fields{
+		logger.FieldUID:        cArrs.UID,
+		logger.FieldRemoteAddr: cArrs.Conn.RemoteAddr().String(),
+	}
+	var tErr *phaseTimeoutError
+	if errors.As(err, &tErr) {
+		s.log.Warn(ctx, "handshake timeout", fields, logger.Fields{logger.FieldPhase: tErr.phase})
+		return
+	}
+	s.log.Error(ctx, "handshake failed", fields, logger.Fields{logger.FieldError: err})
+}
+
+// serveConn serve conn from handshake to close, ctx traces the session
+func (s *ProxyServer) serveConn(ctx context.Context, conn connection.Connection) {
+	ctx, span := telemetry.Start(ctx, "accept", telemetry.AttrRemoteAddr.String(conn.GetArrs().Conn.RemoteAddr().String()))
+	defer span.End()
+
+	handshaking := s.handshakeSem != nil
+	releaseHandshake := func() {
+		if handshaking {
+			handshaking = false
+			<-s.handshakeSem
+		}
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			ctx := utils.NewTraceContext()
+			releaseHandshake()
 			cArrs := conn.GetArrs()
 
-			logger.Error(ctx, fmt.Sprintf("server connection [%s] error", cArrs.Conn.RemoteAddr().String()))
-			logger.Error(ctx, string(debug.Stack()))
+			s.log.Error(ctx, "server connection error", logger.Fields{
+				logger.FieldUID:        cArrs.UID,
+				logger.FieldRemoteAddr: cArrs.Conn.RemoteAddr().String(),
+				logger.FieldError:      fmt.Sprintf("%v\n%s", r, debug.Stack()),
+			})
+			span.SetStatus(codes.Error, fmt.Sprint(r))
 
-			delete(s.authedConn, cArrs.AuthCtx)
 			conn.Close()
 			return
 		}
 	}()
 
-	ctx := utils.NewTraceContext()
 	// Auth
-	authCtx, err := s.auth(conn)
+	aCtx, aSpan := telemetry.Start(ctx, "auth")
+	authCtx, err := s.auth(aCtx, conn)
+	releaseHandshake()
+	aSpan.SetAttributes(telemetry.AttrUID.String(conn.GetArrs().UID))
+	telemetry.End(aSpan, err)
 	if err != nil {
-		logger.Error(ctx, err.Error())
+		s.logHandshakeErr(ctx, conn, err)
+		// Refusal is delayed after handshake slot released, so slow
+		// failures can't hold the slots
+		s.replyRefusal(conn, err)
 		panic(err)
 	}
 
 	// For proxy connection, do io switch
 	cArrs := conn.GetArrs()
-	if cArrs.ProxyConn {
+	span.SetAttributes(telemetry.AttrUID.String(cArrs.UID))
+	if cArrs.ProxyConn || cArrs.VisitorConn {
+		cArrs.Conn.SetDeadline(time.Time{})
 		aConn := s.getAuthedConn(authCtx)
-		if aConn != nil {
+		if aConn == nil {
+			conn.Close()
+			return
+		}
+
+		if cArrs.ProxyConn {
 			aConn.NewPConn(cArrs.Conn)
+		} else {
+			aConn.NewVisitor(ctx, cArrs.Conn)
 		}
 		return
 	}
 
-	// For negotation connection bind then proxy
-	bPort, err := s.bind(conn)
+	s.addAuthedConn(authCtx, conn)
+	defer s.delAuthedConn(authCtx)
+
+	// Disconnect session and its streams when credential expires
+	s.watchExpiry(ctx, authCtx, conn)
+
+	// For negotation connection bind then proxy, or register secret service
+	bCtx, bSpan := telemetry.Start(ctx, "bind")
+	pkt, err := s.negotiate(conn)
 	if err != nil {
-		logger.Error(ctx, err.Error())
+		telemetry.End(bSpan, err)
+		s.logHandshakeErr(ctx, conn, err)
 		panic(err)
 	}
-	err = conn.BindAndProxy(bPort)
+
+	if pkt.GetPCode() == protocol.ReqSecret {
+		name, err := s.register(bCtx, conn, pkt)
+		bSpan.SetAttributes(telemetry.AttrService.String(name))
+		telemetry.End(bSpan, err)
+		if err != nil {
+			s.logHandshakeErr(ctx, conn, err)
+			panic(err)
+		}
+		cArrs.Conn.SetDeadline(time.Time{})
+		fields := logger.Fields{
+			logger.FieldService:    name,
+			logger.FieldUID:        cArrs.UID,
+			logger.FieldRemoteAddr: cArrs.Conn.RemoteAddr().String(),
+		}
+		s.log.Info(ctx, "secret service registered", fields)
+
+		err = conn.Monitor()
+		s.log.Info(ctx, "secret service unregistered", fields)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if pkt.GetPCode() == protocol.ReqForward {
+		tConn, err := s.forward(conn, pkt)
+		bSpan.SetAttributes(telemetry.AttrTarget.String(pkt.GetPayload().String()))
+		telemetry.End(bSpan, err)
+		if err != nil {
+			s.logHandshakeErr(ctx, conn, err)
+			panic(err)
+		}
+		cArrs.Conn.SetDeadline(time.Time{})
+		s.log.Debug(ctx, "forward", logger.Fields{
+			logger.FieldUID:        cArrs.UID,
+			logger.FieldRemoteAddr: cArrs.Conn.RemoteAddr().String(),
+			logger.FieldTarget:     tConn.RemoteAddr().String(),
+		})
+		conn.Forward(ctx, tConn)
+		return
+	}
+
+	bPort, err := s.bind(bCtx, conn, pkt)
+	bSpan.SetAttributes(telemetry.AttrBindPort.Int(bPort))
+	telemetry.End(bSpan, err)
+	if err != nil {
+		s.logHandshakeErr(ctx, conn, err)
+		panic(err)
+	}
+	cArrs.Conn.SetDeadline(time.Time{})
+	err = conn.BindAndProxy(ctx, bPort)
 	if err != nil {
-		logger.Error(ctx, err.Error())
+		s.log.Error(ctx, "bind and proxy", logger.Fields{
+			logger.FieldUID:      cArrs.UID,
+			logger.FieldBindPort: bPort,
+			logger.FieldError:    err,
+		})
 		panic(err)
 	}
 }
@@ -254,12 +921,41 @@ func (s *ProxyServer) serve() error {
 		ctx := utils.NewTraceContext()
 		conn, err := s.ln.Accept()
 		if err != nil {
-			logger.Error(ctx, err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.log.Error(ctx, "accept connection", logger.Fields{logger.FieldError: err})
+			continue
+		}
+
+		if s.guard != nil && s.guard.banned(remoteIP(conn)) {
+			s.log.Debug(ctx, "refuse banned connection", logger.Fields{logger.FieldRemoteAddr: conn.RemoteAddr().String()})
+			conn.Close()
 			continue
 		}
 
-		var c connection.Connection = connection.NewServerConnection(conn)
-		go s.serveConn(c)
+		if s.handshakeSem != nil {
+			select {
+			case s.handshakeSem <- struct{}{}:
+			default:
+				s.log.Warn(ctx, "too many unauthenticated connections, drop", logger.Fields{logger.FieldRemoteAddr: conn.RemoteAddr().String()})
+				conn.Close()
+				continue
+			}
+		}
+
+		cOpts := []connection.SOption{
+			connection.IdleTimeout(s.idleTimeout),
+			connection.ServerLogger(s.log),
+		}
+		if s.access != nil {
+			cOpts = append(cOpts, connection.AccessLog(s.access))
+		}
+		if s.webhook != nil && s.webhook.policy.Visitors {
+			cOpts = append(cOpts, connection.Admit(s.webhook.admit))
+		}
+		var c connection.Connection = connection.NewServerConnection(conn, cOpts...)
+		go s.serveConn(ctx, c)
 	}
 }
 
@@ -267,12 +963,19 @@ func (s *ProxyServer) serve() error {
 func (s *ProxyServer) Launch() error {
 	// Listen port and serve
 	ctx := utils.NewTraceContext()
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	ep := s.listen
+	if ep == nil {
+		ep = transport.TCP(fmt.Sprintf(":%d", s.port))
+	}
+	ln, err := ep.Listen()
 	if err != nil {
-		logger.Error(ctx, fmt.Sprintf("Listen port %d %s", s.port, err.Error()))
+		s.log.Error(ctx, "listen", logger.Fields{"address": ep.String(), logger.FieldError: err})
 		return err
 	}
 	s.ln = ln
+	if s.maxHandshakes > 0 {
+		s.handshakeSem = make(chan struct{}, s.maxHandshakes)
+	}
 
 	// Serve
 	return s.serve()
@@ -280,4 +983,7 @@ func (s *ProxyServer) Launch() error {
 
 func (s *ProxyServer) Stop() {
 	s.ln.Close()
+	if s.access != nil {
+		s.access.Close()
+	}
 }
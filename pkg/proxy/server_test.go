@@ -1,13 +1,17 @@
 package proxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"bou.ke/monkey"
 	"github.com/golang/mock/gomock"
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
 	"github.com/lucheng0127/narwhal/mocks/mock_connection"
 	"github.com/lucheng0127/narwhal/mocks/mock_net"
 	"github.com/lucheng0127/narwhal/mocks/mock_protocol"
@@ -28,7 +32,18 @@ func TestNewProxyServer(t *testing.T) {
 		{
 			name: "default port",
 			args: args{},
-			want: &ProxyServer{port: 8888},
+			want: &ProxyServer{
+				port:          8888,
+				helloTimeout:  DefaultHelloTimeout,
+				authTimeout:   DefaultAuthTimeout,
+				bindTimeout:   DefaultBindTimeout,
+				maxHandshakes: DefaultMaxHandshakes,
+				store:         NewStaticUserStore(nil),
+				guard:         newAuthGuard(DefaultGuardPolicy),
+				authedConn:    map[string]connection.Connection{},
+				secrets:       map[string]*secretService{},
+				log:           logger.Default(),
+			},
 		},
 		{
 			name: "port user configured",
@@ -38,7 +53,18 @@ func TestNewProxyServer(t *testing.T) {
 					Users(map[string]string{"user": "0"}),
 				},
 			},
-			want: &ProxyServer{port: 8001, users: map[string]string{"user": "0"}},
+			want: &ProxyServer{
+				port:          8001,
+				store:         NewStaticUserStore(map[string]string{"user": "0"}),
+				helloTimeout:  DefaultHelloTimeout,
+				authTimeout:   DefaultAuthTimeout,
+				bindTimeout:   DefaultBindTimeout,
+				maxHandshakes: DefaultMaxHandshakes,
+				guard:         newAuthGuard(DefaultGuardPolicy),
+				authedConn:    map[string]connection.Connection{},
+				secrets:       map[string]*secretService{},
+				log:           logger.Default(),
+			},
 		},
 	}
 	for _, tt := range tests {
@@ -71,9 +97,10 @@ func TestProxyServer_Launch(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 
@@ -184,6 +211,28 @@ func TestProxyServer_availabledPort(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "port and range ok",
+			fields: fields{
+				users: map[string]string{"user": "22,8000-8100"},
+			},
+			args: args{
+				authCtx: "user",
+				port:    8050,
+			},
+			want: true,
+		},
+		{
+			name: "port and range not ok",
+			fields: fields{
+				users: map[string]string{"user": "22,8000-8100"},
+			},
+			args: args{
+				authCtx: "user",
+				port:    80,
+			},
+			want: false,
+		},
 		{
 			name: "user not exist",
 			fields: fields{
@@ -243,9 +292,10 @@ func TestProxyServer_availabledPort(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 			if got := s.availabledPort(tt.args.authCtx, tt.args.port); got != tt.want {
@@ -287,9 +337,10 @@ func TestProxyServer_getUserByUid(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 			if got := s.getUserByUid(tt.args.uid); got != tt.want {
@@ -299,6 +350,27 @@ func TestProxyServer_getUserByUid(t *testing.T) {
 	}
 }
 
+func TestProxyServer_Reload(t *testing.T) {
+	s := &ProxyServer{
+		store:    NewStaticUserStore(map[string]string{"user": "0", "removed": "22"}),
+		forwards: map[string][]string{"user": {"10.0.0.5:5432"}},
+	}
+	s.Reload([]User{{Uid: "user", Ports: "80"}, {Uid: "added", Ports: "22"}}, nil)
+
+	if len(s.getUserByUid("removed")) != 0 {
+		t.Error("removed user still available")
+	}
+	if s.getUserByUid("added") != "added" {
+		t.Error("added user not available")
+	}
+	if s.availabledPort("user", 22) || !s.availabledPort("user", 80) {
+		t.Error("ports of user not reloaded")
+	}
+	if s.availabledTarget("user", "10.0.0.5:5432") {
+		t.Error("forwards not reloaded")
+	}
+}
+
 func TestProxyServer_getAuthedConn(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -333,9 +405,10 @@ func TestProxyServer_getAuthedConn(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 			if got := s.getAuthedConn(tt.args.authCtx); !reflect.DeepEqual(got, tt.want) {
@@ -353,6 +426,9 @@ func TestProxyServer_auth(t *testing.T) {
 	mockNetAddr := mock_net.NewMockAddr(mockCtrl)
 	mockNetConn := mock_net.NewMockConn(mockCtrl)
 	mockNetConn.EXPECT().Write(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetDeadline(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetReadDeadline(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetWriteDeadline(gomock.Any()).AnyTimes()
 	mockNetConn.EXPECT().RemoteAddr().AnyTimes().Return(mockNetAddr)
 	mockNetAddr.EXPECT().String().AnyTimes().Return("127.0.0.1:51111")
 	mockArrs := connection.Arrs{Conn: mockNetConn}
@@ -411,7 +487,7 @@ func TestProxyServer_auth(t *testing.T) {
 				},
 			},
 			args:    args{conn: mockConn},
-			want:    "",
+			want:    mockUuid.String(),
 			wantErr: false,
 		},
 		{
@@ -442,9 +518,10 @@ func TestProxyServer_auth(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 
@@ -458,7 +535,7 @@ func TestProxyServer_auth(t *testing.T) {
 			} else if tt.name == "auth ok" {
 				mockPkt.EXPECT().GetPCode().Return(protocol.ReqAuth)
 				mockPkt.EXPECT().GetPayload().Return(mockPayload)
-				mockPayload.EXPECT().String().Return("user")
+				mockPayload.EXPECT().Fields().Return([]string{"user"})
 
 				monkey.Patch(
 					protocol.ReadFromConn,
@@ -473,7 +550,7 @@ func TestProxyServer_auth(t *testing.T) {
 			} else if tt.name == "auth not ok" {
 				mockPkt.EXPECT().GetPCode().Return(protocol.ReqAuth)
 				mockPkt.EXPECT().GetPayload().Return(mockPayload)
-				mockPayload.EXPECT().String().Return("user1")
+				mockPayload.EXPECT().Fields().Return([]string{"user1"})
 
 				monkey.Patch(
 					protocol.ReadFromConn,
@@ -531,7 +608,7 @@ func TestProxyServer_auth(t *testing.T) {
 				})
 			}
 
-			got, err := s.auth(tt.args.conn)
+			got, err := s.auth(context.Background(), tt.args.conn)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ProxyServer.auth() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -550,6 +627,9 @@ func TestProxyServer_bind(t *testing.T) {
 	mockNetAddr := mock_net.NewMockAddr(mockCtrl)
 	mockNetConn := mock_net.NewMockConn(mockCtrl)
 	mockNetConn.EXPECT().Write(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetDeadline(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetReadDeadline(gomock.Any()).AnyTimes()
+	mockNetConn.EXPECT().SetWriteDeadline(gomock.Any()).AnyTimes()
 	mockNetConn.EXPECT().RemoteAddr().AnyTimes().Return(mockNetAddr)
 	mockNetAddr.EXPECT().String().AnyTimes().Return("127.0.0.1:51111")
 	mockConn := mock_connection.NewMockConnection(mockCtrl)
@@ -622,9 +702,10 @@ func TestProxyServer_bind(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &ProxyServer{
+				log:        logger.Default(),
 				port:       tt.fields.port,
 				ln:         tt.fields.ln,
-				users:      tt.fields.users,
+				store:      NewStaticUserStore(tt.fields.users),
 				authedConn: tt.fields.authedConn,
 			}
 
@@ -679,7 +760,11 @@ func TestProxyServer_bind(t *testing.T) {
 				)
 			}
 
-			got, err := s.bind(tt.args.conn)
+			got := -1
+			pkt, err := s.negotiate(tt.args.conn)
+			if err == nil {
+				got, err = s.bind(context.Background(), tt.args.conn, pkt)
+			}
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ProxyServer.bind() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -690,3 +775,407 @@ func TestProxyServer_bind(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyServer_handshakeTimeout(t *testing.T) {
+	monkey.UnpatchAll()
+
+	tests := []struct {
+		name  string
+		phase string
+	}{
+		{
+			name:  "hello timeout",
+			phase: phaseHello,
+		},
+		{
+			name:  "bind timeout",
+			phase: phaseBind,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ProxyServer{
+				log:          logger.Default(),
+				helloTimeout: 50 * time.Millisecond,
+				bindTimeout:  50 * time.Millisecond,
+			}
+			sConn, cConn := net.Pipe()
+			defer cConn.Close()
+			conn := connection.NewServerConnection(sConn)
+
+			// Client connected but never send request
+			var err error
+			if tt.phase == phaseHello {
+				_, err = s.auth(context.Background(), conn)
+			} else {
+				_, err = s.negotiate(conn)
+			}
+
+			var tErr *phaseTimeoutError
+			if !errors.As(err, &tErr) || tErr.phase != tt.phase {
+				t.Errorf("ProxyServer handshake error = %v, want %s timeout", err, tt.phase)
+			}
+		})
+	}
+}
+
+func TestProxyServer_authValidity(t *testing.T) {
+	monkey.UnpatchAll()
+
+	now := time.Now()
+	expire := now.Add(time.Hour).Truncate(time.Second)
+	s := NewProxyServer(StaticUsers([]User{
+		{Uid: "always", Ports: "0"},
+		{Uid: "valid", Ports: "0", Validity: Validity{NotBefore: now.Add(-time.Hour), ExpiresAt: expire}},
+		{Uid: "later", Ports: "0", Validity: Validity{NotBefore: now.Add(time.Hour)}},
+		{Uid: "expired", Ports: "0", Validity: Validity{ExpiresAt: now.Add(-time.Minute)}},
+	}), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+
+	tests := []struct {
+		name       string
+		uid        string
+		wantErr    bool
+		wantExpire time.Time
+	}{
+		{name: "without validity", uid: "always"},
+		{name: "in validity", uid: "valid", wantExpire: expire},
+		{name: "not valid yet", uid: "later", wantErr: true},
+		{name: "expired", uid: "expired", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sConn, cConn := net.Pipe()
+			defer cConn.Close()
+			conn := connection.NewServerConnection(sConn)
+			client := connection.NewClient(cConn)
+			errCh := make(chan error, 1)
+			go func() { errCh <- client.Auth(tt.uid) }()
+
+			_, err := s.auth(context.Background(), conn)
+			s.replyRefusal(conn, err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProxyServer.auth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cErr := <-errCh; (cErr != nil) != tt.wantErr {
+				t.Fatalf("Client.Auth() error = %v, wantErr %v", cErr, tt.wantErr)
+			}
+			if expire := conn.GetArrs().Expire; !tt.wantErr && !expire.Equal(tt.wantExpire) {
+				t.Errorf("expire of connection %s, want %s", expire, tt.wantExpire)
+			}
+		})
+	}
+
+	// Expired users can't bind with authenticated connections either
+	if s.availabledPort("expired", 22) || !s.availabledPort("valid", 22) {
+		t.Error("availabledPort() not match validity")
+	}
+}
+
+func TestProxyServer_expireSession(t *testing.T) {
+	monkey.UnpatchAll()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := NewProxyServer(StaticUsers([]User{
+		{Uid: "alice", Ports: "0", Validity: Validity{ExpiresAt: time.Now().Add(300 * time.Millisecond)}},
+	}), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.serveConn(context.Background(), connection.NewServerConnection(sConn))
+	}()
+
+	cConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cConn.Close()
+	client := connection.NewClient(cConn)
+	if err := client.Auth("alice"); err != nil {
+		t.Fatalf("Client.Auth() error = %v", err)
+	}
+	if err := client.Register("svc", "key"); err != nil {
+		t.Fatalf("Client.Register() error = %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not disconnected when credential expired")
+	}
+	cConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := cConn.Read(make([]byte, 1)); err == nil {
+		t.Error("client connection still open")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.authedConn) != 0 || len(s.secrets) != 0 {
+		t.Error("expired session still registered")
+	}
+}
+
+func TestProxyServer_sessionPolicy(t *testing.T) {
+	monkey.UnpatchAll()
+
+	tests := []struct {
+		name      string
+		policy    SessionPolicy
+		wantErr   error
+		wantEvict bool
+	}{
+		{name: "allow by default"},
+		{name: "reject", policy: SessionPolicy{Default: SessionReject}, wantErr: connection.ErrSessionExists},
+		{name: "replace", policy: SessionPolicy{Default: SessionReplace}, wantEvict: true},
+		{name: "user overrides default", policy: SessionPolicy{Default: SessionReplace, Users: map[string]string{"alice": SessionReject}}, wantErr: connection.ErrSessionExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			s := NewProxyServer(Users(map[string]string{"alice": "0"}), Sessions(tt.policy), Guard(GuardPolicy{BaseDelay: -1})).(*ProxyServer)
+			go func() {
+				for {
+					sConn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go s.serveConn(context.Background(), connection.NewServerConnection(sConn))
+				}
+			}()
+
+			pLn, _ := net.Listen("tcp", ":0")
+			bPort := uint16(pLn.Addr().(*net.TCPAddr).Port)
+			pLn.Close()
+			dial := func() connection.Client {
+				cConn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { cConn.Close() })
+				client := connection.NewClient(cConn)
+				if err := client.Auth("alice"); err != nil {
+					t.Fatalf("Client.Auth() error = %v", err)
+				}
+				return client
+			}
+
+			first := dial()
+			if err := first.Bind(bPort); err != nil {
+				t.Fatalf("Client.Bind() of first session error = %v", err)
+			}
+			evicted := make(chan error, 1)
+			go func() { evicted <- first.MonitorAndProxy(1) }()
+
+			err = dial().Bind(bPort)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Client.Bind() of second session error = %v, want %v", err, tt.wantErr)
+			}
+
+			select {
+			case err := <-evicted:
+				if !tt.wantEvict || !errors.Is(err, connection.ErrSessionReplaced) {
+					t.Fatalf("first session closed with %v, want evict %v", err, tt.wantEvict)
+				}
+			case <-time.After(300 * time.Millisecond):
+				if tt.wantEvict {
+					t.Fatal("first session not replaced")
+				}
+			}
+			if !tt.wantEvict {
+				return
+			}
+
+			// Port is handed over to the second session
+			var vErr error
+			for i := 0; i < 20; i++ {
+				var vConn net.Conn
+				if vConn, vErr = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bPort)); vErr == nil {
+					vConn.Close()
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if vErr != nil {
+				t.Errorf("port not bound by the second session, %v", vErr)
+			}
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			if len(s.sessions) != 1 {
+				t.Errorf("sessions %d, want the second one only", len(s.sessions))
+			}
+		})
+	}
+}
+
+func TestProxyServer_authFailureDelay(t *testing.T) {
+	monkey.UnpatchAll()
+
+	delay := 500 * time.Millisecond
+	s := launchTestServer(t, Users(map[string]string{"alice": "0"}), MaxHandshakes(1),
+		Guard(GuardPolicy{MaxFailures: 2, BaseDelay: delay}))
+	addr := s.ln.Addr().String()
+
+	// Refusal is replied after delay
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	start := time.Now()
+	refusedCh := make(chan error)
+	go func() {
+		refusedCh <- connection.NewClient(refused).Auth("mallory")
+	}()
+
+	// Handshake slot is released while the refusal is delayed
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := connection.NewClient(conn).Auth("alice"); err != nil {
+		t.Errorf("Client.Auth() during delay of refused conn error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("Client.Auth() during delay of refused conn took %s, want less than %s", elapsed, delay)
+	}
+
+	if err := <-refusedCh; err == nil {
+		t.Fatal("Client.Auth() of unknown user succeed")
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("refusal replied after %s, want no earlier than %s", elapsed, delay)
+	}
+
+	// Proxy connections of a staled auth ctx are not auth failures
+	for i := 0; i < 2; i++ {
+		pConn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		protocol.NewPkt(protocol.ReqPConn, []byte(uuid.NewV4().String())).SendToConn(pConn)
+		pkt, err := protocol.ReadFromConn(pConn)
+		pConn.Close()
+		if err != nil || pkt.GetPayload().Byte() != protocol.RetFailed {
+			t.Fatalf("staled proxy connection reply %v error %v, want failed", pkt, err)
+		}
+	}
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %v after staled proxy connections, want empty", bans)
+	}
+}
+
+func TestProxyServer_reloadSessions(t *testing.T) {
+	monkey.UnpatchAll()
+
+	// Dave and erin expire soon, until their validity is extended on reload
+	soon := time.Now().Add(500 * time.Millisecond)
+	s := launchTestServer(t, StaticUsers([]User{
+		{Uid: "alice", Ports: "0"},
+		{Uid: "bob", Ports: "0"},
+		{Uid: "carol", Ports: "0"},
+		{Uid: "dave", Ports: "0", Validity: Validity{ExpiresAt: soon}},
+		{Uid: "erin", Ports: "0", Validity: Validity{ExpiresAt: soon}},
+	}), Guard(GuardPolicy{BaseDelay: -1}))
+
+	// closed report when server disconnects the session of uid
+	closed := make(map[string]chan struct{})
+	for _, uid := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		cConn, err := net.Dial("tcp", s.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cConn.Close()
+		client := connection.NewClient(cConn)
+		if err := client.Auth(uid); err != nil {
+			t.Fatalf("Client.Auth() of %s error = %v", uid, err)
+		}
+		if err := client.Register("svc-"+uid, "key"); err != nil {
+			t.Fatalf("Client.Register() of %s error = %v", uid, err)
+		}
+		ch := make(chan struct{})
+		closed[uid] = ch
+		go func() {
+			cConn.Read(make([]byte, 1))
+			close(ch)
+		}()
+	}
+
+	expire := time.Now().Add(300 * time.Millisecond)
+	s.Reload([]User{
+		{Uid: "bob", Ports: "0", Validity: Validity{ExpiresAt: expire}},
+		{Uid: "carol", Ports: "0"},
+		{Uid: "dave", Ports: "0"},
+		{Uid: "erin", Ports: "0", Validity: Validity{ExpiresAt: time.Now().Add(time.Hour)}},
+	}, nil)
+
+	select {
+	case <-closed["alice"]:
+	case <-time.After(time.Second):
+		t.Error("session of removed user not disconnected on reload")
+	}
+	select {
+	case <-closed["bob"]:
+		if time.Now().Before(expire) {
+			t.Error("session of shortened user disconnected before expire")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("session of shortened user not disconnected at expire")
+	}
+	select {
+	case <-closed["carol"]:
+		t.Error("session of unchanged user disconnected")
+	default:
+	}
+
+	// Sessions of extended users outlive the validity they authenticated with
+	time.Sleep(time.Until(soon) + 200*time.Millisecond)
+	for _, uid := range []string{"dave", "erin"} {
+		select {
+		case <-closed[uid]:
+			t.Errorf("session of extended user %s disconnected at old expire", uid)
+		default:
+		}
+	}
+}
+
+func TestSessionExpiry_rearm(t *testing.T) {
+	now := time.Now()
+	key := now.Add(time.Hour)
+	tests := []struct {
+		name   string
+		key    time.Time
+		expire time.Time
+		want   time.Time
+	}{
+		{name: "extended", expire: now.Add(2 * time.Hour), want: now.Add(2 * time.Hour)},
+		{name: "never", want: time.Time{}},
+		{name: "key expires earlier", key: key, expire: now.Add(2 * time.Hour), want: key},
+		{name: "key expires, user never", key: key, want: key},
+		{name: "user expires earlier than key", key: key, expire: now.Add(time.Minute), want: now.Add(time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &sessionExpiry{key: tt.key}
+			e.arm(now.Add(30 * time.Minute))
+			defer e.stop()
+
+			e.rearm(tt.expire)
+			if !e.expire.Equal(tt.want) {
+				t.Errorf("expire after rearm %s, want %s", e.expire, tt.want)
+			}
+		})
+	}
+}
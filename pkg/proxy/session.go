@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+	"github.com/lucheng0127/narwhal/pkg/protocol"
+)
+
+// Session policies, what happens when a uid binds a port or registers a
+// secret service while its previous session is alive
+const (
+	SessionAllow   = "allow"   // Sessions coexist, they may fail to bind the same port
+	SessionReject  = "reject"  // The new session is refused with RetSessionExists
+	SessionReplace = "replace" // The old session is closed with RepEvict, its ports are handed over
+)
+
+// SessionPolicy is the session policy of server, Users override Default for
+// uids, empty means SessionAllow
+type SessionPolicy struct {
+	Default string
+	Users   map[string]string // uid: policy
+}
+
+// ValidateSessionPolicy check policy is allow, reject or replace
+func ValidateSessionPolicy(policy string) error {
+	switch policy {
+	case "", SessionAllow, SessionReject, SessionReplace:
+		return nil
+	}
+	return fmt.Errorf("session policy [%s] not %s, %s or %s", policy, SessionAllow, SessionReject, SessionReplace)
+}
+
+// of return policy of uid
+func (p SessionPolicy) of(uid string) string {
+	if policy, ok := p.Users[uid]; ok && len(policy) != 0 {
+		return policy
+	}
+	if len(p.Default) == 0 {
+		return SessionAllow
+	}
+	return p.Default
+}
+
+// session is an authenticated connection bound a port or registered a
+// secret service, done is closed when its connection finished
+type session struct {
+	uid      string
+	conn     connection.Connection
+	raw      net.Conn // Taken on claim, arrs of conn change while proxying
+	done     chan struct{}
+	replaced bool // Closing by a new session of the same uid
+}
+
+// errSessionExists is returned when session refused by SessionReject
+var errSessionExists = errors.New("session of uid exists")
+
+// SetSessionPolicy replace session policy, it takes effect on following
+// binds and registrations
+func (s *ProxyServer) SetSessionPolicy(policy SessionPolicy) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	s.sessionPolicy = policy
+}
+
+// claimSession apply session policy of uid to conn binding or registering,
+// it returns the result code replied on success, RetReplaced when previous
+// sessions were replaced, they are closed before return so their ports
+// can be bound. The session is released by delAuthedConn
+func (s *ProxyServer) claimSession(ctx context.Context, conn connection.Connection) (byte, error) {
+	cArrs := conn.GetArrs()
+	s.usersMu.RLock()
+	policy := s.sessionPolicy.of(cArrs.UID)
+	s.usersMu.RUnlock()
+
+	s.mu.Lock()
+	var olds []*session
+	for _, sess := range s.sessions {
+		if sess.uid == cArrs.UID && !sess.replaced {
+			olds = append(olds, sess)
+		}
+	}
+	if len(olds) != 0 && policy == SessionReject {
+		s.mu.Unlock()
+		return protocol.RetSessionExists, errSessionExists
+	}
+	if policy == SessionReplace {
+		for _, old := range olds {
+			old.replaced = true
+		}
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*session)
+	}
+	s.sessions[cArrs.AuthCtx] = &session{uid: cArrs.UID, conn: conn, raw: cArrs.Conn, done: make(chan struct{})}
+	s.mu.Unlock()
+
+	if policy != SessionReplace || len(olds) == 0 {
+		return protocol.RetSucceed, nil
+	}
+	for _, old := range olds {
+		s.log.Info(ctx, "session replaced", logger.Fields{
+			logger.FieldUID:        old.uid,
+			logger.FieldRemoteAddr: old.raw.RemoteAddr().String(),
+		})
+		// Tell the old client why before closing, it may be busy with
+		// other writes, don't wait long
+		old.raw.SetWriteDeadline(deadline(time.Second))
+		protocol.NewPkt(protocol.RepEvict, []byte{protocol.RetReplaced}).SendToConn(old.raw)
+		old.conn.Terminate()
+	}
+	wait := s.bindTimeout
+	if wait <= 0 {
+		wait = DefaultBindTimeout
+	}
+	timeout := time.After(wait)
+	for _, old := range olds {
+		select {
+		case <-old.done:
+		case <-timeout:
+			return protocol.RetFailed, errors.New("wait replaced session closed timeout")
+		}
+	}
+	return protocol.RetReplaced, nil
+}
+
+// releaseSession remove session of authCtx, caller must hold s.mu
+func (s *ProxyServer) releaseSession(authCtx string) {
+	if sess, ok := s.sessions[authCtx]; ok {
+		delete(s.sessions, authCtx)
+		close(sess.done)
+	}
+}
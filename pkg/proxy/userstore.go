@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchUser is returned by user managers when uid not exist
+var ErrNoSuchUser = errors.New("no such user")
+
+// ErrUserExists is returned by user managers when adding uid exists
+var ErrUserExists = errors.New("user exists")
+
+// ErrNotYetValid is returned when a credential is used before its not before
+var ErrNotYetValid = errors.New("credential not valid yet")
+
+// ErrExpired is returned when a credential is used after it expired
+var ErrExpired = errors.New("credential expired")
+
+// Validity is the time range a credential can be used in, zero time means
+// unbounded. Sessions authenticated with it are closed when it expires
+type Validity struct {
+	NotBefore time.Time
+	ExpiresAt time.Time
+}
+
+// check return ErrNotYetValid or ErrExpired when not valid at now
+func (v Validity) check(now time.Time) error {
+	if !v.NotBefore.IsZero() && now.Before(v.NotBefore) {
+		return fmt.Errorf("%w, valid from %s", ErrNotYetValid, v.NotBefore.Format(time.RFC3339))
+	}
+	if !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt) {
+		return fmt.Errorf("%w at %s", ErrExpired, v.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// validate check not before is earlier than expires at
+func (v Validity) validate() error {
+	if !v.NotBefore.IsZero() && !v.ExpiresAt.IsZero() && !v.NotBefore.Before(v.ExpiresAt) {
+		return errors.New("expires at not later than not before")
+	}
+	return nil
+}
+
+// User is a user can authenticate to server
+//
+// Uid: id of user sent by client
+// Ports: port spec of ports user can bind, see availabledPort for format
+// Validity: when user can authenticate, always when zero
+type User struct {
+	Uid   string
+	Ports string
+	Validity
+}
+
+// UserStore look up users authenticating to server, it is called for each
+// auth and bind request, so it must be safe for concurrent use
+//
+// Lookup: return user of uid, nil without error when no such user
+// AvailablePort: whether user uid can bind port
+type UserStore interface {
+	Lookup(uid string) (*User, error)
+	AvailablePort(uid string, port int) (bool, error)
+}
+
+// UserManager is a user store can be changed at runtime, changes take
+// effect on following requests without reload
+//
+// AddUser: add user, ErrUserExists when uid exists
+// RemoveUser: remove user, ErrNoSuchUser when uid not exist
+// SetPorts: replace ports of user, ErrNoSuchUser when uid not exist
+// ListUsers: users sorted by uid
+// Close: release resources of store
+type UserManager interface {
+	UserStore
+	AddUser(user User) error
+	RemoveUser(uid string) error
+	SetPorts(uid, ports string) error
+	ListUsers() ([]User, error)
+	Close() error
+}
+
+// availabledPortOf check port with ports of user returned by lookup, users
+// out of validity can't bind
+func availabledPortOf(lookup func(string) (*User, error), uid string, port int) (bool, error) {
+	user, err := lookup(uid)
+	if err != nil || user == nil {
+		return false, err
+	}
+	if user.check(time.Now()) != nil {
+		return false, nil
+	}
+	return portInSpec(user.Ports, port), nil
+}
+
+// validateUser check uid, port spec and validity of user
+func validateUser(user User) error {
+	if len(strings.TrimSpace(user.Uid)) == 0 {
+		return errors.New("uid is empty")
+	}
+	if err := ValidatePortSpec(user.Ports); err != nil {
+		return fmt.Errorf("user [%s] %s", user.Uid, err.Error())
+	}
+	if err := user.Validity.validate(); err != nil {
+		return fmt.Errorf("user [%s] %s", user.Uid, err.Error())
+	}
+	return nil
+}
+
+// StaticUserStore is the users of config
+type StaticUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// NewStaticUserStore return store of users, uid: port spec
+func NewStaticUserStore(users map[string]string) *StaticUserStore {
+	s := new(StaticUserStore)
+	s.Set(users)
+	return s
+}
+
+// Set replace users of store with users without validity, uid: port spec
+func (s *StaticUserStore) Set(users map[string]string) {
+	list := make([]User, 0, len(users))
+	for uid, ports := range users {
+		list = append(list, User{Uid: uid, Ports: ports})
+	}
+	s.SetUsers(list)
+}
+
+// SetUsers replace users of store
+func (s *StaticUserStore) SetUsers(users []User) {
+	m := make(map[string]User, len(users))
+	for _, u := range users {
+		m[u.Uid] = u
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users = m
+}
+
+func (s *StaticUserStore) Lookup(uid string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[uid]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+func (s *StaticUserStore) AvailablePort(uid string, port int) (bool, error) {
+	return availabledPortOf(s.Lookup, uid, port)
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// userFileExts are extensions of user files, json is parsed as yaml
+var userFileExts = []string{".yaml", ".yml", ".json"}
+
+func isUserFileExt(ext string) bool {
+	for _, e := range userFileExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// userFile is content of a user file
+type userFile struct {
+	Ports     string    `yaml:"ports"`
+	NotBefore time.Time `yaml:"notBefore,omitempty"`
+	ExpiresAt time.Time `yaml:"expiresAt,omitempty"`
+}
+
+// DirUserStore keep each user in a file of directory, named by uid with
+// extension yaml, yml or json, e.g. alice.yaml:
+//
+//	ports: 22,80
+//	expiresAt: 2024-06-01T18:00:00Z
+//
+// Files are read for each lookup, so users added or removed take effect
+// without reload
+type DirUserStore struct {
+	dir string
+	mu  sync.Mutex // Serialize changes
+}
+
+// NewDirUserStore return store of users in dir, dir is created if not exist
+func NewDirUserStore(dir string) (*DirUserStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create user dir %s", err.Error())
+	}
+	return &DirUserStore{dir: dir}, nil
+}
+
+// validUidFile check uid can be used as file name, uid sent by client must
+// not escape the directory
+func validUidFile(uid string) bool {
+	return len(uid) != 0 && !strings.HasPrefix(uid, ".") && !strings.ContainsAny(uid, "/\\\x00")
+}
+
+// file return path of user file of uid, empty if not exist
+func (s *DirUserStore) file(uid string) (string, error) {
+	if !validUidFile(uid) {
+		return "", nil
+	}
+	for _, ext := range userFileExts {
+		path := filepath.Join(s.dir, uid+ext)
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func readUserFile(path string) (*userFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	uf := new(userFile)
+	if err := yaml.Unmarshal(data, uf); err != nil {
+		return nil, fmt.Errorf("parse user file %s %s", path, err.Error())
+	}
+	return uf, nil
+}
+
+func (s *DirUserStore) Lookup(uid string) (*User, error) {
+	path, err := s.file(uid)
+	if err != nil || len(path) == 0 {
+		return nil, err
+	}
+	uf, err := readUserFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed after found
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &User{Uid: uid, Ports: uf.Ports, Validity: Validity{NotBefore: uf.NotBefore, ExpiresAt: uf.ExpiresAt}}, nil
+}
+
+func (s *DirUserStore) AvailablePort(uid string, port int) (bool, error) {
+	return availabledPortOf(s.Lookup, uid, port)
+}
+
+// writeUserFile write user file of user atomically
+func (s *DirUserStore) writeUserFile(path string, user User) error {
+	data, err := yaml.Marshal(&userFile{Ports: user.Ports, NotBefore: user.NotBefore, ExpiresAt: user.ExpiresAt})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".user.tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DirUserStore) AddUser(user User) error {
+	if err := validateUser(user); err != nil {
+		return err
+	}
+	if !validUidFile(user.Uid) {
+		return fmt.Errorf("uid [%s] can't be used as file name", user.Uid)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.file(user.Uid)
+	if err != nil {
+		return err
+	}
+	if len(path) != 0 {
+		return fmt.Errorf("%w [%s]", ErrUserExists, user.Uid)
+	}
+	return s.writeUserFile(filepath.Join(s.dir, user.Uid+".yaml"), user)
+}
+
+func (s *DirUserStore) RemoveUser(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.file(uid)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("%w [%s]", ErrNoSuchUser, uid)
+	}
+	return os.Remove(path)
+}
+
+func (s *DirUserStore) SetPorts(uid, ports string) error {
+	if err := validateUser(User{Uid: uid, Ports: ports}); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.file(uid)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("%w [%s]", ErrNoSuchUser, uid)
+	}
+	uf, err := readUserFile(path)
+	if err != nil {
+		return err
+	}
+	return s.writeUserFile(path, User{Uid: uid, Ports: ports, Validity: Validity{NotBefore: uf.NotBefore, ExpiresAt: uf.ExpiresAt}})
+}
+
+func (s *DirUserStore) ListUsers() ([]User, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		uid := strings.TrimSuffix(e.Name(), ext)
+		if e.IsDir() || !isUserFileExt(ext) || !validUidFile(uid) || seen[uid] {
+			continue
+		}
+		// The same uid with multi extensions, use the one looked up
+		user, err := s.Lookup(uid)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			continue
+		}
+		seen[uid] = true
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Uid < users[j].Uid
+	})
+	return users, nil
+}
+
+func (s *DirUserStore) Close() error {
+	return nil
+}
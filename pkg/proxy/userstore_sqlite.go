@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Validity of users is kept in unix seconds, 0 means unbounded
+const sqliteUsersSchema = `CREATE TABLE IF NOT EXISTS users (
+	uid        TEXT PRIMARY KEY,
+	ports      TEXT NOT NULL,
+	not_before INTEGER NOT NULL DEFAULT 0,
+	expires_at INTEGER NOT NULL DEFAULT 0
+)`
+
+// sqliteUsersColumns are columns added after table users created, they are
+// added to databases of older versions
+var sqliteUsersColumns = []string{
+	"not_before INTEGER NOT NULL DEFAULT 0",
+	"expires_at INTEGER NOT NULL DEFAULT 0",
+}
+
+// SQLiteUserStore keep users in table users of an embedded sqlite database
+type SQLiteUserStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteUserStore open sqlite database at path, it is created with
+// table users if not exist
+func NewSQLiteUserStore(path string) (*SQLiteUserStore, error) {
+	// Wait for writes of user commands instead of failing lookups, set in
+	// dsn so each connection of the pool has it
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("open user database %s", err.Error())
+	}
+	if _, err := db.Exec(sqliteUsersSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create table users %s", err.Error())
+	}
+	if err := migrateUsers(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate table users %s", err.Error())
+	}
+	return &SQLiteUserStore{db: db}, nil
+}
+
+// migrateUsers add columns missing in table users
+func migrateUsers(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('users')")
+	if err != nil {
+		return err
+	}
+	exist := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		exist[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range sqliteUsersColumns {
+		name, _, _ := strings.Cut(column, " ")
+		if exist[name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE users ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toUnix return unix seconds of t, 0 for zero time
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnix return time of unix seconds sec, zero time for 0
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+func (s *SQLiteUserStore) Lookup(uid string) (*User, error) {
+	user := &User{Uid: uid}
+	var notBefore, expiresAt int64
+	err := s.db.QueryRow("SELECT ports, not_before, expires_at FROM users WHERE uid = ?", uid).
+		Scan(&user.Ports, &notBefore, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.NotBefore, user.ExpiresAt = fromUnix(notBefore), fromUnix(expiresAt)
+	return user, nil
+}
+
+func (s *SQLiteUserStore) AvailablePort(uid string, port int) (bool, error) {
+	return availabledPortOf(s.Lookup, uid, port)
+}
+
+func (s *SQLiteUserStore) AddUser(user User) error {
+	if err := validateUser(user); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("INSERT INTO users (uid, ports, not_before, expires_at) VALUES (?, ?, ?, ?)",
+		user.Uid, user.Ports, toUnix(user.NotBefore), toUnix(user.ExpiresAt))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return fmt.Errorf("%w [%s]", ErrUserExists, user.Uid)
+	}
+	return err
+}
+
+// affected return ErrNoSuchUser when no row changed by res
+func affected(res sql.Result, uid string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w [%s]", ErrNoSuchUser, uid)
+	}
+	return nil
+}
+
+func (s *SQLiteUserStore) RemoveUser(uid string) error {
+	res, err := s.db.Exec("DELETE FROM users WHERE uid = ?", uid)
+	if err != nil {
+		return err
+	}
+	return affected(res, uid)
+}
+
+func (s *SQLiteUserStore) SetPorts(uid, ports string) error {
+	if err := validateUser(User{Uid: uid, Ports: ports}); err != nil {
+		return err
+	}
+	res, err := s.db.Exec("UPDATE users SET ports = ? WHERE uid = ?", ports, uid)
+	if err != nil {
+		return err
+	}
+	return affected(res, uid)
+}
+
+func (s *SQLiteUserStore) ListUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT uid, ports, not_before, expires_at FROM users ORDER BY uid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]User, 0)
+	for rows.Next() {
+		var user User
+		var notBefore, expiresAt int64
+		if err := rows.Scan(&user.Uid, &user.Ports, &notBefore, &expiresAt); err != nil {
+			return nil, err
+		}
+		user.NotBefore, user.ExpiresAt = fromUnix(notBefore), fromUnix(expiresAt)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLiteUserStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserManagers(t *testing.T) {
+	newStores := map[string]func(t *testing.T) UserManager{
+		"dir": func(t *testing.T) UserManager {
+			s, err := NewDirUserStore(filepath.Join(t.TempDir(), "users"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"sqlite": func(t *testing.T) UserManager {
+			s, err := NewSQLiteUserStore(filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+
+	for name, newStore := range newStores {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			defer s.Close()
+
+			if err := s.AddUser(User{Uid: "alice", Ports: "22,80"}); err != nil {
+				t.Fatalf("AddUser() error = %v", err)
+			}
+			if err := s.AddUser(User{Uid: "bob", Ports: "0"}); err != nil {
+				t.Fatalf("AddUser() error = %v", err)
+			}
+			if err := s.AddUser(User{Uid: "alice", Ports: "0"}); !errors.Is(err, ErrUserExists) {
+				t.Errorf("AddUser() exist user error = %v, want %v", err, ErrUserExists)
+			}
+			if err := s.AddUser(User{Uid: "carol", Ports: "22-abc"}); err == nil {
+				t.Error("AddUser() invalidate ports should fail")
+			}
+
+			user, err := s.Lookup("alice")
+			if err != nil || user == nil || user.Ports != "22,80" {
+				t.Errorf("Lookup() = %v, error %v", user, err)
+			}
+			if user, err := s.Lookup("carol"); err != nil || user != nil {
+				t.Errorf("Lookup() no such user = %v, error %v", user, err)
+			}
+			if ok, err := s.AvailablePort("alice", 80); err != nil || !ok {
+				t.Errorf("AvailablePort() = %v, error %v", ok, err)
+			}
+			if ok, err := s.AvailablePort("alice", 443); err != nil || ok {
+				t.Errorf("AvailablePort() not permitted = %v, error %v", ok, err)
+			}
+
+			if err := s.SetPorts("alice", "443"); err != nil {
+				t.Errorf("SetPorts() error = %v", err)
+			}
+			if err := s.SetPorts("carol", "443"); !errors.Is(err, ErrNoSuchUser) {
+				t.Errorf("SetPorts() no such user error = %v, want %v", err, ErrNoSuchUser)
+			}
+			if ok, _ := s.AvailablePort("alice", 443); !ok {
+				t.Error("ports not set")
+			}
+
+			expired := Validity{
+				NotBefore: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC),
+				ExpiresAt: time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC),
+			}
+			if err := s.AddUser(User{Uid: "dave", Ports: "22", Validity: expired}); err != nil {
+				t.Fatalf("AddUser() with validity error = %v", err)
+			}
+			if err := s.AddUser(User{Uid: "erin", Ports: "22", Validity: Validity{NotBefore: expired.ExpiresAt, ExpiresAt: expired.NotBefore}}); err == nil {
+				t.Error("AddUser() expires before not before should fail")
+			}
+			if err := s.SetPorts("dave", "80"); err != nil {
+				t.Errorf("SetPorts() error = %v", err)
+			}
+			if user, err := s.Lookup("dave"); err != nil || user == nil || user.Validity != expired {
+				t.Errorf("Lookup() = %+v, error %v, want validity %+v", user, err, expired)
+			}
+			if ok, err := s.AvailablePort("dave", 80); err != nil || ok {
+				t.Errorf("AvailablePort() of expired user = %v, error %v", ok, err)
+			}
+
+			if err := s.RemoveUser("bob"); err != nil {
+				t.Errorf("RemoveUser() error = %v", err)
+			}
+			if err := s.RemoveUser("bob"); !errors.Is(err, ErrNoSuchUser) {
+				t.Errorf("RemoveUser() no such user error = %v, want %v", err, ErrNoSuchUser)
+			}
+
+			users, err := s.ListUsers()
+			want := []User{{Uid: "alice", Ports: "443"}, {Uid: "dave", Ports: "80", Validity: expired}}
+			if err != nil || !reflect.DeepEqual(users, want) {
+				t.Errorf("ListUsers() = %v, error %v, want %v", users, err, want)
+			}
+		})
+	}
+}
+
+func TestSQLiteUserStore_migrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Table of versions without validity
+	_, err = db.Exec("CREATE TABLE users (uid TEXT PRIMARY KEY, ports TEXT NOT NULL); INSERT INTO users VALUES ('alice', '22')")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSQLiteUserStore(path)
+	if err != nil {
+		t.Fatalf("NewSQLiteUserStore() error = %v", err)
+	}
+	defer s.Close()
+	if user, err := s.Lookup("alice"); err != nil || user == nil || user.Ports != "22" || user.Validity != (Validity{}) {
+		t.Errorf("Lookup() = %+v, error %v", user, err)
+	}
+	expire := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	if err := s.AddUser(User{Uid: "bob", Ports: "0", Validity: Validity{ExpiresAt: expire}}); err != nil {
+		t.Fatalf("AddUser() error = %v", err)
+	}
+	if user, _ := s.Lookup("bob"); user == nil || !user.ExpiresAt.Equal(expire) {
+		t.Errorf("Lookup() = %+v, want expires at %s", user, expire)
+	}
+}
+
+func TestDirUserStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDirUserStore(filepath.Join(dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"users/alice.json": `{"ports": "22"}`,
+		"users/bob.yml":    "ports: 0\n",
+		"users/notes.txt":  "not a user\n",
+		"secret.yaml":      "ports: 0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		uid   string
+		ports string
+		found bool
+	}{
+		{name: "json", uid: "alice", ports: "22", found: true},
+		{name: "yml number ports", uid: "bob", ports: "0", found: true},
+		{name: "other extension", uid: "notes", found: false},
+		{name: "escape dir", uid: "../secret", found: false},
+		{name: "hidden", uid: ".tmp", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := s.Lookup(tt.uid)
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if (user != nil) != tt.found || (user != nil && user.Ports != tt.ports) {
+				t.Errorf("Lookup() = %v, want found %v ports %s", user, tt.found, tt.ports)
+			}
+		})
+	}
+
+	users, err := s.ListUsers()
+	if err != nil || len(users) != 2 {
+		t.Errorf("ListUsers() = %v, error %v", users, err)
+	}
+}
+
+func TestProxyServer_store(t *testing.T) {
+	store, err := NewSQLiteUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	s := NewProxyServer(Store(store)).(*ProxyServer)
+	if len(s.getUserByUid("alice")) != 0 {
+		t.Error("user found before added")
+	}
+	if err := store.AddUser(User{Uid: "alice", Ports: "8000-8100"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.getUserByUid("alice") != "alice" || !s.availabledPort("alice", 8080) {
+		t.Error("user added not available without reload")
+	}
+
+	// Users of reload are ignored by non static store
+	s.Reload([]User{{Uid: "bob", Ports: "0"}}, nil)
+	if len(s.getUserByUid("bob")) != 0 {
+		t.Error("users of reload used by sqlite store")
+	}
+}
+
+func TestSQLiteUserStore_busyTimeout(t *testing.T) {
+	s, err := NewSQLiteUserStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Hold connections so each query takes a new one of the pool
+	for i := 0; i < 3; i++ {
+		conn, err := s.db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var timeout int
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA busy_timeout").Scan(&timeout); err != nil || timeout != 5000 {
+			t.Errorf("busy_timeout of connection [%d] = %d error %v, want 5000", i, timeout, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	logger "github.com/lucheng0127/narwhal/internal/pkg/log"
+	"github.com/lucheng0127/narwhal/pkg/connection"
+)
+
+// Events webhook called on
+const (
+	WebhookAuth    = "auth"    // Client authenticating with uid
+	WebhookBind    = "bind"    // Authenticated client binding port
+	WebhookVisitor = "visitor" // Visitor connecting to bound port or secret service
+)
+
+// DefaultWebhookTimeout is how long server waits for webhook response
+const DefaultWebhookTimeout = 5 * time.Second
+
+// WebhookPolicy is the webhook deciding auth and bind instead of user store,
+// and visitors optionally
+//
+// URL: http or https url requests posted to
+// Timeout: timeout of a request, default DefaultWebhookTimeout
+// CacheTTL: how long decisions cached, 0 means no cache
+// FailOpen: allow when webhook unreachable or replies malformed, refuse
+// by default
+// Visitors: call webhook on each visitor connection
+// Headers: headers of requests, e.g. Authorization
+// Metadata: sent with each request, e.g. name of the server
+type WebhookPolicy struct {
+	URL      string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	FailOpen bool
+	Visitors bool
+	Headers  map[string]string
+	Metadata map[string]string
+}
+
+// WebhookRequest is the json body posted to webhook
+type WebhookRequest struct {
+	Event       string            `json:"event"`
+	UID         string            `json:"uid"`
+	ClientAddr  string            `json:"clientAddr"`
+	Port        int               `json:"port,omitempty"`        // Bind port of bind and visitor events
+	VisitorAddr string            `json:"visitorAddr,omitempty"` // Visitor address of visitor events
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// WebhookDecision is the json body webhook replies, overrides apply to
+// the tunnel of client when allowed on auth or bind, values of bind take
+// precedence
+//
+// RateLimit: visitor connections per second, 0 means no limit
+// MaxStreams: concurrent visitor connections, 0 means no limit
+type WebhookDecision struct {
+	Allow      bool    `json:"allow"`
+	Reason     string  `json:"reason,omitempty"`
+	RateLimit  float64 `json:"rateLimit,omitempty"`
+	MaxStreams int     `json:"maxStreams,omitempty"`
+}
+
+type webhookCacheEntry struct {
+	key      string
+	decision WebhookDecision
+	expire   time.Time
+}
+
+// webhook call webhook of policy and cache decisions
+type webhook struct {
+	policy WebhookPolicy
+	client *http.Client
+	mu     sync.Mutex // Protect cache and expiry
+	cache  map[string]webhookCacheEntry
+	expiry []webhookCacheEntry // Entries cached in order of expire, ttl is the same for all
+	log    logger.Logger
+}
+
+func newWebhook(policy WebhookPolicy) *webhook {
+	if policy.Timeout == 0 {
+		policy.Timeout = DefaultWebhookTimeout
+	}
+	return &webhook{
+		policy: policy,
+		client: &http.Client{Timeout: policy.Timeout},
+		cache:  make(map[string]webhookCacheEntry),
+		log:    logger.Default(),
+	}
+}
+
+// evict drop entries expired before now from the oldest, they are never
+// looked up again for addresses change. Caller must hold mu
+func (w *webhook) evict(now time.Time) {
+	for len(w.expiry) != 0 && now.After(w.expiry[0].expire) {
+		old := w.expiry[0]
+		w.expiry[0] = webhookCacheEntry{}
+		w.expiry = w.expiry[1:]
+		// The key may be cached again after old
+		if e, ok := w.cache[old.key]; ok && e.expire.Equal(old.expire) {
+			delete(w.cache, old.key)
+		}
+	}
+}
+
+// addrIP return ip of addr, ports of clients change for each connection so
+// they are not part of cache key
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func webhookCacheKey(req *WebhookRequest) string {
+	return fmt.Sprintf("%s|%s|%s|%d|%s", req.Event, req.UID, addrIP(req.ClientAddr),
+		req.Port, addrIP(req.VisitorAddr))
+}
+
+// decide return decision of req from cache or webhook, failures are
+// decided by FailOpen of policy and returned with the error
+func (w *webhook) decide(ctx context.Context, req WebhookRequest) (WebhookDecision, error) {
+	req.Metadata = w.policy.Metadata
+	key := webhookCacheKey(&req)
+	if w.policy.CacheTTL > 0 {
+		w.mu.Lock()
+		entry, ok := w.cache[key]
+		w.mu.Unlock()
+		if ok && time.Now().Before(entry.expire) {
+			return entry.decision, nil
+		}
+	}
+
+	decision, err := w.call(ctx, &req)
+	if err != nil {
+		w.log.Error(ctx, "call webhook", logger.Fields{
+			logger.FieldUID:   req.UID,
+			logger.FieldPhase: req.Event,
+			"fail_open":       w.policy.FailOpen,
+			logger.FieldError: err,
+		})
+		// Failures are not cached, retry on next request
+		return WebhookDecision{Allow: w.policy.FailOpen, Reason: "webhook unavailable"}, err
+	}
+
+	if w.policy.CacheTTL > 0 {
+		now := time.Now()
+		entry := webhookCacheEntry{key: key, decision: decision, expire: now.Add(w.policy.CacheTTL)}
+		w.mu.Lock()
+		w.evict(now)
+		w.cache[key] = entry
+		w.expiry = append(w.expiry, entry)
+		w.mu.Unlock()
+	}
+	return decision, nil
+}
+
+func (w *webhook) call(ctx context.Context, req *WebhookRequest) (WebhookDecision, error) {
+	var decision WebhookDecision
+	body, err := json.Marshal(req)
+	if err != nil {
+		return decision, err
+	}
+
+	hReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.policy.URL, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	hReq.Header.Set("Content-Type", "application/json")
+	for k, v := range w.policy.Headers {
+		hReq.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(hReq)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return decision, fmt.Errorf("webhook replied status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("parse webhook reply %s", err.Error())
+	}
+	return decision, nil
+}
+
+// limits return tunnel limits of decision, zero values of decision keep
+// values of base
+func (d WebhookDecision) limits(base connection.Limits) connection.Limits {
+	if d.MaxStreams > 0 {
+		base.MaxStreams = d.MaxStreams
+	}
+	if d.RateLimit > 0 {
+		base.Rate = d.RateLimit
+	}
+	return base
+}
+
+// admit implement connection.AdmitFunc, ask webhook for each visitor
+func (w *webhook) admit(ctx context.Context, arrs connection.Arrs, vConn net.Conn) error {
+	d, _ := w.decide(ctx, WebhookRequest{
+		Event:       WebhookVisitor,
+		UID:         arrs.UID,
+		ClientAddr:  arrs.Conn.RemoteAddr().String(),
+		Port:        arrs.BindPort,
+		VisitorAddr: vConn.RemoteAddr().String(),
+	})
+	if !d.Allow {
+		return fmt.Errorf("refused by webhook %s", d.Reason)
+	}
+	return nil
+}
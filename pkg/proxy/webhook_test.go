@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucheng0127/narwhal/pkg/connection"
+)
+
+// newWebhookServer reply decision of handler, and count requests
+func newWebhookServer(t *testing.T, handler func(req WebhookRequest) (int, WebhookDecision)) (*httptest.Server, *int64) {
+	var calls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		code, d := handler(req)
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(d)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestWebhook_decide(t *testing.T) {
+	srv, _ := newWebhookServer(t, func(req WebhookRequest) (int, WebhookDecision) {
+		if req.Metadata["server"] != "test" {
+			return http.StatusBadRequest, WebhookDecision{}
+		}
+		switch req.UID {
+		case "alice":
+			return http.StatusOK, WebhookDecision{Allow: req.Event != WebhookBind || req.Port == 22, MaxStreams: 2}
+		case "broken":
+			return http.StatusInternalServerError, WebhookDecision{}
+		default:
+			return http.StatusOK, WebhookDecision{Allow: false, Reason: "unknown user"}
+		}
+	})
+
+	tests := []struct {
+		name      string
+		url       string
+		failOpen  bool
+		req       WebhookRequest
+		wantAllow bool
+		wantErr   bool
+	}{
+		{name: "auth allowed", url: srv.URL, req: WebhookRequest{Event: WebhookAuth, UID: "alice"}, wantAllow: true},
+		{name: "bind allowed", url: srv.URL, req: WebhookRequest{Event: WebhookBind, UID: "alice", Port: 22}, wantAllow: true},
+		{name: "bind denied", url: srv.URL, req: WebhookRequest{Event: WebhookBind, UID: "alice", Port: 80}, wantAllow: false},
+		{name: "auth denied", url: srv.URL, req: WebhookRequest{Event: WebhookAuth, UID: "bob"}, wantAllow: false},
+		{name: "error fail closed", url: srv.URL, req: WebhookRequest{Event: WebhookAuth, UID: "broken"}, wantAllow: false, wantErr: true},
+		{name: "error fail open", url: srv.URL, failOpen: true, req: WebhookRequest{Event: WebhookAuth, UID: "broken"}, wantAllow: true, wantErr: true},
+		{name: "unreachable fail closed", url: "http://127.0.0.1:1", req: WebhookRequest{Event: WebhookAuth, UID: "alice"}, wantAllow: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWebhook(WebhookPolicy{
+				URL:      tt.url,
+				Timeout:  time.Second,
+				FailOpen: tt.failOpen,
+				Headers:  map[string]string{"Authorization": "Bearer token"},
+				Metadata: map[string]string{"server": "test"},
+			})
+			d, err := w.decide(context.Background(), tt.req)
+			if d.Allow != tt.wantAllow || (err != nil) != tt.wantErr {
+				t.Errorf("decide() = %+v, error %v, want allow %v error %v", d, err, tt.wantAllow, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhook_cache(t *testing.T) {
+	srv, calls := newWebhookServer(t, func(req WebhookRequest) (int, WebhookDecision) {
+		return http.StatusOK, WebhookDecision{Allow: true}
+	})
+	w := newWebhook(WebhookPolicy{
+		URL:      srv.URL,
+		CacheTTL: 100 * time.Millisecond,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	})
+
+	ctx := context.Background()
+	// Port of client address is not part of cache key
+	w.decide(ctx, WebhookRequest{Event: WebhookAuth, UID: "alice", ClientAddr: "10.0.0.1:5000"})
+	w.decide(ctx, WebhookRequest{Event: WebhookAuth, UID: "alice", ClientAddr: "10.0.0.1:5001"})
+	if n := atomic.LoadInt64(calls); n != 1 {
+		t.Errorf("webhook called %d times, want 1 with cache", n)
+	}
+	w.decide(ctx, WebhookRequest{Event: WebhookBind, UID: "alice", ClientAddr: "10.0.0.1:5000", Port: 22})
+	if n := atomic.LoadInt64(calls); n != 2 {
+		t.Errorf("webhook called %d times, want 2 for another event", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	w.decide(ctx, WebhookRequest{Event: WebhookAuth, UID: "alice", ClientAddr: "10.0.0.1:5000"})
+	if n := atomic.LoadInt64(calls); n != 3 {
+		t.Errorf("webhook called %d times, want 3 after ttl", n)
+	}
+	// Expired entries are evicted when caching
+	if len(w.cache) != 1 || len(w.expiry) != 1 {
+		t.Errorf("cached %d entries %d expiries, want 1", len(w.cache), len(w.expiry))
+	}
+}
+
+func TestProxyServer_webhook(t *testing.T) {
+	srv, _ := newWebhookServer(t, func(req WebhookRequest) (int, WebhookDecision) {
+		switch req.Event {
+		case WebhookAuth:
+			return http.StatusOK, WebhookDecision{Allow: req.UID == "alice", MaxStreams: 2, RateLimit: 10}
+		case WebhookBind:
+			return http.StatusOK, WebhookDecision{Allow: req.Port == 2222, MaxStreams: 5}
+		default:
+			return http.StatusOK, WebhookDecision{Allow: req.VisitorAddr != "pipe"}
+		}
+	})
+
+	// Users of store are not used with webhook
+	s := NewProxyServer(
+		Users(map[string]string{"bob": "0"}),
+		Webhook(WebhookPolicy{URL: srv.URL, Visitors: true, Headers: map[string]string{"Authorization": "Bearer token"}}),
+	).(*ProxyServer)
+
+	cConn, sConn := net.Pipe()
+	defer cConn.Close()
+	conn := connection.NewServerConnection(sConn)
+	ctx := context.Background()
+
+	if ok, err := s.authorize(ctx, conn, "bob"); ok || err != nil {
+		t.Errorf("authorize() user of store = %v, error %v, want refused", ok, err)
+	}
+	if ok, err := s.authorize(ctx, conn, "alice"); !ok || err != nil {
+		t.Fatalf("authorize() = %v, error %v, want allowed", ok, err)
+	}
+	conn.SetUID("alice")
+	if want := (connection.Limits{MaxStreams: 2, Rate: 10}); conn.GetArrs().Limits != want {
+		t.Errorf("limits of auth %+v, want %+v", conn.GetArrs().Limits, want)
+	}
+
+	if s.permitPort(ctx, conn, 80) {
+		t.Error("permitPort() port refused by webhook permitted")
+	}
+	if !s.permitPort(ctx, conn, 2222) {
+		t.Error("permitPort() port allowed by webhook not permitted")
+	}
+	if want := (connection.Limits{MaxStreams: 5, Rate: 10}); conn.GetArrs().Limits != want {
+		t.Errorf("limits of bind %+v, want %+v", conn.GetArrs().Limits, want)
+	}
+
+	vConn, _ := net.Pipe()
+	if err := s.webhook.admit(ctx, conn.GetArrs(), vConn); err == nil {
+		t.Error("admit() visitor refused by webhook admitted")
+	}
+}
@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// SchemeQUIC is scheme of quic transport
+const SchemeQUIC = "quic"
+
+const (
+	quicALPN            = "narwhal"
+	quicKeepAlive       = 15 * time.Second
+	quicMaxIdleTimeout  = 60 * time.Second
+	quicMaxStreams      = 4096 // Concurrent streams of a connection, a stream for each visitor
+	quicSessionCacheLen = 64
+)
+
+func init() {
+	Register(SchemeQUIC, &quicTransport{
+		conns:    make(map[string]quic.Connection),
+		sessions: tls.NewLRUClientSessionCache(quicSessionCacheLen),
+	})
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:    quicKeepAlive,
+		MaxIdleTimeout:     quicMaxIdleTimeout,
+		MaxIncomingStreams: quicMaxStreams,
+	}
+}
+
+// quicTransport carry each connection on a stream of a quic connection,
+// e.g. quic://example.com:8888. Dials to the same endpoint share the quic
+// connection, so control and proxy connections of a client are streams of
+// it. A new quic connection resumes the tls session, server certificate is
+// required to listen.
+//
+// 0-RTT is not used, data of it can be replayed, and the first request of
+// each connection is auth which must wait for the handshake anyway
+type quicTransport struct {
+	mu       sync.Mutex // Protect conns
+	conns    map[string]quic.Connection
+	sessions tls.ClientSessionCache // Session tickets for resumption
+}
+
+func (t *quicTransport) Listen(ep *Endpoint) (net.Listener, error) {
+	if ep.TLS == nil || (len(ep.TLS.Certificates) == 0 && ep.TLS.GetCertificate == nil) {
+		return nil, errors.New("tls certificate not set")
+	}
+	conf := ep.TLS.Clone()
+	conf.NextProtos = []string{quicALPN}
+	ln, err := quic.ListenAddr(ep.URL.Host, conf, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ql := &quicListener{ln: ln, streams: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go ql.serve()
+	return ql, nil
+}
+
+func (t *quicTransport) Dial(ctx context.Context, ep *Endpoint) (net.Conn, error) {
+	conn, err := t.connect(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{conn: conn, stream: stream}, nil
+}
+
+// connect return quic connection of ep alive, or dial a new one
+func (t *quicTransport) connect(ctx context.Context, ep *Endpoint) (quic.Connection, error) {
+	key := ep.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if conn, ok := t.conns[key]; ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	conf := ClientTLS(ep)
+	conf.NextProtos = []string{quicALPN}
+	if conf.ClientSessionCache == nil {
+		conf.ClientSessionCache = t.sessions
+	}
+	conn, err := quic.DialAddr(ctx, ep.URL.Host, conf, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	t.conns[key] = conn
+	return conn, nil
+}
+
+// quicListener accept streams of quic connections
+type quicListener struct {
+	ln      *quic.Listener
+	streams chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (l *quicListener) serve() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn accept streams of conn
+func (l *quicListener) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &quicConn{conn: conn, stream: stream}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stop listening, connections of it are closed
+func (l *quicListener) Close() error {
+	l.cancel()
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicConn is net.Conn of a quic stream
+type quicConn struct {
+	conn   quic.Connection
+	stream quic.Stream
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	return c.stream.Read(b)
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+// CloseWrite send EOF to peer, the stream can still be read
+func (c *quicConn) CloseWrite() error {
+	return c.stream.Close()
+}
+
+func (c *quicConn) Close() error {
+	c.stream.CancelRead(0)
+	return c.stream.Close()
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// serveEcho echo each connection accepted by ln
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func echoConn(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("echo got %q error %v, want %q", buf, err, msg)
+	}
+}
+
+func TestQUIC_resume(t *testing.T) {
+	serverTLS, pool := selfSigned(t)
+	listen := func(addr string) net.Listener {
+		ep, _ := Parse("quic://" + addr)
+		// A new ticket key for each listener, like a restarted server
+		ep.TLS = serverTLS.Clone()
+		ln, err := ep.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveEcho(ln)
+		return ln
+	}
+	ln := listen("127.0.0.1:0")
+	addr := ln.Addr().String()
+
+	tr := &quicTransport{conns: make(map[string]quic.Connection), sessions: tls.NewLRUClientSessionCache(quicSessionCacheLen)}
+	ep, _ := Parse("quic://" + addr)
+	ep.TLS = &tls.Config{RootCAs: pool}
+	dial := func() *quicConn {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		conn, err := tr.Dial(ctx, ep)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*quicConn)
+	}
+
+	// Streams of dials share the quic connection
+	first, second := dial(), dial()
+	echoConn(t, first, "first")
+	echoConn(t, second, "second")
+	if first.conn != second.conn {
+		t.Error("dials to the same endpoint not share quic connection")
+	}
+
+	// New quic connection resumes the tls session, 0-RTT is not used
+	first.conn.CloseWithError(0, "")
+	resumed := dial()
+	echoConn(t, resumed, "resumed")
+	state := resumed.conn.ConnectionState()
+	if resumed.conn == first.conn || !state.TLS.DidResume {
+		t.Error("new quic connection not resumed")
+	}
+	if state.Used0RTT {
+		t.Error("new quic connection used 0-RTT")
+	}
+
+	// Restarted server can't resume, a full handshake is done
+	resumed.conn.CloseWithError(0, "")
+	ln.Close()
+	ln = listen(addr)
+	defer ln.Close()
+	restarted := dial()
+	echoConn(t, restarted, "restarted")
+	if restarted.conn.ConnectionState().TLS.DidResume {
+		t.Error("session resumed by restarted server")
+	}
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Schemes of builtin transports
+const (
+	SchemeTCP  = "tcp"
+	SchemeTLS  = "tls"
+	SchemeUnix = "unix"
+)
+
+func init() {
+	Register(SchemeTCP, tcpTransport{})
+	Register(SchemeTLS, tlsTransport{})
+	Register(SchemeUnix, unixTransport{})
+}
+
+// tcpTransport carry connections over plain tcp, host of url is host:port
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(ep *Endpoint) (net.Listener, error) {
+	return net.Listen("tcp", ep.URL.Host)
+}
+
+func (tcpTransport) Dial(ctx context.Context, ep *Endpoint) (net.Conn, error) {
+	return dialTCP(ctx, ep, ep.URL.Host)
+}
+
+// tlsTransport is tcpTransport with tls, server certificate is required
+// to listen, server name is host of url when not set in tls config
+type tlsTransport struct{}
+
+func (tlsTransport) Listen(ep *Endpoint) (net.Listener, error) {
+	if ep.TLS == nil || (len(ep.TLS.Certificates) == 0 && ep.TLS.GetCertificate == nil) {
+		return nil, errors.New("tls certificate not set")
+	}
+	return tls.Listen("tcp", ep.URL.Host, ep.TLS)
+}
+
+func (tlsTransport) Dial(ctx context.Context, ep *Endpoint) (net.Conn, error) {
+	raw, err := dialTCP(ctx, ep, ep.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, ClientTLS(ep))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ClientTLS return tls config of ep for dialing, server name defaults to
+// host of url
+func ClientTLS(ep *Endpoint) *tls.Config {
+	conf := new(tls.Config)
+	if ep.TLS != nil {
+		conf = ep.TLS.Clone()
+	}
+	if len(conf.ServerName) == 0 && !conf.InsecureSkipVerify {
+		conf.ServerName = ep.URL.Hostname()
+	}
+	return conf
+}
+
+// ServerTLSConfig load certificate and key files of server
+func ServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate %s", err.Error())
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// ClientTLSConfig return tls config verifying server with CAs of caFile,
+// system roots when caFile is empty. Insecure skips the verification
+func ClientTLSConfig(caFile, serverName string, insecure bool) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure, MinVersion: tls.VersionTLS12}
+	if len(caFile) == 0 {
+		return conf, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read tls ca %s", err.Error())
+	}
+	conf.RootCAs = x509.NewCertPool()
+	if !conf.RootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in tls ca %s", caFile)
+	}
+	return conf, nil
+}
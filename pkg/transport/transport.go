@@ -0,0 +1,123 @@
+// Package transport carries control and proxy connections between narwhal
+// client and server, the transport is selected by scheme of the address,
+// e.g. tcp://example.com:8888, tls://example.com:8888,
+// unix:///run/narwhal.sock, wss://example.com/narwhal or
+// quic://example.com:8888. Clients may dial tcp based transports through
+// an HTTP CONNECT or SOCKS5 proxy
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transport listen and dial endpoints of its scheme
+//
+// Listen: listen on endpoint, accepted connections carry narwhal protocol
+// Dial: connect to endpoint listened by server
+type Transport interface {
+	Listen(ep *Endpoint) (net.Listener, error)
+	Dial(ctx context.Context, ep *Endpoint) (net.Conn, error)
+}
+
+var (
+	mu         sync.RWMutex
+	transports = make(map[string]Transport)
+)
+
+// Register make transport t available by scheme, it panics if scheme
+// registered already
+func Register(scheme string, t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := transports[scheme]; ok {
+		panic(fmt.Sprintf("transport [%s] registered twice", scheme))
+	}
+	transports[scheme] = t
+}
+
+// Schemes return sorted schemes of registered transports
+func Schemes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	schemes := make([]string, 0, len(transports))
+	for scheme := range transports {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func lookup(scheme string) (Transport, error) {
+	mu.RLock()
+	t, ok := transports[scheme]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("transport [%s] not one of %s", scheme, strings.Join(Schemes(), ", "))
+	}
+	return t, nil
+}
+
+// Endpoint is an address of a transport, TLS is the server certificate when
+// listening, roots and server name when dialing, used by tls based
+// transports. Proxy is the egress proxy dialing through, tcp based
+// transports only
+type Endpoint struct {
+	URL   *url.URL
+	TLS   *tls.Config
+	Proxy *url.URL
+}
+
+// Parse parse addr into endpoint, host:port without scheme is tcp
+func Parse(addr string) (*Endpoint, error) {
+	if !strings.Contains(addr, "://") {
+		addr = SchemeTCP + "://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lookup(u.Scheme); err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 && len(u.Path) == 0 {
+		return nil, fmt.Errorf("address of [%s] not set", addr)
+	}
+	return &Endpoint{URL: u}, nil
+}
+
+// TCP return tcp endpoint of host:port
+func TCP(addr string) *Endpoint {
+	return &Endpoint{URL: &url.URL{Scheme: SchemeTCP, Host: addr}}
+}
+
+func (ep *Endpoint) String() string {
+	return ep.URL.String()
+}
+
+// Listen listen on ep with transport of its scheme
+func (ep *Endpoint) Listen() (net.Listener, error) {
+	t, err := lookup(ep.URL.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(ep)
+}
+
+// Dial connect to ep with transport of its scheme
+func (ep *Endpoint) Dial(ctx context.Context) (net.Conn, error) {
+	t, err := lookup(ep.URL.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if ep.Proxy != nil && !ProxySupported(ep.URL.Scheme) {
+		return nil, fmt.Errorf("transport [%s] not dialed through proxy", ep.URL.Scheme)
+	}
+	return t.Dial(ctx, ep)
+}
@@ -0,0 +1,287 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// selfSigned return a tls config serving a certificate of 127.0.0.1 and
+// localhost, and the pool trusting it
+func selfSigned(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "narwhal"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       string
+		wantScheme string
+		wantHost   string
+		wantPath   string
+		wantErr    bool
+	}{
+		{name: "host port is tcp", addr: "127.0.0.1:8888", wantScheme: SchemeTCP, wantHost: "127.0.0.1:8888"},
+		{name: "tls", addr: "tls://example.com:8888", wantScheme: SchemeTLS, wantHost: "example.com:8888"},
+		{name: "listen all", addr: "tcp://:8888", wantScheme: SchemeTCP, wantHost: ":8888"},
+		{name: "unix", addr: "unix:///run/narwhal.sock", wantScheme: SchemeUnix, wantPath: "/run/narwhal.sock"},
+		{name: "unknown scheme", addr: "sctp://example.com:8888", wantErr: true},
+		{name: "address not set", addr: "tls://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, err := Parse(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ep.URL.Scheme != tt.wantScheme || ep.URL.Host != tt.wantHost || ep.URL.Path != tt.wantPath {
+				t.Errorf("Parse() = %s, want scheme %s host %s path %s", ep, tt.wantScheme, tt.wantHost, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestTransports(t *testing.T) {
+	serverTLS, pool := selfSigned(t)
+	sock := filepath.Join(t.TempDir(), "narwhal.sock")
+
+	tests := []struct {
+		name      string
+		listen    string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+		wantErr   bool
+	}{
+		{name: "tcp", listen: "tcp://127.0.0.1:0"},
+		{name: "tls", listen: "tls://127.0.0.1:0", serverTLS: serverTLS, clientTLS: &tls.Config{RootCAs: pool}},
+		{name: "tls server not trusted", listen: "tls://127.0.0.1:0", serverTLS: serverTLS, wantErr: true},
+		{name: "unix", listen: "unix://" + sock},
+		{name: "ws", listen: "ws://127.0.0.1:0/narwhal"},
+		{name: "wss", listen: "wss://127.0.0.1:0/narwhal", serverTLS: serverTLS, clientTLS: &tls.Config{RootCAs: pool}},
+		{name: "quic", listen: "quic://127.0.0.1:0", serverTLS: serverTLS, clientTLS: &tls.Config{RootCAs: pool}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep, err := Parse(tt.listen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep.TLS = tt.serverTLS
+			ln, err := ep.Listen()
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+
+			// Dial the address listened, port 0 is resolved
+			u := *ep.URL
+			if len(u.Host) != 0 {
+				u.Host = ln.Addr().String()
+			}
+			dEp := &Endpoint{URL: &u, TLS: tt.clientTLS}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := dEp.Dial(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("echo through %s got %q error %v", tt.name, buf, err)
+			}
+
+			// Connection is still usable after read timeout
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			var nErr net.Error
+			if _, err := conn.Read(buf); !errors.As(err, &nErr) || !nErr.Timeout() {
+				t.Errorf("read without data error %v, want timeout", err)
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			conn.Write([]byte("pong"))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+				t.Errorf("echo after timeout through %s got %q error %v", tt.name, buf, err)
+			}
+
+			// Half close, echo server closes when it reads EOF
+			conn.(interface{ CloseWrite() error }).CloseWrite()
+			if rest, err := io.ReadAll(conn); err != nil || len(rest) != 0 {
+				t.Errorf("read after close write got %q error %v, want EOF", rest, err)
+			}
+		})
+	}
+
+	ep, _ := Parse("tls://127.0.0.1:0")
+	if _, err := ep.Listen(); err == nil {
+		t.Error("Listen() tls without certificate succeed")
+	}
+}
+
+func TestForwardedAddr(t *testing.T) {
+	trusted, err := parseTrusted("10.0.0.1, 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+
+	tests := []struct {
+		name    string
+		peer    net.Addr
+		headers map[string]string
+		want    string
+	}{
+		{name: "last hop", peer: proxy, headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7"}, want: "203.0.113.7:0"},
+		{name: "skip trusted hops", peer: proxy, headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7, 192.168.1.1"}, want: "203.0.113.7:0"},
+		{name: "all hops trusted", peer: proxy, headers: map[string]string{"X-Forwarded-For": "192.168.1.2, 192.168.1.1"}, want: "192.168.1.2:0"},
+		{name: "real ip without forwarded for", peer: proxy, headers: map[string]string{"X-Real-IP": "203.0.113.7"}, want: "203.0.113.7:0"},
+		{name: "forwarded for over real ip", peer: proxy, headers: map[string]string{"X-Forwarded-For": "203.0.113.7", "X-Real-IP": "198.51.100.1"}, want: "203.0.113.7:0"},
+		{name: "peer not trusted", peer: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, headers: map[string]string{"X-Forwarded-For": "203.0.113.7"}},
+		{name: "malformed", peer: proxy, headers: map[string]string{"X-Forwarded-For": "unknown"}},
+		{name: "not set", peer: proxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/narwhal", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			addr := forwardedAddr(r, tt.peer, trusted)
+			if (addr == nil && len(tt.want) != 0) || (addr != nil && addr.String() != tt.want) {
+				t.Errorf("forwardedAddr() = %v, want %s", addr, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTrusted("10.0.0.1,nginx"); err == nil {
+		t.Error("parseTrusted() of hostname succeed")
+	}
+}
+
+func TestWebsocket_reverseProxy(t *testing.T) {
+	ep, _ := Parse("ws://127.0.0.1:0/narwhal?" + QueryTrustProxy + "=127.0.0.1")
+	ln, err := ep.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	// Reverse proxy terminating tls in front of server, like nginx
+	backend, _ := url.Parse("http://" + ln.Addr().String())
+	proxy := httptest.NewTLSServer(httputil.NewSingleHostReverseProxy(backend))
+	defer proxy.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(proxy.Certificate())
+
+	dEp, _ := Parse("wss://" + proxy.Listener.Addr().String() + "/narwhal")
+	dEp.TLS = &tls.Config{RootCAs: pool}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := dEp.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial() through reverse proxy error = %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("echo through reverse proxy got %q error %v", buf, err)
+	}
+	// Reverse proxy sets X-Forwarded-For of the client
+	if addr := <-remote; addr.String() != "127.0.0.1:0" {
+		t.Errorf("remote address %s, want address forwarded", addr)
+	}
+}
+
+func TestWebsocket_untrustedPeer(t *testing.T) {
+	ep, _ := Parse("ws://127.0.0.1:0/narwhal?" + QueryTrustProxy + "=10.0.0.1")
+	ln, err := ep.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	// Client forges X-Forwarded-For, it's not a trusted proxy
+	header := http.Header{"X-Forwarded-For": []string{"203.0.113.7"}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/narwhal", header)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer ws.Close()
+	if addr := <-remote; addr.String() != ws.LocalAddr().String() {
+		t.Errorf("remote address %s, want peer address %s", addr, ws.LocalAddr())
+	}
+}
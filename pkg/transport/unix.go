@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// unixTransport carry connections over unix domain socket, path of url is
+// the socket file, e.g. unix:///run/narwhal.sock
+type unixTransport struct{}
+
+func (unixTransport) Listen(ep *Endpoint) (net.Listener, error) {
+	path := ep.URL.Path
+	// Socket file left by a server not exited cleanly blocks listening,
+	// remove it when nobody accepts on it
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func (unixTransport) Dial(ctx context.Context, ep *Endpoint) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, "unix", ep.URL.Path)
+}
@@ -0,0 +1,429 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Schemes of websocket transports
+const (
+	SchemeWS  = "ws"
+	SchemeWSS = "wss"
+)
+
+// Websocket options in query of url
+const (
+	// QueryTrustProxy is comma separated ips or cidrs of reverse proxies
+	// like nginx, remote address of connections from them is taken from
+	// X-Forwarded-For or X-Real-IP
+	QueryTrustProxy = "trustProxy"
+)
+
+const (
+	wsPingInterval      = 30 * time.Second // Keep idle connections through proxies
+	wsReadHeaderTimeout = 10 * time.Second
+	wsChunkSize         = 32 * 1024 // Data read from a message at a time
+)
+
+func init() {
+	Register(SchemeWS, wsTransport{})
+	Register(SchemeWSS, wsTransport{secure: true})
+}
+
+// wsTransport carry connections in binary websocket messages, the server
+// accepts upgrades on path of url, e.g. ws://:8888/narwhal. Wss listens
+// with tls, or ws behind a reverse proxy terminating tls is dialed with wss
+type wsTransport struct {
+	secure bool
+}
+
+func (t wsTransport) Listen(ep *Endpoint) (net.Listener, error) {
+	trusted, err := parseTrusted(ep.URL.Query().Get(QueryTrustProxy))
+	if err != nil {
+		return nil, err
+	}
+
+	var ln net.Listener
+	if t.secure {
+		ln, err = tlsTransport{}.Listen(ep)
+	} else {
+		ln, err = net.Listen("tcp", ep.URL.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path := ep.URL.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	wl := &wsListener{
+		ln:      ln,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+		trusted: trusted,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, wl.upgrade)
+	wl.srv = &http.Server{Handler: mux, ReadHeaderTimeout: wsReadHeaderTimeout}
+	go wl.srv.Serve(ln)
+	return wl, nil
+}
+
+func (t wsTransport) Dial(ctx context.Context, ep *Endpoint) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: wsReadHeaderTimeout,
+		NetDialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialTCP(ctx, ep, addr)
+		},
+	}
+	if t.secure {
+		dialer.TLSClientConfig = ClientTLS(ep)
+	}
+	ws, _, err := dialer.DialContext(ctx, ep.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws, ws.RemoteAddr()), nil
+}
+
+// wsListener accept connections upgraded by its http server
+type wsListener struct {
+	ln        net.Listener
+	srv       *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	trusted   []*net.IPNet // Reverse proxies trusted
+}
+
+// parseTrusted parse comma separated ips or cidrs
+func parseTrusted(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%s [%s] not an ip or cidr", QueryTrustProxy, item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s [%s] not an ip or cidr", QueryTrustProxy, item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var upgrader = websocket.Upgrader{
+	// Clients are not browsers, origin means nothing
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (l *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrader replied the error
+		return
+	}
+
+	remote := ws.RemoteAddr()
+	if addr := forwardedAddr(r, remote, l.trusted); addr != nil {
+		remote = addr
+	}
+	conn := newWSConn(ws, remote)
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// forwardedAddr return client address set by trusted reverse proxies of
+// peer. Proxies append the address they see to X-Forwarded-For, entries
+// before are set by client, so it's the last hop not a trusted proxy.
+// X-Real-IP is used when X-Forwarded-For not set. Nil when peer is not
+// trusted or headers malformed
+func forwardedAddr(r *http.Request, peer net.Addr, trusted []*net.IPNet) net.Addr {
+	tcpAddr, ok := peer.(*net.TCPAddr)
+	if !ok || !contains(trusted, tcpAddr.IP) {
+		return nil
+	}
+
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = []string{r.Header.Get("X-Real-IP")}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if i == 0 || !contains(trusted, ip) {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	return nil
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.srv.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// wsConn is net.Conn of binary messages of a websocket, an empty message
+// is EOF of the writer so the connection can be half closed. Messages are
+// read by a pump, a websocket fails for good once its read timeout, so read
+// deadline is on the pump output
+type wsConn struct {
+	ws       *websocket.Conn
+	remote   net.Addr
+	chunks   chan []byte // Data of messages, closed with rErr set when read stopped
+	rErr     error
+	pending  []byte // Rest of the chunk in reading
+	deadline wsDeadline
+	wMu      sync.Mutex // Messages are written by one writer at a time
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newWSConn(ws *websocket.Conn, remote net.Addr) *wsConn {
+	c := &wsConn{ws: ws, remote: remote, chunks: make(chan []byte), done: make(chan struct{})}
+	go c.pump()
+	go c.keepalive()
+	return c
+}
+
+// keepalive ping peer, proxies close connections idle for a while
+func (c *wsConn) keepalive() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsPingInterval)) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// pump read binary messages into chunks until EOF, error or closed
+func (c *wsConn) pump() {
+	defer close(c.chunks)
+	for {
+		mt, r, err := c.ws.NextReader()
+		if err != nil {
+			var cErr *websocket.CloseError
+			if errors.As(err, &cErr) && cErr.Code == websocket.CloseNormalClosure {
+				err = io.EOF
+			}
+			c.rErr = err
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+
+		got := false
+		for {
+			buf := make([]byte, wsChunkSize)
+			n, err := r.Read(buf)
+			if n > 0 {
+				got = true
+				select {
+				case c.chunks <- buf[:n]:
+				case <-c.done:
+					c.rErr = net.ErrClosed
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				c.rErr = err
+				return
+			}
+		}
+		if !got {
+			c.rErr = io.EOF
+			return
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.rErr
+			}
+			c.pending = chunk
+		case <-c.deadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite send EOF to peer by an empty message
+func (c *wsConn) CloseWrite() error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, nil)
+}
+
+func (c *wsConn) Close() error {
+	c.doneOnce.Do(func() {
+		close(c.done)
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	})
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.deadline.set(t)
+	return nil
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// wsDeadline is a deadline can be set again after it passed, its channel
+// is closed when the deadline passed
+type wsDeadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	gen   int // Timers of earlier sets may fire after stopped
+	ch    chan struct{}
+}
+
+func (d *wsDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+	if d.ch == nil || isClosed(d.ch) {
+		d.ch = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.ch)
+		return
+	}
+	gen := d.gen
+	d.timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.gen == gen {
+			close(d.ch)
+		}
+	})
+}
+
+func (d *wsDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}